@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/twilio/twilio-go/client"
+)
+
+const defaultAccountName = "default"
+
+/*
+ Besides the account from the Twilio SID and Token settings, more accounts can
+ be configured as a JSON list. A subaccount without an API key of its own
+ sends its requests with its SID and the auth token of the master account it
+ names as the parent.
+
+	[
+		{"name": "brand-a", "account_sid": "AC...", "auth_token": "..."},
+		{"name": "brand-b", "account_sid": "AC...", "auth_token": "...", "parent": "default"},
+		{"name": "brand-c", "account_sid": "AC...", "auth_token": "...", "api_key_sid": "SK...", "api_key_secret": "..."}
+	]
+
+ When an API key is given it is used for all requests instead of the auth
+ token. Every account still needs its own auth token, as Twilio signs the
+ webhooks of an account with it and unsigned webhooks are rejected.
+
+ Accounts use the region and edge from the settings unless they set their own
+ "region" and "edge". Subaccounts default to the region of their parent.
+*/
+
+type twilioAccount struct {
+	Name         string `json:"name"`
+	AccountSid   string `json:"account_sid"`
+	AuthToken    string `json:"auth_token,omitempty"`
+	ApiKeySid    string `json:"api_key_sid,omitempty"`
+	ApiKeySecret string `json:"api_key_secret,omitempty"`
+	Parent       string `json:"parent,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Edge         string `json:"edge,omitempty"`
+
+	// Credentials used to authenticate requests for this account, taken from
+	// the parent for subaccounts.
+	Username string `json:"-"`
+	Password string `json:"-"`
+}
+
+// parseTwilioAccounts builds the account list from the configuration, with the
+// account from the SID and Token settings first.
+func parseTwilioAccounts(configuration *configuration) ([]*twilioAccount, error) {
+	accounts := []*twilioAccount{{
+		Name:         defaultAccountName,
+		AccountSid:   configuration.TwilioSid,
+		AuthToken:    configuration.TwilioToken,
+		ApiKeySid:    configuration.TwilioApiKeySid,
+		ApiKeySecret: configuration.TwilioApiKeySecret,
+		Region:       configuration.TwilioRegion,
+		Edge:         configuration.TwilioEdge,
+	}}
+
+	if strings.TrimSpace(configuration.TwilioAccounts) != "" {
+		var extra []*twilioAccount
+		if err := json.Unmarshal([]byte(configuration.TwilioAccounts), &extra); err != nil {
+			return nil, errors.Wrap(err, "failed to parse Twilio accounts")
+		}
+		accounts = append(accounts, extra...)
+	}
+
+	byName := map[string]*twilioAccount{}
+	for _, account := range accounts {
+		if account.Name == "" || account.AccountSid == "" {
+			return nil, errors.New("every Twilio account needs a name and an account SID")
+		}
+		if _, ok := byName[account.Name]; ok {
+			return nil, errors.Errorf("Twilio account %s is configured more than once", account.Name)
+		}
+		if account.AuthToken == "" {
+			return nil, errors.Errorf("Twilio account %s needs its auth token to validate webhook signatures", account.Name)
+		}
+		byName[account.Name] = account
+	}
+
+	// Resolve the accounts with their own credentials first so subaccounts can
+	// take them from their parent afterwards
+	for _, account := range accounts {
+		if (account.ApiKeySid == "") != (account.ApiKeySecret == "") {
+			return nil, errors.Errorf("Twilio account %s needs both an API key SID and secret", account.Name)
+		}
+		if account.ApiKeySid != "" {
+			account.Username = account.ApiKeySid
+			account.Password = account.ApiKeySecret
+			continue
+		}
+		if account.Parent == "" {
+			account.Username = account.AccountSid
+			account.Password = account.AuthToken
+		}
+	}
+	for _, account := range accounts {
+		if account.Username != "" {
+			continue
+		}
+		parent, ok := byName[account.Parent]
+		if !ok || parent.Parent != "" {
+			return nil, errors.Errorf("Twilio account %s has an invalid parent account %s", account.Name, account.Parent)
+		}
+		// Conversations and media URLs carry no account SID, Twilio takes the
+		// account from the username. The parent auth token is accepted for
+		// its subaccounts.
+		account.Username = account.AccountSid
+		account.Password = parent.AuthToken
+		if account.Region == "" {
+			account.Region = parent.Region
+		}
+		if account.Edge == "" {
+			account.Edge = parent.Edge
+		}
+	}
+	for _, account := range accounts {
+		if account.Region == "" {
+			account.Region = configuration.TwilioRegion
+		}
+		if account.Edge == "" {
+			account.Edge = configuration.TwilioEdge
+		}
+	}
+	return accounts, nil
+}
+
+// checkTwilioAccount makes sure the credentials of the account are accepted
+// by Twilio in its configured region. Twilio credentials are region specific,
+// so an account used with the wrong region fails to authenticate. The error
+// is only set when Twilio could not be asked.
+func checkTwilioAccount(account *twilioAccount, httpClient *http.Client) (bool, error) {
+	restClient := newTwilioRestClient(account, httpClient)
+	if _, err := restClient.Api.FetchAccount(account.AccountSid); err != nil {
+		var restErr *client.TwilioRestError
+		if errors.As(err, &restErr) && (restErr.Status == http.StatusUnauthorized || restErr.Status == http.StatusNotFound) {
+			return false, nil
+		}
+		return true, errors.Wrapf(err, "could not check Twilio account %s", account.Name)
+	}
+	return true, nil
+}
+
+// twilioAccountsEqual reports whether two account lists would build the same
+// clients.
+func twilioAccountsEqual(a, b []*twilioAccount) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// findTwilioAccount finds a configured account by name or account SID.
+func (p *TwilioPlugin) findTwilioAccount(selector string) *twilioAccount {
+	for _, account := range p.getConfiguration().Accounts {
+		if strings.EqualFold(account.Name, selector) || account.AccountSid == selector {
+			return account
+		}
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) initializeTwilioClients() {
+	clients := map[string]ITwilioClient{}
+	var defaultClient ITwilioClient
+	for _, account := range p.getConfiguration().Accounts {
+		client := newCachedTwilioClient(p, NewTwilioClient(p, account))
+		clients[account.AccountSid] = client
+		if defaultClient == nil {
+			defaultClient = client
+		}
+	}
+	if defaultClient == nil {
+		defaultClient = NewTwilioClient(p, &twilioAccount{Name: defaultAccountName})
+	}
+
+	// Swap all clients at once so requests never see a mix of old and new
+	p.twilioLock.Lock()
+	defer p.twilioLock.Unlock()
+	p.twilio = defaultClient
+	p.twilioClients = clients
+}
+
+// getTwilioClient returns the client for the given account, or the default
+// client when the account is empty or unknown.
+func (p *TwilioPlugin) getTwilioClient(accountSid string) ITwilioClient {
+	p.twilioLock.RLock()
+	defer p.twilioLock.RUnlock()
+
+	if client, ok := p.twilioClients[accountSid]; ok {
+		return client
+	}
+	return p.twilio
+}
+
+// hasTwilioAccount reports whether a client exists for the account SID.
+func (p *TwilioPlugin) hasTwilioAccount(accountSid string) bool {
+	p.twilioLock.RLock()
+	defer p.twilioLock.RUnlock()
+
+	_, ok := p.twilioClients[accountSid]
+	return ok
+}
+
+// getSettingsTwilioClient returns the client for the account a conversation
+// belongs to.
+func (p *TwilioPlugin) getSettingsTwilioClient(settings *conversationSettings) ITwilioClient {
+	if settings == nil {
+		return p.getTwilioClient("")
+	}
+	return p.getTwilioClient(settings.AccountSid)
+}
+
+// commandTwilioClient returns the client for the account selected in a
+// command, falling back to the account of the conversation it is about.
+func (p *TwilioPlugin) commandTwilioClient(selected *twilioAccount, settings *conversationSettings) ITwilioClient {
+	if selected != nil {
+		return p.getTwilioClient(selected.AccountSid)
+	}
+	return p.getSettingsTwilioClient(settings)
+}
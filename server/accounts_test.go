@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestParseTwilioAccounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts string
+		username string
+		password string
+		err      string
+	}{{
+		name:     "own auth token",
+		accounts: `[{"name": "brand", "account_sid": "AC2", "auth_token": "token2"}]`,
+		username: "AC2",
+		password: "token2",
+	}, {
+		name:     "own API key",
+		accounts: `[{"name": "brand", "account_sid": "AC2", "auth_token": "token2", "api_key_sid": "SK2", "api_key_secret": "secret2", "parent": "default"}]`,
+		username: "SK2",
+		password: "secret2",
+	}, {
+		name:     "subaccount uses its SID with the parent token",
+		accounts: `[{"name": "brand", "account_sid": "AC2", "auth_token": "token2", "parent": "default"}]`,
+		username: "AC2",
+		password: "token1",
+	}, {
+		name:     "parent with an API key",
+		accounts: `[{"name": "parent", "account_sid": "AC3", "auth_token": "token3", "api_key_sid": "SK3", "api_key_secret": "secret3"}, {"name": "brand", "account_sid": "AC2", "auth_token": "token2", "parent": "parent"}]`,
+		username: "AC2",
+		password: "token3",
+	}, {
+		name:     "parent is a subaccount",
+		accounts: `[{"name": "middle", "account_sid": "AC3", "auth_token": "token3", "parent": "default"}, {"name": "brand", "account_sid": "AC2", "auth_token": "token2", "parent": "middle"}]`,
+		err:      "Twilio account brand has an invalid parent account middle",
+	}, {
+		name:     "unknown parent",
+		accounts: `[{"name": "brand", "account_sid": "AC2", "auth_token": "token2", "parent": "gone"}]`,
+		err:      "Twilio account brand has an invalid parent account gone",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			accounts, err := parseTwilioAccounts(&configuration{TwilioSid: "AC1", TwilioToken: "token1", TwilioAccounts: test.accounts})
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("parseTwilioAccounts error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTwilioAccounts failed: %v", err)
+			}
+			var brand *twilioAccount
+			for _, account := range accounts {
+				if account.Name == "brand" {
+					brand = account
+				}
+			}
+			if brand == nil {
+				t.Fatal("account brand is missing")
+			}
+			if brand.Username != test.username || brand.Password != test.password {
+				t.Fatalf("credentials = %s:%s, want %s:%s", brand.Username, brand.Password, test.username, test.password)
+			}
+		})
+	}
+}
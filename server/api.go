@@ -3,40 +3,64 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/twilio/twilio-go/client"
 )
 
 func (p *TwilioPlugin) initializeRouter() {
 	router := mux.NewRouter()
 	// hostname/plugins/sx.paul.mattermost.twilio/twilio/conversation
 	router.HandleFunc("/twilio/conversation", p.handleTwilioConversation).Methods("POST")
+	// Backup and restore of the plugin state, system admins only
+	router.HandleFunc("/backup", p.handleBackupExport).Methods("GET")
+	router.HandleFunc("/backup", p.handleBackupRestore).Methods("POST")
+	router.HandleFunc(channelListActionPath, p.handleChannelListAction).Methods("POST")
+	router.HandleFunc(conversationPickActionPath, p.handleConversationPick).Methods("POST")
+	router.HandleFunc(autocompletePath, p.handleAutocomplete).Methods("GET")
+	router.HandleFunc(dialogOpenPath, p.handleDialogOpen).Methods("POST")
+	router.HandleFunc(dialogPath, p.handleDialogSubmit).Methods("POST")
 
 	p.router = router
 }
 
 func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.Request) {
 
-	configuration := p.getConfiguration()
 	/*body, err := io.ReadAll(r.Body)
 	p.API.LogDebug("handleTwilioConversation", "body", string(body))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}*/
+	// Let Twilio retry the webhook when it arrives during deactivation
+	done, ok := p.trackWork()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+	ctx := r.Context()
+
 	if err := r.ParseForm(); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	p.API.LogInfo("Twilio Webhook", "form", r.Form)
 	accountSid := r.FormValue("AccountSid")
-	if accountSid == "" || accountSid != configuration.TwilioSid {
-		p.API.LogWarn("Invalid or missing AccountSid", "provided", accountSid, "expected", configuration.TwilioSid)
+	if !p.hasTwilioAccount(accountSid) {
+		p.API.LogWarn("Invalid or missing AccountSid", "provided", accountSid)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !p.validateTwilioSignature(r, p.findTwilioAccount(accountSid)) {
+		p.API.LogWarn("Invalid Twilio signature", "account_sid", accountSid)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
 	p.API.LogDebug("Message", "EventType", r.FormValue("EventType"))
 	eventType := r.FormValue("EventType")
@@ -44,10 +68,11 @@ func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.R
 	case "onConversationAdded":
 
 	case "onConversationRemoved":
+		p.invalidateConversationCache(r.FormValue("ConversationSid"))
+		p.invalidateParticipantsCache(r.FormValue("ConversationSid"))
 
-	case "onConversationUpdated":
-
-	case "onConversationStateUpdated":
+	case "onConversationUpdated", "onConversationStateUpdated":
+		p.invalidateConversationCache(r.FormValue("ConversationSid"))
 
 	case "onMessageAdded":
 		p.API.LogDebug("onMessageAdded")
@@ -57,11 +82,33 @@ func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.R
 		body := r.FormValue("Body")
 		messageSid := r.FormValue("MessageSid")
 		ChatServiceSid := r.FormValue("ChatServiceSid")
+		p.noteConversationActivity(ctx, accountSid, conversationSid)
+
+		// Give the configured flows a chance to answer before anything is posted
+		outcome, err := p.runConversationFlow(ctx, accountSid, conversationSid, body)
+		if err != nil {
+			p.API.LogError("Could not run conversation flow", "sid", conversationSid, "error", err.Error())
+		}
+		if outcome != nil && outcome.Handled {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
 		// Handle message added logic here
-		settings, err := p.getOrCreateConversationSettings(conversationSid)
+		var settings *conversationSettings
+		if outcome != nil && outcome.Action == flowActionRoute {
+			settings, err = p.routeConversationToChannel(ctx, accountSid, conversationSid, outcome.Channel, author)
+		} else {
+			settings, err = p.getOrCreateConversationSettings(ctx, accountSid, conversationSid, author, body)
+		}
 		if err != nil {
-			// Conversation does not have channel settings
+			// Conversation does not have channel settings, let Twilio retry
+			// when it was only unavailable for a moment
+			if isRetryableTwilioError(err) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(err.Error()))
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
@@ -95,6 +142,9 @@ func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.R
 				"twilio_message_sid":      messageSid,
 			},
 		}
+		if settings.Type == "post" {
+			post.RootId = settings.RootPostId
+		}
 		newpost, errp := p.API.CreatePost(post)
 		if errp != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -113,7 +163,7 @@ func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.R
 			for _, item := range items {
 				if sid, ok := item["Sid"].(string); ok {
 					if Filename, ok := item["Filename"].(string); ok {
-						resp, err := p.twilio.DownloadMedia(ChatServiceSid, sid)
+						resp, err := p.getSettingsTwilioClient(settings).DownloadMedia(ctx, ChatServiceSid, sid)
 						if err != nil {
 							p.API.LogError("Could not download media", "error", err.Error())
 							return
@@ -138,11 +188,11 @@ func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.R
 
 	case "onMessageRemoved":
 
-	case "onParticipantAdded":
-
-	case "onParticipantRemoved":
-
-	case "onParticipantUpdated":
+	case "onParticipantAdded", "onParticipantRemoved", "onParticipantUpdated":
+		p.invalidateParticipantsCache(r.FormValue("ConversationSid"))
+		if eventType == "onParticipantAdded" {
+			p.indexConversationNumber(accountSid, r.FormValue("MessagingBinding.ProxyAddress"), r.FormValue("ConversationSid"))
+		}
 
 	case "onDeliveryUpdated":
 
@@ -155,6 +205,57 @@ func (p *TwilioPlugin) handleTwilioConversation(w http.ResponseWriter, r *http.R
 	w.WriteHeader(http.StatusOK)
 }
 
+// validateTwilioSignature checks the X-Twilio-Signature header against the
+// auth token of the account. Twilio signs the URL it posted to, which is the
+// configured webhook URL, or the old one for webhooks that were not moved
+// after a site URL change.
+func (p *TwilioPlugin) validateTwilioSignature(r *http.Request, account *twilioAccount) bool {
+	if account == nil {
+		return false
+	}
+	if account.AuthToken == "" {
+		p.API.LogWarn("No auth token configured, rejecting webhook", "account", account.Name)
+		return false
+	}
+	params := map[string]string{}
+	for key, values := range r.PostForm {
+		if len(values) > 0 {
+			params[key] = values[0]
+		}
+	}
+	validator := client.NewRequestValidator(account.AuthToken)
+	signature := r.Header.Get("X-Twilio-Signature")
+	for _, signed := range p.signedWebhookURLs(r) {
+		if validator.Validate(signed, params, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// signedWebhookURLs returns the URLs the request may have been signed with.
+// The host of the request is not trusted, it only decides whether the webhook
+// URL in use before the last change is tried as well.
+func (p *TwilioPlugin) signedWebhookURLs(r *http.Request) []string {
+	webhooks := []string{p.getWebhookURL()}
+	if previous, err := p.getPreviousWebhookURL(); err != nil {
+		p.API.LogWarn("Could not get previous webhook URL", "error", err.Error())
+	} else if parsed, perr := url.Parse(previous); previous != "" && perr == nil && strings.EqualFold(parsed.Host, r.Host) {
+		webhooks = append(webhooks, previous)
+	}
+
+	var signed []string
+	for _, webhook := range webhooks {
+		parsed, err := url.Parse(webhook)
+		if err != nil {
+			continue
+		}
+		parsed.RawQuery = r.URL.RawQuery
+		signed = append(signed, parsed.String())
+	}
+	return signed
+}
+
 func (p *TwilioPlugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
 	p.API.LogDebug("ServeHTTP", "path", r.URL.Path)
 	if p.router != nil {
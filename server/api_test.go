@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// testSiteAPI is the KV test API with a site URL.
+type testSiteAPI struct {
+	*testKVAPI
+	siteURL string
+}
+
+func (api *testSiteAPI) GetConfig() *model.Config {
+	return &model.Config{ServiceSettings: model.ServiceSettings{SiteURL: &api.siteURL}}
+}
+
+// twilioSignature signs the form posted to the URL like Twilio does.
+func twilioSignature(authToken, signedURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := signedURL
+	for _, key := range keys {
+		data += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidateTwilioSignature(t *testing.T) {
+	const webhookPath = "/plugins/sx.paul.mattermost.twilio/twilio/conversation"
+	api := &testSiteAPI{testKVAPI: newTestKVAPI(), siteURL: "https://chat.example.com"}
+	p := &TwilioPlugin{}
+	p.SetAPI(api)
+	api.KVSet(previousWebhookURLKey, []byte("https://old.example.com"+webhookPath))
+	account := &twilioAccount{Name: "default", AuthToken: "token"}
+	form := url.Values{"EventType": {"onMessageAdded"}, "Body": {"hi"}}
+
+	tests := []struct {
+		name      string
+		host      string
+		signedURL string
+		valid     bool
+	}{
+		{"configured webhook", "chat.example.com", "https://chat.example.com" + webhookPath, true},
+		{"configured webhook behind another host", "internal:8065", "https://chat.example.com" + webhookPath, true},
+		{"previous webhook", "old.example.com", "https://old.example.com" + webhookPath, true},
+		{"previous webhook with another host", "chat.example.com", "https://old.example.com" + webhookPath, false},
+		{"URL of the request host", "evil.example.com", "https://evil.example.com" + webhookPath, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/twilio/conversation", strings.NewReader(form.Encode()))
+			r.Host = test.host
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Twilio-Signature", twilioSignature("token", test.signedURL, form))
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("ParseForm failed: %v", err)
+			}
+			if got := p.validateTwilioSignature(r, account); got != test.valid {
+				t.Fatalf("validateTwilioSignature = %v, want %v", got, test.valid)
+			}
+		})
+	}
+}
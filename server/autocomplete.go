@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+const (
+	// Called by the Mattermost server for the suggestions of dynamic list
+	// arguments while a command is typed
+	autocompletePath        = "/autocomplete/{list}"
+	autocompleteNumbersURL  = "/plugins/sx.paul.mattermost.twilio/autocomplete/numbers"
+	autocompleteRecentURL   = "/plugins/sx.paul.mattermost.twilio/autocomplete/conversations"
+	autocompleteUnlinkedURL = "/plugins/sx.paul.mattermost.twilio/autocomplete/unlinked"
+
+	// Suggestion candidates are cached for a few minutes, new numbers and
+	// conversations show up after that
+	cacheAutocompletePrefix = "twilio-cache-ac-"
+	autocompleteCacheTTL    = 5 * 60
+
+	// Conversations of the first listing page offered as suggestions
+	autocompleteConversations = 50
+	maxAutocompleteItems      = 25
+)
+
+// handleAutocomplete serves the suggestions of a dynamic list argument,
+// filtered by what the user typed so far. The candidates are cached per
+// account, so typing does not go to Twilio on every key press.
+func (p *TwilioPlugin) handleAutocomplete(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	if userId == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	userInput := query.Get("user_input")
+	_, selector := extractAccountSelector(strings.Fields(userInput))
+	var account *twilioAccount
+	if selector != "" {
+		account = p.findTwilioAccount(selector)
+	}
+	twilioClient := p.commandTwilioClient(account, nil)
+
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+	defer cancel()
+	var items []model.AutocompleteListItem
+	var err error
+	switch mux.Vars(r)["list"] {
+	case "numbers":
+		items, err = p.numberSuggestions(ctx, twilioClient)
+	case "conversations":
+		items, err = p.conversationSuggestions(ctx, twilioClient)
+	case "unlinked":
+		items, err = p.conversationSuggestions(ctx, twilioClient)
+		items = p.withoutLinked(items)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		p.API.LogWarn("Could not get autocomplete suggestions", "list", mux.Vars(r)["list"], "error", err.Error())
+		items = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filterSuggestions(items, typedArgument(userInput, query.Get("parsed"))))
+}
+
+// numberSuggestions returns the phone numbers of the account.
+func (p *TwilioPlugin) numberSuggestions(ctx context.Context, twilioClient ITwilioClient) ([]model.AutocompleteListItem, error) {
+	account := twilioClient.Account()
+	key := cacheAutocompletePrefix + "numbers-" + account.AccountSid
+	var items []model.AutocompleteListItem
+	if p.getCached(key, &items) {
+		return items, nil
+	}
+	numbers, err := twilioClient.AccountNumbers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items = []model.AutocompleteListItem{}
+	for _, num := range numbers {
+		if num.PhoneNumber == nil {
+			continue
+		}
+		items = append(items, model.AutocompleteListItem{
+			Item:     *num.PhoneNumber,
+			HelpText: "Number of Twilio account " + account.Name,
+		})
+	}
+	p.setCached(key, items, autocompleteCacheTTL)
+	return items, nil
+}
+
+// conversationSuggestions returns the first page of conversations of the
+// account with their participants, sorted by last activity.
+func (p *TwilioPlugin) conversationSuggestions(ctx context.Context, twilioClient ITwilioClient) ([]model.AutocompleteListItem, error) {
+	key := cacheAutocompletePrefix + "conversations-" + twilioClient.Account().AccountSid
+	var items []model.AutocompleteListItem
+	if p.getCached(key, &items) {
+		return items, nil
+	}
+	page, err := twilioClient.ListConversationsPage(ctx, &conversationFilter{}, "", autocompleteConversations)
+	if err != nil {
+		return nil, err
+	}
+	results := fetchAll(ctx, page.Conversations, func(ctx context.Context, conv twiliov1.ConversationsV1Conversation) ([]string, error) {
+		return twilioClient.GetConversationParticipants(ctx, *conv.Sid)
+	})
+	items = []model.AutocompleteListItem{}
+	for i, result := range results {
+		conv := &page.Conversations[i]
+		item := model.AutocompleteListItem{Item: *conv.Sid}
+		if conv.FriendlyName != nil {
+			item.Hint = *conv.FriendlyName
+		}
+		var details []string
+		if result.Err == nil && len(result.Value) > 0 {
+			details = append(details, strings.Join(result.Value, ", "))
+		}
+		if conv.State != nil {
+			details = append(details, *conv.State)
+		}
+		if activity := lastActivity(conv); !activity.IsZero() {
+			details = append(details, "last activity "+activity.UTC().Format("2006-01-02 15:04"))
+		}
+		item.HelpText = strings.Join(details, ", ")
+		items = append(items, item)
+	}
+	p.setCached(key, items, autocompleteCacheTTL)
+	return items, nil
+}
+
+// withoutLinked drops the conversations already linked to a channel.
+func (p *TwilioPlugin) withoutLinked(items []model.AutocompleteListItem) []model.AutocompleteListItem {
+	var unlinked []model.AutocompleteListItem
+	for _, item := range items {
+		if settings, err := p.store.Get(item.Item); err == nil && settings == nil {
+			unlinked = append(unlinked, item)
+		}
+	}
+	return unlinked
+}
+
+// typedArgument returns what the user typed of the argument being completed.
+func typedArgument(userInput, parsed string) string {
+	if parsed != "" && strings.HasPrefix(userInput, parsed) {
+		return strings.TrimSpace(userInput[len(parsed):])
+	}
+	fields := strings.Fields(userInput)
+	if len(fields) == 0 || strings.HasSuffix(userInput, " ") {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+// filterSuggestions keeps the items mentioning the typed text anywhere.
+func filterSuggestions(items []model.AutocompleteListItem, typed string) []model.AutocompleteListItem {
+	typed = strings.ToLower(typed)
+	filtered := []model.AutocompleteListItem{}
+	for _, item := range items {
+		text := strings.ToLower(item.Item + " " + item.Hint + " " + item.HelpText)
+		if strings.Contains(text, typed) {
+			filtered = append(filtered, item)
+		}
+		if len(filtered) == maxAutocompleteItems {
+			break
+		}
+	}
+	return filtered
+}
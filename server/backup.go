@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Layout of the backup files, raised when it changes
+	backupVersion = 1
+	// Largest backup accepted by the restore endpoint
+	maxBackupSize = 50 * 1024 * 1024
+
+	// On conflicts skip keeps the current item and merge takes the backed up
+	// one. Overwrite takes the backed up one as well and also removes the items
+	// missing from the backup.
+	backupModeSkip      = "skip"
+	backupModeMerge     = "merge"
+	backupModeOverwrite = "overwrite"
+
+	backupSectionConversations = "conversations"
+	backupSectionFlows         = "flows"
+	backupSectionRoutes        = "routes"
+	backupSectionNumbers       = "number assignments"
+	backupSectionContactTags   = "contact tags"
+
+	// Cluster wide lock held while a backup is restored
+	backupRestoreLockKey = "twilio-backup-restore"
+)
+
+var backupSections = []string{backupSectionConversations, backupSectionFlows, backupSectionRoutes, backupSectionNumbers, backupSectionContactTags}
+
+// pluginBackup is the plugin state as written to a backup file. It holds what
+// was set up on the server, not caches, indexes, running jobs or flows in
+// progress. Backups without contact tags are from before they existed.
+type pluginBackup struct {
+	Version           int                          `json:"version"`
+	CreatedAt         int64                        `json:"created_at"`
+	Conversations     []*conversationSettings      `json:"conversations"`
+	Flows             map[string]*flowDefinition   `json:"flows"`
+	Routes            []*routingRule               `json:"routes"`
+	NumberAssignments map[string]*numberAssignment `json:"number_assignments"`
+	ContactTags       map[string][]string          `json:"contact_tags,omitempty"`
+}
+
+// restoreSummary counts what a restore changed, or would change on a dry run.
+type restoreSummary struct {
+	Mode     string                    `json:"mode"`
+	DryRun   bool                      `json:"dry_run"`
+	Sections map[string]*restoreCounts `json:"sections"`
+}
+
+type restoreCounts struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Removed int `json:"removed"`
+}
+
+func backupModeIsValid(mode string) bool {
+	return mode == backupModeSkip || mode == backupModeMerge || mode == backupModeOverwrite
+}
+
+func (p *TwilioPlugin) exportBackup() (*pluginBackup, error) {
+	conversations, err := p.store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].ConversationSid < conversations[j].ConversationSid
+	})
+	flows, err := p.getFlows()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := p.getRoutingRules()
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := p.getNumberAssignments()
+	if err != nil {
+		return nil, err
+	}
+	contactTags, err := p.getContactTags()
+	if err != nil {
+		return nil, err
+	}
+	return &pluginBackup{
+		Version:           backupVersion,
+		CreatedAt:         model.GetMillis(),
+		Conversations:     conversations,
+		Flows:             flows,
+		Routes:            routes,
+		NumberAssignments: assignments,
+		ContactTags:       contactTags,
+	}, nil
+}
+
+// parseBackup reads a backup file and checks that it can be restored.
+func parseBackup(data []byte) (*pluginBackup, error) {
+	var backup pluginBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, errors.Wrap(err, "Could not parse backup")
+	}
+	if backup.Version < 1 || backup.Version > backupVersion {
+		return nil, errors.Errorf("Unsupported backup version %d", backup.Version)
+	}
+	for _, settings := range backup.Conversations {
+		if settings == nil || settings.ConversationSid == "" || settings.ChannelId == "" {
+			return nil, errors.New("Backup contains a conversation mapping without conversation or channel")
+		}
+	}
+	for name, flow := range backup.Flows {
+		if err := flow.IsValid(); err != nil {
+			return nil, errors.Wrapf(err, "Backup contains invalid flow %s", name)
+		}
+	}
+	for _, rule := range backup.Routes {
+		if err := rule.IsValid(); err != nil {
+			return nil, errors.Wrapf(err, "Backup contains invalid routing rule %s", rule.Name)
+		}
+	}
+	return &backup, nil
+}
+
+// restoreBackup applies the backup with the given conflict mode. On a dry run
+// it only counts what would change. The restore holds a cluster wide lock, and
+// the merged state is checked before anything is removed, so a backup that
+// can not be applied leaves the current state alone.
+func (p *TwilioPlugin) restoreBackup(backup *pluginBackup, mode string, dryRun bool) (*restoreSummary, error) {
+	if !backupModeIsValid(mode) {
+		return nil, errors.Errorf("Unknown mode %s, use skip, merge or overwrite", mode)
+	}
+	unlock, err := p.lockBackupRestore()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	summary := &restoreSummary{Mode: mode, DryRun: dryRun, Sections: map[string]*restoreCounts{}}
+
+	current, err := p.store.List()
+	if err != nil {
+		return nil, err
+	}
+	existingConversations := map[string]*conversationSettings{}
+	for _, settings := range current {
+		existingConversations[settings.ConversationSid] = settings
+	}
+	backupConversations := map[string]*conversationSettings{}
+	for _, settings := range backup.Conversations {
+		backupConversations[settings.ConversationSid] = settings
+	}
+	conversations, counts := mergeSection(existingConversations, backupConversations, mode)
+	summary.Sections[backupSectionConversations] = counts
+
+	existingFlows, err := p.getFlows()
+	if err != nil {
+		return nil, err
+	}
+	flows, counts := mergeSection(existingFlows, backup.Flows, mode)
+	summary.Sections[backupSectionFlows] = counts
+
+	existingRoutes, err := p.getRoutingRules()
+	if err != nil {
+		return nil, err
+	}
+	routes, counts := mergeRoutes(existingRoutes, backup.Routes, mode)
+	summary.Sections[backupSectionRoutes] = counts
+
+	existingAssignments, err := p.getNumberAssignments()
+	if err != nil {
+		return nil, err
+	}
+	assignments, counts := mergeSection(existingAssignments, backup.NumberAssignments, mode)
+	summary.Sections[backupSectionNumbers] = counts
+
+	existingTags, err := p.getContactTags()
+	if err != nil {
+		return nil, err
+	}
+	contactTags, counts := mergeSection(existingTags, backup.ContactTags, mode)
+	summary.Sections[backupSectionContactTags] = counts
+
+	if err := p.checkRestore(conversations, existingConversations, routes, assignments); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return summary, nil
+	}
+
+	ctx := p.lifecycleContext()
+	for sid, settings := range existingConversations {
+		if _, ok := conversations[sid]; !ok {
+			if err := p.restoreConversation(ctx, sid, func() error {
+				p.deleteConversationSettings(settings)
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for sid, settings := range conversations {
+		if existing, ok := existingConversations[sid]; ok && sameJSON(existing, settings) {
+			continue
+		}
+		if err := p.restoreConversation(ctx, sid, func() error {
+			return p.saveConversationSettings(settings)
+		}); err != nil {
+			return nil, errors.Wrapf(err, "Could not restore conversation %s", sid)
+		}
+	}
+	if err := p.saveFlows(flows); err != nil {
+		return nil, err
+	}
+	if err := p.saveRoutingRules(routes); err != nil {
+		return nil, err
+	}
+	if err := p.saveNumberAssignments(assignments); err != nil {
+		return nil, err
+	}
+	if err := p.saveContactTags(contactTags); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// lockBackupRestore takes the cluster wide lock that keeps two restores from
+// running at the same time.
+func (p *TwilioPlugin) lockBackupRestore() (func(), error) {
+	mutex, err := cluster.NewMutex(p.API, backupRestoreLockKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create restore lock")
+	}
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), 10*time.Second)
+	defer cancel()
+	if err := mutex.LockWithContext(ctx); err != nil {
+		return nil, errors.New("Another restore is running")
+	}
+	return mutex.Unlock, nil
+}
+
+// restoreConversation changes the mapping of a conversation while holding its
+// lock, so a message arriving at the same time does not create a link of its
+// own.
+func (p *TwilioPlugin) restoreConversation(ctx context.Context, conversationSid string, change func() error) error {
+	unlock, err := p.lockConversation(ctx, conversationSid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return change()
+}
+
+// checkRestore makes sure the merged state can be applied: every restored
+// conversation points to an existing channel, and the teams of the routing
+// rules and number assignments exist.
+func (p *TwilioPlugin) checkRestore(conversations, existing map[string]*conversationSettings, routes []*routingRule, assignments map[string]*numberAssignment) error {
+	for sid, settings := range conversations {
+		if current, ok := existing[sid]; ok && sameJSON(current, settings) {
+			continue
+		}
+		channel, appErr := p.API.GetChannel(settings.ChannelId)
+		if appErr != nil {
+			return errors.Errorf("Conversation %s is linked to channel %s, which does not exist", sid, settings.ChannelId)
+		}
+		if channel.DeleteAt != 0 {
+			return errors.Errorf("Conversation %s is linked to channel %s, which is archived", sid, channel.Name)
+		}
+	}
+	for _, rule := range routes {
+		if err := rule.IsValid(); err != nil {
+			return err
+		}
+		if rule.Team != "" {
+			if _, appErr := p.API.GetTeamByName(rule.Team); appErr != nil {
+				return errors.Errorf("Routing rule %s uses team %s, which does not exist", rule.Name, rule.Team)
+			}
+		}
+	}
+	for number, assignment := range assignments {
+		if _, appErr := p.API.GetTeam(assignment.TeamId); appErr != nil {
+			return errors.Errorf("Number %s is assigned to team %s, which does not exist", number, assignment.TeamId)
+		}
+	}
+	return nil
+}
+
+// mergeSection combines the current and the backed up items of a section by
+// key. Items that are the same in both are not counted.
+func mergeSection[T any](existing, backup map[string]T, mode string) (map[string]T, *restoreCounts) {
+	counts := &restoreCounts{}
+	result := map[string]T{}
+	for key, item := range existing {
+		if _, ok := backup[key]; !ok && mode == backupModeOverwrite {
+			counts.Removed++
+			continue
+		}
+		result[key] = item
+	}
+	for key, item := range backup {
+		current, ok := existing[key]
+		switch {
+		case !ok:
+			result[key] = item
+			counts.Added++
+		case sameJSON(current, item):
+		case mode == backupModeSkip:
+			counts.Skipped++
+		default:
+			result[key] = item
+			counts.Updated++
+		}
+	}
+	return result, counts
+}
+
+// mergeRoutes is mergeSection for the routing rules, which keep their order.
+// Rules from the backup replace rules of the same name in place, new ones are
+// appended. Overwrite takes the order of the backup.
+func mergeRoutes(existing, backup []*routingRule, mode string) ([]*routingRule, *restoreCounts) {
+	existingByName := map[string]*routingRule{}
+	for _, rule := range existing {
+		existingByName[rule.Name] = rule
+	}
+	backupByName := map[string]*routingRule{}
+	for _, rule := range backup {
+		backupByName[rule.Name] = rule
+	}
+	merged, counts := mergeSection(existingByName, backupByName, mode)
+
+	order := existing
+	if mode == backupModeOverwrite {
+		order = backup
+	}
+	var result []*routingRule
+	seen := map[string]bool{}
+	for _, rules := range [][]*routingRule{order, backup} {
+		for _, rule := range rules {
+			if rule, ok := merged[rule.Name]; ok && !seen[rule.Name] {
+				seen[rule.Name] = true
+				result = append(result, rule)
+			}
+		}
+	}
+	return result, counts
+}
+
+func sameJSON(a, b interface{}) bool {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(left) == string(right)
+}
+
+// Text lists the counts of every section for a command response.
+func (s *restoreSummary) Text() string {
+	text := fmt.Sprintf("Restored the backup with mode %s:\n", s.Mode)
+	if s.DryRun {
+		text = fmt.Sprintf("Dry run, nothing was changed. Restoring the backup with mode %s would change:\n", s.Mode)
+	}
+	for _, section := range backupSections {
+		counts := s.Sections[section]
+		text += fmt.Sprintf("- %s: %d added, %d updated, %d skipped, %d removed\n", section, counts.Added, counts.Updated, counts.Skipped, counts.Removed)
+	}
+	return text
+}
+
+// sendBackup exports the plugin state and sends it to the user as a file in
+// a direct message from the bot.
+func (p *TwilioPlugin) sendBackup(userId string) error {
+	backup, err := p.exportBackup()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal backup")
+	}
+
+	bot, err := p.getBot()
+	if err != nil {
+		return err
+	}
+	channel, appErr := p.API.GetDirectChannel(userId, bot.UserId)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Could not get direct channel")
+	}
+	name := "twilio-backup-" + time.Now().UTC().Format("2006-01-02-150405") + ".json"
+	file, appErr := p.API.UploadFile(data, channel.Id, name)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Could not upload backup")
+	}
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    bot.UserId,
+		ChannelId: channel.Id,
+		Message:   fmt.Sprintf("Backup of the Twilio plugin with %d conversation mappings, %d flows, %d routing rules, %d number assignments and %d tagged contacts.", len(backup.Conversations), len(backup.Flows), len(backup.Routes), len(backup.NumberAssignments), len(backup.ContactTags)),
+		FileIds:   []string{file.Id},
+	}); appErr != nil {
+		return errors.Wrap(appErr, "Could not create post")
+	}
+	return nil
+}
+
+// readBackupPost reads the backup attached to a post, given by its ID or
+// permalink, that the user can read.
+func (p *TwilioPlugin) readBackupPost(userId, reference string) (*pluginBackup, error) {
+	postId := reference[strings.LastIndex(reference, "/")+1:]
+	if !model.IsValidId(postId) {
+		return nil, errors.Errorf("%s is not a post ID or permalink", reference)
+	}
+	post, appErr := p.API.GetPost(postId)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Could not find post")
+	}
+	if !p.API.HasPermissionToChannel(userId, post.ChannelId, model.PermissionReadChannelContent) {
+		return nil, errors.New("You can not read that post")
+	}
+	for _, fileId := range post.FileIds {
+		info, appErr := p.API.GetFileInfo(fileId)
+		if appErr != nil || !strings.EqualFold(info.Extension, "json") {
+			continue
+		}
+		data, appErr := p.API.GetFile(fileId)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not read backup file")
+		}
+		return parseBackup(data)
+	}
+	return nil, errors.New("The post has no JSON file attached")
+}
+
+// handleBackupExport returns the plugin state as a backup file.
+func (p *TwilioPlugin) handleBackupExport(w http.ResponseWriter, r *http.Request) {
+	if !p.API.HasPermissionTo(r.Header.Get("Mattermost-User-ID"), model.PermissionManageSystem) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	backup, err := p.exportBackup()
+	if err != nil {
+		p.API.LogError("Could not export backup", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=twilio-backup.json")
+	if err := json.NewEncoder(w).Encode(backup); err != nil {
+		p.API.LogError("Could not write backup", "error", err.Error())
+	}
+}
+
+// handleBackupRestore restores a backup file sent as the request body. The
+// mode and dry_run query parameters work like the command options.
+func (p *TwilioPlugin) handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	if !p.API.HasPermissionTo(r.Header.Get("Mattermost-User-ID"), model.PermissionManageSystem) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = backupModeSkip
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	var backup *pluginBackup
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBackupSize))
+	if err == nil {
+		backup, err = parseBackup(data)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	summary, err := p.restoreBackup(backup, mode, dryRun)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		p.API.LogError("Could not write restore summary", "error", err.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+const (
+	cacheConversationPrefix = "twilio-cache-co-"
+	cacheParticipantsPrefix = "twilio-cache-pa-"
+
+	// Seconds cached data is used for. Webhook events drop it earlier when
+	// the conversation or its participants change.
+	conversationCacheTTL = 60 * 60
+	participantsCacheTTL = 15 * 60
+)
+
+type cacheRefreshKey struct{}
+
+// withCacheRefresh marks the context so cached Twilio data is fetched again.
+func withCacheRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheRefreshKey{}, true)
+}
+
+func cacheRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(cacheRefreshKey{}).(bool)
+	return refresh
+}
+
+// cachedTwilioClient keeps conversation details and participant lists in the
+// KV store, so repeated lookups do not go to Twilio every time.
+type cachedTwilioClient struct {
+	ITwilioClient
+	p *TwilioPlugin
+}
+
+func newCachedTwilioClient(p *TwilioPlugin, client ITwilioClient) ITwilioClient {
+	cached := &cachedTwilioClient{ITwilioClient: client, p: p}
+	// Lookups of the client itself, like scanning for the conversations of a
+	// number, go through the cache as well
+	if tc, ok := client.(*TwilioClient); ok {
+		tc.cached = cached
+	}
+	return cached
+}
+
+func (c *cachedTwilioClient) GetConversation(ctx context.Context, conversationSid string) (*twiliov1.ConversationsV1Conversation, error) {
+	key := cacheConversationPrefix + conversationSid
+	var conversation twiliov1.ConversationsV1Conversation
+	if !cacheRefresh(ctx) && c.p.getCached(key, &conversation) {
+		return &conversation, nil
+	}
+	fresh, err := c.ITwilioClient.GetConversation(ctx, conversationSid)
+	if err != nil {
+		return nil, err
+	}
+	c.p.setCached(key, fresh, conversationCacheTTL)
+	return fresh, nil
+}
+
+func (c *cachedTwilioClient) SetConversationAttributes(ctx context.Context, conversationSid, attributes string) error {
+	err := c.ITwilioClient.SetConversationAttributes(ctx, conversationSid, attributes)
+	c.p.invalidateConversationCache(conversationSid)
+	return err
+}
+
+func (c *cachedTwilioClient) GetConversationParticipants(ctx context.Context, conversationSid string) ([]string, error) {
+	key := cacheParticipantsPrefix + conversationSid
+	var participants []string
+	if !cacheRefresh(ctx) && c.p.getCached(key, &participants) {
+		return participants, nil
+	}
+	fresh, err := c.ITwilioClient.GetConversationParticipants(ctx, conversationSid)
+	if err != nil {
+		return nil, err
+	}
+	c.p.setCached(key, fresh, participantsCacheTTL)
+	return fresh, nil
+}
+
+// getCached reads a cached value, reporting whether there was one.
+func (p *TwilioPlugin) getCached(key string, value interface{}) bool {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil || data == nil {
+		return false
+	}
+	return json.Unmarshal(data, value) == nil
+}
+
+func (p *TwilioPlugin) setCached(key string, value interface{}, ttl int64) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	if appErr := p.API.KVSetWithExpiry(key, data, ttl); appErr != nil {
+		p.API.LogWarn("Could not cache Twilio data", "key", key, "error", appErr.Error())
+	}
+}
+
+// invalidateConversationCache drops the cached details of the conversation.
+func (p *TwilioPlugin) invalidateConversationCache(conversationSid string) {
+	if appErr := p.API.KVDelete(cacheConversationPrefix + conversationSid); appErr != nil {
+		p.API.LogWarn("Could not drop cached conversation", "sid", conversationSid, "error", appErr.Error())
+	}
+}
+
+// invalidateParticipantsCache drops the cached participants of the
+// conversation.
+func (p *TwilioPlugin) invalidateParticipantsCache(conversationSid string) {
+	if appErr := p.API.KVDelete(cacheParticipantsPrefix + conversationSid); appErr != nil {
+		p.API.LogWarn("Could not drop cached participants", "sid", conversationSid, "error", appErr.Error())
+	}
+}
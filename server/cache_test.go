@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+func TestTwilioClientLookupsUseCache(t *testing.T) {
+	p := &TwilioPlugin{}
+	p.SetAPI(newTestKVAPI())
+	// Without a REST client any request to Twilio panics
+	client := newCachedTwilioClient(p, &TwilioClient{p: p, account: &twilioAccount{AccountSid: "AC1"}})
+
+	sid := "CH1"
+	p.setCached(cacheConversationPrefix+sid, &twiliov1.ConversationsV1Conversation{Sid: &sid}, conversationCacheTTL)
+	p.indexConversationNumber("AC1", "+1555", sid)
+	p.setNumberScanned("AC1", "+1555")
+
+	conversations, err := client.FindConversationsByProxyAddress(context.Background(), "+1555", false)
+	if err != nil {
+		t.Fatalf("FindConversationsByProxyAddress failed: %v", err)
+	}
+	if len(conversations) != 1 || *conversations[0].Sid != sid {
+		t.Fatalf("FindConversationsByProxyAddress = %+v, want %s", conversations, sid)
+	}
+}
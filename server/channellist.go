@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+const (
+	channelListPageSize = 10
+
+	// Called by the previous and next buttons of the listing
+	channelListActionPath = "/channel/list"
+	channelListActionURL  = "/plugins/sx.paul.mattermost.twilio" + channelListActionPath
+)
+
+// channelListQuery selects the linked channels shown by /twilio channel list.
+// It travels in the buttons of the listing, so a button shows the page of
+// the same query.
+type channelListQuery struct {
+	Number string `json:"number,omitempty"`
+	TeamId string `json:"team_id,omitempty"`
+	Page   int    `json:"page"`
+}
+
+// linkedChannel is a mapping shown in the listing.
+type linkedChannel struct {
+	Settings     *conversationSettings
+	Channel      *model.Channel
+	Participants []string
+}
+
+// channelListPost builds the ephemeral post with one page of the linked
+// channels the user can read, with buttons to the pages around it.
+func (p *TwilioPlugin) channelListPost(ctx context.Context, userId string, query *channelListQuery) (*model.Post, error) {
+	linked, err := p.listLinkedChannels(ctx, userId, query)
+	if err != nil {
+		return nil, err
+	}
+	bot, err := p.getBot()
+	if err != nil {
+		return nil, err
+	}
+
+	pages := (len(linked) + channelListPageSize - 1) / channelListPageSize
+	query.Page = max(min(query.Page, pages-1), 0)
+	start := query.Page * channelListPageSize
+	rows := linked[start:min(start+channelListPageSize, len(linked))]
+
+	var text string
+	if len(rows) == 0 {
+		text = "No linked channels found."
+	} else {
+		text = fmt.Sprintf("Linked channels, page %d of %d:\n", query.Page+1, pages)
+		conversations := fetchAll(ctx, rows, func(ctx context.Context, row *linkedChannel) (*twiliov1.ConversationsV1Conversation, error) {
+			return p.getSettingsTwilioClient(row.Settings).GetConversation(ctx, row.Settings.ConversationSid)
+		})
+		for i, row := range rows {
+			text += p.linkedChannelText(row, conversations[i]) + "\n"
+		}
+	}
+
+	post := &model.Post{
+		UserId:  bot.UserId,
+		Message: text,
+	}
+	var actions []*model.PostAction
+	if query.Page > 0 {
+		actions = append(actions, channelListAction("previous", "Previous", query, query.Page-1))
+	}
+	if query.Page+1 < pages {
+		actions = append(actions, channelListAction("next", "Next", query, query.Page+1))
+	}
+	if len(actions) > 0 {
+		model.ParseSlackAttachment(post, []*model.SlackAttachment{{Actions: actions}})
+	}
+	return post, nil
+}
+
+func channelListAction(id, name string, query *channelListQuery, page int) *model.PostAction {
+	target := *query
+	target.Page = page
+	data, _ := json.Marshal(&target)
+	return &model.PostAction{
+		Id:   id,
+		Name: name,
+		Type: model.PostActionTypeButton,
+		Integration: &model.PostActionIntegration{
+			URL:     channelListActionURL,
+			Context: map[string]interface{}{"query": string(data)},
+		},
+	}
+}
+
+// listLinkedChannels returns the mappings of the query to channels the user
+// can read, sorted by channel name.
+func (p *TwilioPlugin) listLinkedChannels(ctx context.Context, userId string, query *channelListQuery) ([]*linkedChannel, error) {
+	all, err := p.store.List()
+	if err != nil {
+		return nil, err
+	}
+	var linked []*linkedChannel
+	for _, settings := range all {
+		if query.TeamId != "" && settings.TeamId != query.TeamId {
+			continue
+		}
+		channel, appErr := p.API.GetChannel(settings.ChannelId)
+		if appErr != nil || !p.API.HasPermissionToChannel(userId, channel.Id, model.PermissionReadChannelContent) {
+			continue
+		}
+		linked = append(linked, &linkedChannel{Settings: settings, Channel: channel})
+	}
+	sort.Slice(linked, func(i, j int) bool {
+		if linked[i].Channel.DisplayName != linked[j].Channel.DisplayName {
+			return linked[i].Channel.DisplayName < linked[j].Channel.DisplayName
+		}
+		return linked[i].Settings.ConversationSid < linked[j].Settings.ConversationSid
+	})
+
+	// Participants are cached, so looking up all of them to filter by our
+	// number stays cheap after the first listing
+	results := fetchAll(ctx, linked, func(ctx context.Context, row *linkedChannel) ([]string, error) {
+		return p.getSettingsTwilioClient(row.Settings).GetConversationParticipants(ctx, row.Settings.ConversationSid)
+	})
+	var filtered []*linkedChannel
+	for i, row := range linked {
+		row.Participants = results[i].Value
+		if query.Number != "" && proxyAddress(row.Participants) != query.Number {
+			continue
+		}
+		filtered = append(filtered, row)
+	}
+	return filtered, nil
+}
+
+func (p *TwilioPlugin) linkedChannelText(row *linkedChannel, conversation fetchResult[*twiliov1.ConversationsV1Conversation]) string {
+	text := "- ~" + row.Channel.Name
+	if row.Settings.Type == "post" {
+		text += " (thread)"
+	}
+	var contacts []string
+	for _, participant := range row.Participants {
+		if !strings.HasPrefix(participant, "*") {
+			contacts = append(contacts, participant)
+		}
+	}
+	if len(contacts) > 0 {
+		text += " with " + strings.Join(contacts, ", ")
+	}
+	if number := proxyAddress(row.Participants); number != "" {
+		text += " on " + number
+	}
+	if conversation.Err != nil {
+		return text + fmt.Sprintf(" (could not get conversation %s: %s)", row.Settings.ConversationSid, twilioErrorText(conversation.Err))
+	}
+	conv := conversation.Value
+	if conv.State != nil {
+		text += ", " + *conv.State
+	}
+	if activity := lastActivity(conv); !activity.IsZero() {
+		text += ", last activity " + activity.UTC().Format("2006-01-02 15:04")
+	}
+	return text
+}
+
+// handleChannelListAction shows another page of a listing when one of its
+// buttons is pressed.
+func (p *TwilioPlugin) handleChannelListAction(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var request model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || userId == "" || request.UserId != userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var query channelListQuery
+	data, _ := request.Context["query"].(string)
+	if err := json.Unmarshal([]byte(data), &query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+	defer cancel()
+	post, err := p.channelListPost(ctx, userId, &query)
+	if err != nil {
+		p.API.LogError("Could not list linked channels", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	post.Id = request.PostId
+	post.ChannelId = request.ChannelId
+	p.API.UpdateEphemeralPost(userId, post)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&model.PostActionIntegrationResponse{})
+}
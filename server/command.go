@@ -1,190 +1,324 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
-	"sync"
+	"time"
+	"unicode"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
 	openapi "github.com/twilio/twilio-go/rest/conversations/v1"
+	messaging "github.com/twilio/twilio-go/rest/messaging/v1"
 )
 
+// How long a command may wait for Twilio before giving up.
+const commandTimeout = 30 * time.Second
+
 type Handler struct {
 	client *pluginapi.Client
+	root   *commandNode
 }
 
 type Command interface {
 	Handle(args *model.CommandArgs, p *TwilioPlugin) (*model.CommandResponse, error)
-	executeTwilioCommand(args *model.CommandArgs, p *TwilioPlugin) *model.CommandResponse
+	executeConversationPick(args *model.CommandArgs, p *TwilioPlugin, account *twilioAccount, command []string, conversationSid string) *model.CommandResponse
 }
 
 func NewCommandHandler(client *pluginapi.Client) Command {
+	handler := &Handler{
+		client: client,
+	}
+	handler.root = handler.commands()
+
+	commands := strings.Join(childNames(handler.root), ", ")
+	autocomplete := handler.root.autocompleteData()
+	autocomplete.Hint = "[command]"
+	autocomplete.HelpText = "command is one of " + commands
 	err := client.SlashCommand.Register(&model.Command{
 		Trigger:          "twilio",
 		DisplayName:      "Twilio",
 		Description:      "Check to see the twilio conversation linked to this channel",
 		AutoComplete:     true,
-		AutoCompleteDesc: "Commands are channel, conversation, number, help",
+		AutoCompleteDesc: "Commands are " + commands,
 		AutoCompleteHint: "[command]",
-		AutocompleteData: getAutocompleteData(),
+		AutocompleteData: autocomplete,
 		IconURL:          "https://ntfy.sh/static/images/favicon.ico",
 	})
 	if err != nil {
 		client.Log.Error("Failed to register slash command", "error", err)
 	}
-	// Return command handler
-	return &Handler{
-		client: client,
+	return handler
+}
+
+// conversationArg is a conversation given by SID, ~channel, phone number or
+// name, see resolveConversation.
+func conversationArg(help, suggestions string) commandArg {
+	return commandArg{
+		Name:        "conversation",
+		Help:        help + ": SID, ~channel, phone number or name",
+		Rest:        true,
+		Suggestions: suggestions,
+	}
+}
+
+func validatePhoneNumber(value string) error {
+	if !strings.HasPrefix(value, "+") {
+		return errors.New("use the international format, like +1XXXXXXXXXX")
 	}
+	return nil
 }
 
-/*
-	Command structure
-	channel:
-		status: shows conversation linked to this channel and participants
-	    connect <conversation_sid>: links this channel to the given conversation
-	    disconnect: unlinks this channel from any conversation
-	conversation:
-		list [page]: lists conversations and participants (page size 20)
-		participants <conversation_sid>: lists participants in the given conversation
-		webhooks:
-			list <conversation_sid>: lists webhooks for the given conversation
-			add <conversation_sid>: adds a webhook to the given conversation
-			remove <conversation_sid>: removes the given webhook from the given conversation
-	number:
-		list: lists phone numbers associated with the Twilio account
-		webhooks:
-			setup <phone_number>: sets up a webhook for the given phone number
-			remove <phone_number>: removes the webhook for the given phone number
-	help: shows this message
-
-
-*/
-
-func getAutocompleteData() *model.AutocompleteData {
-	main := &model.AutocompleteData{
-		Trigger:  "twilio",
-		Hint:     "[command]",
-		HelpText: "command is one of channel, conversation, number, help",
-	}
-	channel := &model.AutocompleteData{
-		Trigger:  "channel",
-		Hint:     "[status|connect|disconnect]",
-		HelpText: "channel commands are status, connect <conversation_sid>, disconnect",
-	}
-	channel_status := &model.AutocompleteData{
-		Trigger:  "status",
-		Hint:     "",
-		HelpText: "shows the conversation linked to this channel",
-	}
-	channel.AddCommand(channel_status)
-	channel_connect := &model.AutocompleteData{
-		Trigger:  "connect",
-		Hint:     "<conversation_sid>",
-		HelpText: "links this channel to the given conversation",
-	}
-	channel_connect.AddTextArgument("The SID of the Twilio conversation to link to this channel", "conversation_sid", "")
-	channel.AddCommand(channel_connect)
-	channel_disconnect := &model.AutocompleteData{
-		Trigger:  "disconnect",
-		Hint:     "",
-		HelpText: "unlinks this channel from any conversation",
-	}
-	channel.AddCommand(channel_disconnect)
-	main.AddCommand(channel)
-
-	conversation := &model.AutocompleteData{
-		Trigger:  "conversation",
-		Hint:     "[list|participants|webhooks]",
-		HelpText: "conversation commands are list [page], participants <conversation_sid>, webhooks [list|add|remove] <conversation_sid>",
-	}
-	conversation_list := &model.AutocompleteData{
-		Trigger:  "list",
-		Hint:     "[page]",
-		HelpText: "lists conversations and participants (page size 20)",
-	}
-	conversation_list.AddTextArgument("The page of conversations to list", "page", "")
-	conversation.AddCommand(conversation_list)
-	conversation_participants := &model.AutocompleteData{
-		Trigger:  "participants",
-		Hint:     "<conversation_sid>",
-		HelpText: "lists participants in the given conversation",
-	}
-	conversation_participants.AddTextArgument("The SID of the Twilio conversation to list participants for", "conversation_sid", "")
-	conversation.AddCommand(conversation_participants)
-	conversation_webhooks := &model.AutocompleteData{
-		Trigger:  "webhooks",
-		Hint:     "[list|add|remove] <conversation_sid>",
-		HelpText: "webhooks commands are list <conversation_sid>, add <conversation_sid>, remove <conversation_sid>",
-	}
-	conversation_webhooks_list := &model.AutocompleteData{
-		Trigger:  "list",
-		Hint:     "<conversation_sid>",
-		HelpText: "lists webhooks for the given conversation",
-	}
-	conversation_webhooks_list.AddTextArgument("The SID of the Twilio conversation to list webhooks for", "conversation_sid", "")
-	conversation_webhooks.AddCommand(conversation_webhooks_list)
-	conversation_webhooks_add := &model.AutocompleteData{
-		Trigger:  "add",
-		Hint:     "<conversation_sid>",
-		HelpText: "adds a webhook to the given conversation",
-	}
-	conversation_webhooks_add.AddTextArgument("The SID of the Twilio conversation to add a webhook to", "conversation_sid", "")
-	conversation_webhooks.AddCommand(conversation_webhooks_add)
-	conversation_webhooks_remove := &model.AutocompleteData{
-		Trigger:  "remove",
-		Hint:     "<conversation_sid>",
-		HelpText: "removes the given webhook from the given conversation",
-	}
-	conversation_webhooks_remove.AddTextArgument("The SID of the Twilio conversation to remove a webhook from", "conversation_sid", "")
-	conversation_webhooks.AddCommand(conversation_webhooks_remove)
-	conversation.AddCommand(conversation_webhooks)
-	main.AddCommand(conversation)
-
-	number := &model.AutocompleteData{
-		Trigger:  "number",
-		Hint:     "[list|webhooks]",
-		HelpText: "number commands are list, webhooks [setup|remove] <phone_number>",
-	}
-	number_list := &model.AutocompleteData{
-		Trigger:  "list",
-		Hint:     "",
-		HelpText: "lists phone numbers associated with the Twilio account",
-	}
-	number.AddCommand(number_list)
-	number_webhooks := &model.AutocompleteData{
-		Trigger:  "webhooks",
-		Hint:     "[setup|remove] <phone_number>",
-		HelpText: "webhooks commands are setup <phone_number>, remove <phone_number>",
-	}
-	number_webhooks_setup := &model.AutocompleteData{
-		Trigger:  "setup",
-		Hint:     "<phone_number>",
-		HelpText: "sets up a webhook for the given phone number",
-	}
-	number_webhooks_setup.AddTextArgument("The phone number to set up a webhook for", "phone_number", "")
-	number_webhooks.AddCommand(number_webhooks_setup)
-	number_webhooks_remove := &model.AutocompleteData{
-		Trigger:  "remove",
-		Hint:     "<phone_number>",
-		HelpText: "removes the webhook for the given phone number",
-	}
-	number_webhooks_remove.AddTextArgument("The phone number to remove the webhook for", "phone_number", "")
-	number_webhooks.AddCommand(number_webhooks_remove)
-	number.AddCommand(number_webhooks)
-	main.AddCommand(number)
-
-	help := &model.AutocompleteData{
-		Trigger:  "help",
-		Hint:     "",
-		HelpText: "shows this message",
-	}
-	main.AddCommand(help)
-
-	//
-
-	return main
+// commands is the /twilio command tree. Run /twilio help for the rendered
+// command structure.
+func (c *Handler) commands() *commandNode {
+	return &commandNode{
+		Name: "twilio",
+		Children: []*commandNode{{
+			Name: "channel",
+			Children: []*commandNode{{
+				Name:    "list",
+				Help:    "lists the linked channels you can read with their participants, our number, state and last activity",
+				Details: "Optionally only those on our number or in the team",
+				Args: []commandArg{
+					{Name: "number", Help: "Only list channels on this phone number", Optional: true},
+					{Name: "team", Help: "Only list channels in this team", Optional: true},
+				},
+				Run: c.executeChannelList,
+			}, {
+				Name: "status",
+				Help: "shows the conversation linked to this channel and its participants",
+				Run:  c.executeChannelStatus,
+			}, {
+				Name: "connect",
+				Help: "links this channel to the given conversation, or opens a dialog to pick one",
+				Args: []commandArg{{
+					Name:        "conversation",
+					Help:        "The Twilio conversation to link to this channel: SID, ~channel, phone number or name. Leave out to pick it in a dialog",
+					Optional:    true,
+					Rest:        true,
+					Suggestions: autocompleteUnlinkedURL,
+				}},
+				Run: c.executeChannelConnect,
+			}, {
+				Name: "disconnect",
+				Help: "unlinks this channel from any conversation",
+				Run:  c.executeChannelDisconnect,
+			}},
+		}, {
+			Name: "conversation",
+			Children: []*commandNode{{
+				Name:    "list",
+				Help:    "lists a page of conversations with their participants and linked channel, each page sorted by last activity",
+				Details: "Dates are YYYY-MM-DD",
+				Args: []commandArg{
+					{Name: "state", Help: "Only list conversations in this state", Option: true, Optional: true, Choices: []model.AutocompleteListItem{
+						{Item: "active", HelpText: "Conversations in use"},
+						{Item: "inactive", HelpText: "Conversations without recent activity"},
+						{Item: "closed", HelpText: "Closed conversations"},
+					}},
+					{Name: "from", Help: "Only list conversations created on or after this date", Hint: "YYYY-MM-DD", Option: true, Optional: true},
+					{Name: "to", Help: "Only list conversations created on or before this date", Hint: "YYYY-MM-DD", Option: true, Optional: true},
+					{Name: "number", Help: "Only list conversations on this phone number of the account", Hint: "<phone_number>", Option: true, Optional: true, Suggestions: autocompleteNumbersURL},
+					{Name: "page", Help: "The page cursor from the previous listing", Hint: "<cursor>", Option: true, Optional: true},
+				},
+				Run: c.executeConversationList,
+			}, {
+				Name: "new",
+				Help: "opens a dialog to start a conversation with a phone number",
+				Run:  c.executeConversationNew,
+			}, {
+				Name: "participants",
+				Help: "lists participants in the given conversation",
+				Args: []commandArg{conversationArg("The Twilio conversation to list participants for", autocompleteRecentURL)},
+				Run:  c.executeConversationParticipants,
+			}, {
+				Name: "webhooks",
+				Children: []*commandNode{{
+					Name: "list",
+					Help: "lists webhooks for the given conversation",
+					Args: []commandArg{conversationArg("The Twilio conversation to list webhooks for", autocompleteRecentURL)},
+					Run:  c.executeConversationWebhooksList,
+				}, {
+					Name: "add",
+					Help: "adds a webhook to the given conversation",
+					Args: []commandArg{conversationArg("The Twilio conversation to add a webhook to", autocompleteRecentURL)},
+					Run:  c.executeConversationWebhooksAdd,
+				}, {
+					Name: "remove",
+					Help: "removes the webhook from the given conversation",
+					Args: []commandArg{conversationArg("The Twilio conversation to remove a webhook from", autocompleteRecentURL)},
+					Run:  c.executeConversationWebhooksRemove,
+				}},
+			}},
+		}, {
+			Name: "number",
+			Children: []*commandNode{{
+				Name: "list",
+				Help: "lists phone numbers associated with the Twilio account",
+				Run:  c.executeNumberList,
+			}, {
+				Name:  "assign",
+				Help:  "sends new conversations on the number (or messaging service SID) to the team and users",
+				Admin: true,
+				Args: []commandArg{
+					{Name: "phone_number", Help: "The phone number or messaging service SID to assign", Suggestions: autocompleteNumbersURL},
+					{Name: "team", Help: "The name of the team"},
+					{Name: "users", Help: "Usernames to add to new conversations, separated by commas or spaces", Optional: true, Rest: true},
+				},
+				Run: c.executeNumberAssign,
+			}, {
+				Name:  "unassign",
+				Help:  "sends new conversations on the number to the default team again",
+				Admin: true,
+				Args: []commandArg{
+					{Name: "phone_number", Help: "The phone number or messaging service SID to unassign", Suggestions: autocompleteNumbersURL},
+				},
+				Run: c.executeNumberUnassign,
+			}, {
+				Name: "webhooks",
+				Children: []*commandNode{{
+					Name: "setup",
+					Help: "sets up a webhook for the given phone number, or opens a dialog to pick it and the team it goes to",
+					Args: []commandArg{
+						{Name: "phone_number", Help: "The phone number to set up a webhook for. Leave out to pick it in a dialog", Optional: true, Suggestions: autocompleteNumbersURL, Validate: validatePhoneNumber},
+						{Name: "scan", Help: "Scan every conversation of the account again for ones the plugin has not seen yet", Flag: true},
+					},
+					Run: c.executeNumberWebhooksSetup,
+				}, {
+					Name: "remove",
+					Help: "removes the webhook for the given phone number",
+					Args: []commandArg{
+						{Name: "phone_number", Help: "The phone number to remove the webhook for", Suggestions: autocompleteNumbersURL, Validate: validatePhoneNumber},
+						{Name: "scan", Help: "Scan every conversation of the account again for ones the plugin has not seen yet", Flag: true},
+					},
+					Run: c.executeNumberWebhooksRemove,
+				}, {
+					Name:  "repoint",
+					Help:  "moves numbers and conversations from the old webhook URL to the current one",
+					Admin: true,
+					Args: []commandArg{
+						{Name: "old_url", Help: "The old webhook URL, defaults to the URL in use before the site URL changed", Optional: true},
+					},
+					Run: c.executeNumberWebhooksRepoint,
+				}},
+			}},
+		}, {
+			Name:  "flow",
+			Admin: true,
+			Children: []*commandNode{{
+				Name: "list",
+				Help: "lists the configured message flows",
+				Run:  c.executeFlowList,
+			}, {
+				Name: "show",
+				Help: "shows the definition of the given flow",
+				Args: []commandArg{{Name: "name", Help: "The name of the flow to show"}},
+				Run:  c.executeFlowShow,
+			}, {
+				Name: "set",
+				Help: "creates or replaces a flow from its JSON definition",
+				Args: []commandArg{{Name: "json", Help: "The JSON definition of the flow", Raw: true}},
+				Run:  c.executeFlowSet,
+			}, {
+				Name: "delete",
+				Help: "deletes the given flow",
+				Args: []commandArg{{Name: "name", Help: "The name of the flow to delete"}},
+				Run:  c.executeFlowDelete,
+			}, {
+				Name: "reset",
+				Help: "drops the given conversation out of any flow in progress",
+				Args: []commandArg{conversationArg("The Twilio conversation to reset", autocompleteRecentURL)},
+				Run:  c.executeFlowReset,
+			}},
+		}, {
+			Name:  "route",
+			Admin: true,
+			Children: []*commandNode{{
+				Name: "list",
+				Help: "lists the routing rules for new conversations in the order they are evaluated",
+				Run:  c.executeRouteList,
+			}, {
+				Name: "add",
+				Help: "adds a routing rule or replaces the rule with the same name",
+				Args: []commandArg{{Name: "json", Help: "The JSON definition of the rule", Raw: true}},
+				Run:  c.executeRouteAdd,
+			}, {
+				Name: "remove",
+				Help: "removes the given routing rule",
+				Args: []commandArg{{Name: "name", Help: "The name of the rule to remove"}},
+				Run:  c.executeRouteRemove,
+			}, {
+				Name: "tag",
+				Help: "sets the contact tags of a sender number that rules can match on, no tags remove them",
+				Args: []commandArg{
+					{Name: "number", Help: "The sender number"},
+					{Name: "tags", Help: "The tags of the sender", Optional: true, Rest: true},
+				},
+				Run: c.executeRouteTag,
+			}, {
+				Name: "test",
+				Help: "shows where a new conversation would be routed",
+				Args: []commandArg{
+					{Name: "from", Help: "The sender number"},
+					{Name: "to", Help: "Our receiving number"},
+					{Name: "text", Help: "The first message of the conversation", Optional: true, Rest: true},
+				},
+				Run: c.executeRouteTest,
+			}},
+		}, {
+			Name: "account",
+			Children: []*commandNode{{
+				Name: "list",
+				Help: "lists the configured Twilio accounts",
+				Run:  c.executeAccountList,
+			}},
+		}, {
+			Name:  "doctor",
+			Admin: true,
+			Children: []*commandNode{{
+				Name: "mappings",
+				Help: "reports stale mappings, unmapped conversation channels and conversations without webhook, and repairs them with --fix",
+				Args: []commandArg{{Name: "fix", Help: "Repair the issues that can be fixed", Flag: true}},
+				Run:  c.executeDoctorMappings,
+			}},
+		}, {
+			Name:  "rebuild",
+			Help:  "restores lost mappings from channel props and Twilio conversation attributes",
+			Admin: true,
+			Run:   c.executeRebuild,
+		}, {
+			Name:  "backup",
+			Admin: true,
+			Children: []*commandNode{{
+				Name: "export",
+				Help: "sends you the plugin state as a JSON file",
+				Run:  c.executeBackupExport,
+			}, {
+				Name:    "restore",
+				Help:    "restores the backup attached to the post, given by ID or permalink",
+				Details: "On conflicts skip keeps the current item, merge takes the backed up one and overwrite also removes what is not in the backup. Defaults to skip",
+				Args: []commandArg{
+					{Name: "post", Help: "The ID or permalink of the post the backup file is attached to"},
+					{Name: "mode", Help: "What to do with items that exist already", Option: true, Optional: true, Choices: []model.AutocompleteListItem{
+						{Item: backupModeSkip, HelpText: "Keep the current item"},
+						{Item: backupModeMerge, HelpText: "Take the backed up item"},
+						{Item: backupModeOverwrite, HelpText: "Take the backed up item and remove items missing from the backup"},
+					}},
+					{Name: "dry-run", Help: "Only show what the restore would change", Flag: true},
+				},
+				Run: c.executeBackupRestore,
+			}},
+		}, {
+			Name: "help",
+			Help: "shows this message",
+			Run:  c.executeHelp,
+		}},
+	}
 }
 
 func (c *Handler) Handle(args *model.CommandArgs, p *TwilioPlugin) (*model.CommandResponse, error) {
@@ -202,51 +336,62 @@ func (c *Handler) Handle(args *model.CommandArgs, p *TwilioPlugin) (*model.Comma
 }
 
 func (c *Handler) executeTwilioCommand(args *model.CommandArgs, p *TwilioPlugin) *model.CommandResponse {
-	fields := strings.Fields(args.Command)
+	// The options are taken out of the command itself, so raw arguments after
+	// the command words do not keep them either
+	command, selector, refresh := extractCommandOptions(args.Command)
+	args.Command = command
+	fields := strings.Fields(command)
 
-	if len(fields) < 2 {
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         "Available commands are channel, conversation, number, help. Use /twilio help for more information.",
+	var account *twilioAccount
+	if selector != "" {
+		account = p.findTwilioAccount(selector)
+		if account == nil {
+			return &model.CommandResponse{
+				ResponseType: model.CommandResponseTypeEphemeral,
+				Text:         fmt.Sprintf("Unknown Twilio account %s. Use /twilio account list to see the configured accounts.", selector),
+			}
 		}
 	}
 
-	switch strings.ToLower(fields[1]) {
-	case "channel":
-		return c.executeChannelCommand(args, p, fields[2:])
-	case "conversation":
-		return c.executeConversationCommand(args, p, fields[2:])
-	case "number":
-		return c.executeNumberCommand(args, p, fields[2:])
-	case "help":
-		text := `**Command structure**
-	**channel:**
-		**status:** shows conversation linked to this channel and participants
-		**connect <conversation_sid>:** links this channel to the given conversation
-		**disconnect:** unlinks this channel from any conversation
-	**conversation:**
-		**list [page]:** lists conversations and participants (page size 20)
-		**participants <conversation_sid>:** lists participants in the given conversation
-		**webhooks:**
-			**list <conversation_sid>:** lists webhooks for the given conversation
-			**add <conversation_sid>:** adds a webhook to the given conversation
-			**remove <conversation_sid>:** removes the given webhook from the given conversation
-	**number:**
-		**list:** lists phone numbers associated with the Twilio account
-		**webhooks:**
-			**setup <phone_number>:** sets up a webhook for the given phone number
-			**remove <phone_number>:** removes the webhook for the given phone number
-	**help:** shows this message`
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         text,
-		}
-	default:
+	// Bound the Twilio requests of the command, they are also cancelled when
+	// the plugin is deactivated
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+	defer cancel()
+	if refresh {
+		ctx = withCacheRefresh(ctx)
+	}
+
+	return dispatch(ctx, args, p, account, c.root, fields[1:])
+}
+
+// executeConversationPick runs a command taking a conversation with the
+// conversation picked from the choices it offered. The command words are
+// looked up in the tree, so nothing else can be run this way.
+func (c *Handler) executeConversationPick(args *model.CommandArgs, p *TwilioPlugin, account *twilioAccount, command []string, conversationSid string) *model.CommandResponse {
+	path := c.root.find(command)
+	if path == nil || !path[len(path)-1].hasArg("conversation") {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("Unknown command: %s. Available commands are channel, conversation, number, help. Use /twilio help for more information.", fields[1]),
+			Text:         fmt.Sprintf("Unknown command: %s.", strings.Join(command, " ")),
 		}
 	}
+	fields := append(append([]string{}, command...), conversationSid)
+	args.Command = "/twilio " + strings.Join(fields, " ")
+
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+	defer cancel()
+	return dispatch(ctx, args, p, account, c.root, fields)
+}
+
+func (c *Handler) executeHelp(call *commandCall) *model.CommandResponse {
+	text := helpText(call.root) + `
+A **<conversation>** is a conversation SID, a ~channel linked to it, the customer phone number optionally followed by our number, or the unique or friendly name of the conversation. When several conversations match you can pick one.
+Add **--account <name|sid>** to any command to use another configured Twilio account.
+Add **--refresh** to any command to fetch conversation details and participants from Twilio instead of the cache.`
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
 }
 
 func ConversationSidIsValid(sid string) bool {
@@ -263,408 +408,1010 @@ func ConversationSidIsValid(sid string) bool {
 	return true
 }
 
-func (c *Handler) executeChannelCommand(args *model.CommandArgs, p *TwilioPlugin, fields []string) *model.CommandResponse {
-	switch strings.ToLower(fields[0]) {
-	case "status":
+// extractFlag removes the --name flag from the command fields and reports
+// whether it was given.
+func extractFlag(fields []string, name string) ([]string, bool) {
+	for i, field := range fields {
+		if strings.EqualFold(field, "--"+name) {
+			return append(append([]string{}, fields[:i]...), fields[i+1:]...), true
+		}
+	}
+	return fields, false
+}
 
-		conversationSid, err := p.getChannelConversationSid(args.ChannelId)
-		if err != nil || conversationSid == "" {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "This channel is not linked to a Twilio conversation.",
+// extractOptions removes the given --name value options from the command
+// fields and returns their values by name.
+func extractOptions(fields []string, names ...string) ([]string, map[string]string) {
+	options := map[string]string{}
+	var rest []string
+	for i := 0; i < len(fields); i++ {
+		matched := false
+		for _, name := range names {
+			if strings.EqualFold(fields[i], "--"+name) && i+1 < len(fields) {
+				options[name] = fields[i+1]
+				i++
+				matched = true
+				break
 			}
-		}
-		participants, err := p.twilio.GetConversationParticipants(conversationSid)
-		if err != nil {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Could not get Twilio conversation participants.",
+			if prefix := "--" + name + "="; strings.HasPrefix(strings.ToLower(fields[i]), prefix) {
+				options[name] = fields[i][len(prefix):]
+				matched = true
+				break
 			}
 		}
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("This channel is linked to Twilio conversation %s with participants: %s", conversationSid, strings.Join(participants, ", ")),
+		if !matched {
+			rest = append(rest, fields[i])
 		}
-	case "connect":
-		if len(fields) < 2 {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Please provide a conversation SID to connect to. Usage: /twilio channel connect <conversation_sid>",
-			}
+	}
+	return rest, options
+}
+
+// extractAccountSelector removes the optional --account <name|sid> option from
+// the command fields and returns its value.
+func extractAccountSelector(fields []string) ([]string, string) {
+	for i := 0; i < len(fields); i++ {
+		if strings.EqualFold(fields[i], "--account") && i+1 < len(fields) {
+			selector := fields[i+1]
+			return append(append([]string{}, fields[:i]...), fields[i+2:]...), selector
 		}
-		conversationSid, err := p.getChannelConversationSid(args.ChannelId)
-		if err == nil || conversationSid != "" {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("This channel is already linked to Twilio conversation %s. Please disconnect first before connecting to a new conversation.", conversationSid),
-			}
+		if strings.HasPrefix(strings.ToLower(fields[i]), "--account=") {
+			selector := fields[i][len("--account="):]
+			return append(append([]string{}, fields[:i]...), fields[i+1:]...), selector
 		}
-		conversationSid = fields[1]
-		// Test if conversationSid matches regex ^CH[0-9a-fA-F]{32}$
-		if !ConversationSidIsValid(conversationSid) {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Invalid conversation SID format. It should match ^CH[0-9a-fA-F]{32}$.",
+	}
+	return fields, ""
+}
+
+// extractCommandOptions removes the --account <name|sid> and --refresh
+// options from the command wherever they are and returns the command without
+// them, the account selector and whether refresh was given. Everything else
+// keeps its spacing, so raw arguments are passed on as typed.
+func extractCommandOptions(command string) (string, string, bool) {
+	var kept strings.Builder
+	selector, refresh := "", false
+	rest := command
+	for rest != "" {
+		space, word, after := nextCommandWord(rest)
+		switch {
+		case word == "":
+			kept.WriteString(space)
+		case selector == "" && strings.EqualFold(word, "--account"):
+			_, value, afterValue := nextCommandWord(after)
+			if value == "" {
+				kept.WriteString(space + word + after)
+				after = ""
+				break
 			}
+			selector = value
+			after = afterValue
+		case selector == "" && strings.HasPrefix(strings.ToLower(word), "--account="):
+			selector = word[len("--account="):]
+		case !refresh && strings.EqualFold(word, "--refresh"):
+			refresh = true
+		default:
+			kept.WriteString(space + word)
 		}
+		rest = after
+	}
+	return kept.String(), selector, refresh
+}
 
-		conv, err := p.twilio.GetConversation(conversationSid)
-		if err != nil {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Could not find Twilio conversation with SID %s.", conversationSid),
-			}
+// nextCommandWord splits the text into the spacing before the next word, the
+// word and what comes after it.
+func nextCommandWord(text string) (string, string, string) {
+	start := strings.IndexFunc(text, func(r rune) bool { return !unicode.IsSpace(r) })
+	if start < 0 {
+		return text, "", ""
+	}
+	end := strings.IndexFunc(text[start:], unicode.IsSpace)
+	if end < 0 {
+		return text[:start], text[start:], ""
+	}
+	return text[:start], text[start : start+end], text[start+end:]
+}
+
+// rawCommandArgument returns everything in the command after the command
+// words, untouched by field splitting. The command options have to be
+// removed from the command first, see extractCommandOptions.
+func rawCommandArgument(command string, words []string) string {
+	rest := strings.TrimPrefix(strings.TrimSpace(command), "/")
+	for _, word := range words {
+		_, next, after := nextCommandWord(rest)
+		if next == "" || !strings.EqualFold(next, word) {
+			return ""
 		}
-		settings := &conversationSettings{
-			ConversationSid: conversationSid,
-			TeamId:          args.TeamId,
-			ChannelId:       args.ChannelId,
-			ChatServiceSid:  conv.ChatServiceSid,
+		rest = after
+	}
+	return strings.TrimSpace(rest)
+}
+
+func (c *Handler) executeAccountList(call *commandCall) *model.CommandResponse {
+	text := "Twilio accounts:\n"
+	for _, account := range call.p.getConfiguration().Accounts {
+		text += fmt.Sprintf("- %s (%s)", account.Name, account.AccountSid)
+		if account.Parent != "" {
+			text += fmt.Sprintf(" subaccount of %s", account.Parent)
+		}
+		text += "\n"
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func (c *Handler) executeChannelList(call *commandCall) *model.CommandResponse {
+	p, args := call.p, call.args
+	query := &channelListQuery{}
+	// The number and team may be given in either order
+	for _, arg := range []string{call.Arg("number"), call.Arg("team")} {
+		if arg == "" {
+			continue
 		}
-		if err := p.saveConversationSettings(settings); err != nil {
+		if strings.HasPrefix(arg, "+") {
+			query.Number = arg
+			continue
+		}
+		team, appErr := p.API.GetTeamByName(strings.ToLower(strings.TrimPrefix(arg, "~")))
+		if appErr != nil {
 			return &model.CommandResponse{
 				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Could not save conversation settings.",
+				Text:         fmt.Sprintf("Could not find team %s. Usage: %s", arg, commandUsage(call.path)),
 			}
 		}
+		query.TeamId = team.Id
+	}
+	post, err := p.channelListPost(call.ctx, args.UserId, query)
+	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("This channel is now linked to Twilio conversation %s.", conversationSid),
+			Text:         "Could not list linked channels: " + twilioErrorText(err),
 		}
-	case "disconnect":
-		conversation, err := p.getChannelConversationSettings(args.ChannelId)
-		if err != nil || conversation == nil {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "This channel is not linked to a Twilio conversation.",
-			}
+	}
+	post.ChannelId = args.ChannelId
+	p.API.SendEphemeralPost(args.UserId, post)
+	return &model.CommandResponse{}
+}
+
+func (c *Handler) executeChannelStatus(call *commandCall) *model.CommandResponse {
+	settings, err := call.p.store.GetByChannel(call.args.ChannelId)
+	if err != nil || settings == nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "This channel is not linked to a Twilio conversation.",
+			Attachments: []*model.SlackAttachment{{
+				Actions: []*model.PostAction{
+					dialogAction(dialogConnect, "Connect conversation", call.account),
+					dialogAction(dialogConversation, "New conversation", call.account),
+				},
+			}},
 		}
-		p.deleteConversationSettings(conversation)
+	}
+	conversationSid := settings.ConversationSid
+	participants, err := call.p.commandTwilioClient(call.account, settings).GetConversationParticipants(call.ctx, conversationSid)
+	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("This channel has been unlinked from Twilio conversation %s.", conversation.ConversationSid),
+			Text:         "Could not get Twilio conversation participants: " + twilioErrorText(err),
 		}
 	}
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Unknown channel command. Available commands are status, connect <conversation_sid>, disconnect. Use /twilio help for more information.",
+		Text:         fmt.Sprintf("This channel is linked to Twilio conversation %s with participants: %s", conversationSid, strings.Join(participants, ", ")),
 	}
 }
 
-func (c *Handler) executeConversationCommand(args *model.CommandArgs, p *TwilioPlugin, fields []string) *model.CommandResponse {
-	switch strings.ToLower(fields[0]) {
-	case "list":
-		page := 0
-		if len(fields) > 1 {
-			_, err := fmt.Sscanf(fields[1], "%d", &page)
-			if err != nil || page < 0 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Invalid page number. Usage: /twilio conversation list [page]",
-				}
-			}
+func (c *Handler) executeChannelConnect(call *commandCall) *model.CommandResponse {
+	p, args := call.p, call.args
+	if len(call.Words("conversation")) == 0 {
+		return p.commandDialog(call.ctx, args, dialogConnect, call.account, "Please provide a conversation to connect to. Usage: "+commandUsage(call.path))
+	}
+	existing, err := p.store.GetByChannel(args.ChannelId)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not read conversation settings.",
 		}
-		conversations, err := p.twilio.ListConversations()
-		if err != nil {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Could not list Twilio conversations.",
-			}
+	}
+	if existing != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("This channel is already linked to Twilio conversation %s. Please disconnect first before connecting to a new conversation.", existing.ConversationSid),
 		}
-		if len(conversations) == 0 {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "No Twilio conversations found.",
-			}
+	}
+	twilioClient := call.twilioClient()
+	conversationSid, response := call.conversation(twilioClient)
+	if response != nil {
+		return response
+	}
+	conv, err := twilioClient.GetConversation(call.ctx, conversationSid)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not find Twilio conversation with SID %s: %s", conversationSid, twilioErrorText(err)),
 		}
-		if page*20 >= len(conversations) {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "No more Twilio conversations found.",
-			}
+	}
+	settings := &conversationSettings{
+		ConversationSid: conversationSid,
+		TeamId:          args.TeamId,
+		ChannelId:       args.ChannelId,
+		ChatServiceSid:  conv.ChatServiceSid,
+		AccountSid:      twilioClient.Account().AccountSid,
+	}
+	if err := p.saveConversationSettings(settings); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not save conversation settings.",
 		}
-		end := (page + 1) * 20
-		if end > len(conversations) {
-			end = len(conversations)
-		}
-		totalCount := len(conversations)
-		conversations = conversations[page*20 : end]
-		text := "Twilio conversations:\n"
-		var wg sync.WaitGroup
-		guard := make(chan struct{}, 5) // limit to 5 concurrent goroutines
-		for _, conv := range conversations {
-			go func(conv openapi.ConversationsV1Conversation) {
-				guard <- struct{}{}
-				wg.Add(1)
-				defer func() {
-					<-guard
-					wg.Done()
-				}()
-				participants, err := p.twilio.GetConversationParticipants(*conv.Sid)
-				if err != nil {
-					text += fmt.Sprintf("- %s (could not get participants)\n", *conv.Sid)
-				} else {
-					text += fmt.Sprintf("- %s (participants: %s)\n", *conv.Sid, strings.Join(participants, ", "))
-				}
-			}(conv)
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("This channel is now linked to Twilio conversation %s.", conversationSid),
+	}
+}
+
+func (c *Handler) executeChannelDisconnect(call *commandCall) *model.CommandResponse {
+	conversation, err := call.p.store.GetByChannel(call.args.ChannelId)
+	if err != nil || conversation == nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "This channel is not linked to a Twilio conversation.",
+		}
+	}
+	call.p.deleteConversationSettings(conversation)
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("This channel has been unlinked from Twilio conversation %s.", conversation.ConversationSid),
+	}
+}
+
+func (c *Handler) executeConversationList(call *commandCall) *model.CommandResponse {
+	p, ctx := call.p, call.ctx
+	twilioClient := call.twilioClient()
+	filter := &conversationFilter{
+		State:        call.Arg("state"),
+		StartDate:    call.Arg("from"),
+		EndDate:      call.Arg("to"),
+		ProxyAddress: call.Arg("number"),
+	}
+	if err := filter.IsValid(); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Invalid filter: " + err.Error(),
 		}
-		wg.Wait()
-		text += fmt.Sprintf("Showing %d to %d of %d conversations. Use /twilio conversation list %d to see the next page.", page*20+1, end, totalCount, page+1)
+	}
+	page, err := twilioClient.ListConversationsPage(ctx, filter, call.Arg("page"), conversationPageSize)
+	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         text,
+			Text:         "Could not list Twilio conversations: " + twilioErrorText(err),
 		}
-	case "participants":
-		if len(fields) < 2 {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Please provide a conversation SID to list participants for. Usage: /twilio conversation participants <conversation_sid>",
-			}
+	}
+	conversations := page.Conversations
+	if len(conversations) == 0 && page.NextPage == "" {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "No Twilio conversations found.",
 		}
-		conversationSid := fields[1]
-		if !ConversationSidIsValid(conversationSid) {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Invalid conversation SID format. It should match ^CH[0-9a-fA-F]{32}$.",
-			}
+	}
+	text := "Twilio conversations, this page sorted by last activity:\n"
+	if len(conversations) == 0 {
+		text += "No conversations on this page match the filter.\n"
+	}
+	results := fetchAll(ctx, conversations, func(ctx context.Context, conv openapi.ConversationsV1Conversation) ([]string, error) {
+		return twilioClient.GetConversationParticipants(ctx, *conv.Sid)
+	})
+	for i, result := range results {
+		conv := &conversations[i]
+		text += "- " + *conv.Sid
+		if conv.FriendlyName != nil && *conv.FriendlyName != "" {
+			text += " " + *conv.FriendlyName
 		}
-		participants, err := p.twilio.GetConversationParticipants(conversationSid)
-		if err != nil {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Could not get participants for Twilio conversation %s.", conversationSid),
+		if conv.State != nil {
+			text += fmt.Sprintf(", %s", *conv.State)
+		}
+		if activity := lastActivity(conv); !activity.IsZero() {
+			text += ", last activity " + activity.UTC().Format("2006-01-02 15:04")
+		}
+		if result.Err != nil {
+			text += fmt.Sprintf(" (could not get participants: %s)", twilioErrorText(result.Err))
+		} else {
+			text += fmt.Sprintf(" (participants: %s)", strings.Join(result.Value, ", "))
+		}
+		text += ", " + p.conversationLinkText(*conv.Sid) + "\n"
+	}
+	if page.NextPage != "" {
+		command := call.command()
+		for _, name := range []string{"state", "from", "to", "number"} {
+			if value := call.Arg(name); value != "" {
+				command += fmt.Sprintf(" --%s %s", name, value)
 			}
 		}
+		text += fmt.Sprintf("Use `%s --page %s` to see the next page.", command, page.NextPage)
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func (c *Handler) executeConversationNew(call *commandCall) *model.CommandResponse {
+	return call.p.commandDialog(call.ctx, call.args, dialogConversation, call.account, "Starting a conversation needs a dialog, which this client can not show.")
+}
+
+// conversation resolves the conversation argument of the command to a single
+// SID, see TwilioPlugin.commandConversation.
+func (call *commandCall) conversation(twilioClient ITwilioClient) (string, *model.CommandResponse) {
+	return call.p.commandConversation(call.ctx, call.args, twilioClient, call.account, call.command(), call.Words("conversation"))
+}
+
+func (c *Handler) executeConversationParticipants(call *commandCall) *model.CommandResponse {
+	twilioClient := call.twilioClient()
+	conversationSid, response := call.conversation(twilioClient)
+	if response != nil {
+		return response
+	}
+	participants, err := twilioClient.GetConversationParticipants(call.ctx, conversationSid)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not get participants for Twilio conversation %s: %s", conversationSid, twilioErrorText(err)),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Participants in Twilio conversation %s: %s", conversationSid, strings.Join(participants, ", ")),
+	}
+}
+
+func (c *Handler) executeConversationWebhooksList(call *commandCall) *model.CommandResponse {
+	twilioClient := call.twilioClient()
+	conversationSid, response := call.conversation(twilioClient)
+	if response != nil {
+		return response
+	}
+	webhooks, err := twilioClient.ListConversationWebhooks(call.ctx, conversationSid)
+	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         fmt.Sprintf("Participants in Twilio conversation %s: %s", conversationSid, strings.Join(participants, ", ")),
+			Text:         fmt.Sprintf("Could not list webhooks for Twilio conversation %s: %s", conversationSid, twilioErrorText(err)),
 		}
-	case "webhooks":
-		if len(fields) < 2 {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Please provide a subcommand (list, add, remove) and a conversation SID. Usage: /twilio conversation webhooks [list|add|remove] <conversation_sid>",
-			}
+	}
+	if len(webhooks) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("No webhooks found for Twilio conversation %s.", conversationSid),
 		}
-		switch strings.ToLower(fields[1]) {
-		case "list":
-			if len(fields) < 3 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Please provide a conversation SID to list webhooks for. Usage: /twilio conversation webhooks list <conversation_sid>",
-				}
-			}
-			conversationSid := fields[2]
-			if !ConversationSidIsValid(conversationSid) {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Invalid conversation SID format. It should match ^CH[0-9a-fA-F]{32}$.",
-				}
-			}
-			webhooks, err := p.twilio.ListConversationWebhooks(conversationSid)
-			if err != nil {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("Could not list webhooks for Twilio conversation %s.", conversationSid),
-				}
-			}
-			if len(webhooks) == 0 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("No webhooks found for Twilio conversation %s.", conversationSid),
+	}
+	text := fmt.Sprintf("Webhooks for Twilio conversation %s:\n", conversationSid)
+	for _, wh := range webhooks {
+		var url string
+		var eventsStr []string
+		url = ""
+
+		if wh.Configuration != nil {
+			if configMap, ok := (*wh.Configuration).(map[string]interface{}); ok {
+				if u, ok := configMap["url"].(string); ok {
+					url = u
 				}
-			}
-			text := fmt.Sprintf("Webhooks for Twilio conversation %s:\n", conversationSid)
-			for _, wh := range webhooks {
-				var url string
-				var eventsStr []string
-				url = ""
-
-				if wh.Configuration != nil {
-					if configMap, ok := (*wh.Configuration).(map[string]interface{}); ok {
-						if u, ok := configMap["url"].(string); ok {
-							url = u
-						}
-						if events, ok := configMap["events"].([]interface{}); ok {
+				if events, ok := configMap["events"].([]interface{}); ok {
 
-							for _, e := range events {
-								if es, ok := e.(string); ok {
-									eventsStr = append(eventsStr, es)
-								}
-							}
+					for _, e := range events {
+						if es, ok := e.(string); ok {
+							eventsStr = append(eventsStr, es)
 						}
 					}
 				}
-				text += fmt.Sprintf("- SID: %s, URL: %s, Events: %s\n", *wh.Sid, url, strings.Join(eventsStr, ", "))
-			}
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         text,
-			}
-		case "add":
-			if len(fields) < 3 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Please provide a conversation SID to add a webhook to. Usage: /twilio conversation webhooks add <conversation_sid>",
-				}
-			}
-			conversationSid := fields[2]
-			if !ConversationSidIsValid(conversationSid) {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Invalid conversation SID format. It should match ^CH[0-9a-fA-F]{32}$.",
-				}
-			}
-			err := p.twilio.AddWebhookToConversation(conversationSid)
-			if err != nil {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("Could not add webhook to Twilio conversation %s.", conversationSid),
-				}
-			}
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Webhook added to Twilio conversation %s.", conversationSid),
-			}
-		case "remove":
-			if len(fields) < 3 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Please provide a conversation SID to remove the webhook from. Usage: /twilio conversation webhooks remove <conversation_sid>",
-				}
-			}
-			conversationSid := fields[2]
-			if !ConversationSidIsValid(conversationSid) {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Invalid conversation SID format. It should match ^CH[0-9a-fA-F]{32}$.",
-				}
-			}
-			err := p.twilio.RemoveWebhookFromConversation(conversationSid)
-			if err != nil {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("Could not remove webhook from Twilio conversation %s.", conversationSid),
-				}
-			}
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Webhook removed from Twilio conversation %s.", conversationSid),
-			}
-		default:
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Unknown webhooks subcommand. Available subcommands are list <conversation_sid>, add <conversation_sid>, remove <conversation_sid>. Use /twilio help for more information.",
 			}
 		}
+		text += fmt.Sprintf("- SID: %s, URL: %s, Events: %s\n", *wh.Sid, url, strings.Join(eventsStr, ", "))
 	}
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Unknown conversation command. Available commands are list [page], participants <conversation_sid>, webhooks [list|add|remove] <conversation_sid>. Use /twilio help for more information.",
+		Text:         text,
 	}
 }
 
-func (c *Handler) executeNumberCommand(args *model.CommandArgs, p *TwilioPlugin, fields []string) *model.CommandResponse {
-
-	numbers, err := p.twilio.AccountNumbers()
+func (c *Handler) executeConversationWebhooksAdd(call *commandCall) *model.CommandResponse {
+	twilioClient := call.twilioClient()
+	conversationSid, response := call.conversation(twilioClient)
+	if response != nil {
+		return response
+	}
+	err := twilioClient.AddWebhookToConversation(call.ctx, conversationSid)
 	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         "Could not find phone numbers.",
+			Text:         fmt.Sprintf("Could not add webhook to Twilio conversation %s: %s", conversationSid, twilioErrorText(err)),
 		}
 	}
-	if len(numbers) == 0 {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Webhook added to Twilio conversation %s.", conversationSid),
+	}
+}
+
+func (c *Handler) executeConversationWebhooksRemove(call *commandCall) *model.CommandResponse {
+	twilioClient := call.twilioClient()
+	conversationSid, response := call.conversation(twilioClient)
+	if response != nil {
+		return response
+	}
+	err := twilioClient.RemoveWebhookFromConversation(call.ctx, conversationSid)
+	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         "No phone numbers found.",
+			Text:         fmt.Sprintf("Could not remove webhook from Twilio conversation %s: %s", conversationSid, twilioErrorText(err)),
 		}
 	}
-	switch strings.ToLower(fields[0]) {
-	case "list":
-		text := "Phone numbers:\n"
-		for _, num := range numbers {
-			text += fmt.Sprintf("- %s\n", *num.PhoneNumber)
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Webhook removed from Twilio conversation %s.", conversationSid),
+	}
+}
+
+// accountNumbers returns the phone numbers of the account, or the response
+// to send when there are none.
+func (call *commandCall) accountNumbers() ([]messaging.MessagingV1PhoneNumber, *model.CommandResponse) {
+	numbers, err := call.twilioClient().AccountNumbers(call.ctx)
+	if err != nil {
+		return nil, &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not find phone numbers: " + twilioErrorText(err),
 		}
-		return &model.CommandResponse{
+	}
+	if len(numbers) == 0 {
+		return nil, &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         text,
+			Text:         "No phone numbers found.",
 		}
-	case "webhooks":
-		if len(fields) < 2 {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Please provide a subcommand (setup, remove) and a phone number. Usage: /twilio number webhooks [setup|remove] <phone_number>",
-			}
+	}
+	return numbers, nil
+}
+
+// accountNumber checks that the phone number belongs to the account,
+// returning the response to send when it does not.
+func (call *commandCall) accountNumber(phoneNumber string) *model.CommandResponse {
+	numbers, response := call.accountNumbers()
+	if response != nil {
+		return response
+	}
+	for _, num := range numbers {
+		if num.PhoneNumber != nil && *num.PhoneNumber == phoneNumber {
+			return nil
 		}
-		switch strings.ToLower(fields[1]) {
-		case "setup":
-			if len(fields) < 3 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Please provide a phone number to set up a webhook for. Usage: /twilio number webhooks setup <phone_number>",
-				}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Phone number %s is not associated with your Twilio account.", phoneNumber),
+	}
+}
+
+func (c *Handler) executeNumberList(call *commandCall) *model.CommandResponse {
+	p := call.p
+	numbers, response := call.accountNumbers()
+	if response != nil {
+		return response
+	}
+	assignments, err := p.getNumberAssignments()
+	if err != nil {
+		p.API.LogError("Could not get number assignments", "error", err.Error())
+	}
+	text := "Phone numbers:\n"
+	for _, num := range numbers {
+		text += fmt.Sprintf("- %s", *num.PhoneNumber)
+		if assignment, ok := assignments[*num.PhoneNumber]; ok {
+			if team, appErr := p.API.GetTeam(assignment.TeamId); appErr == nil {
+				text += fmt.Sprintf(" (team: %s)", team.Name)
 			}
-			phoneNumber := fields[2]
-			found := false
-			for _, num := range numbers {
-				if num.PhoneNumber != nil && *num.PhoneNumber == phoneNumber {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("Phone number %s is not associated with your Twilio account.", phoneNumber),
-				}
-			}
-			go p.twilio.SetupPhoneNumberAsync(phoneNumber, args)
+		}
+		text += "\n"
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+		Attachments: []*model.SlackAttachment{{
+			Actions: []*model.PostAction{dialogAction(dialogNumber, "Set up a number", call.account)},
+		}},
+	}
+}
+
+func (c *Handler) executeNumberAssign(call *commandCall) *model.CommandResponse {
+	p := call.p
+	phoneNumber := call.Arg("phone_number")
+	// Messaging services are not listed with the numbers
+	if !strings.HasPrefix(phoneNumber, "MG") {
+		if response := call.accountNumber(phoneNumber); response != nil {
+			return response
+		}
+	}
+	team, appErr := p.API.GetTeamByName(call.Arg("team"))
+	if appErr != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not find team %s.", call.Arg("team")),
+		}
+	}
+	assignment := &numberAssignment{
+		Number: phoneNumber,
+		TeamId: team.Id,
+	}
+	if users := call.Words("users"); len(users) > 0 {
+		userIds, unknown := p.lookupUserIds(strings.Join(users, ","))
+		if unknown != "" {
 			return &model.CommandResponse{
 				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Setting up webhook for phone number %s. This may take a few seconds.", phoneNumber),
+				Text:         fmt.Sprintf("Could not find user %s.", unknown),
 			}
+		}
+		assignment.UserIds = userIds
+	}
+	if err := p.assignNumber(assignment); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not save number assignment.",
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("New conversations on %s will go to team %s.", phoneNumber, team.Name),
+	}
+}
 
-		case "remove":
-			if len(fields) < 3 {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         "Please provide a phone number to remove the webhook for. Usage: /twilio number webhooks remove <phone_number>",
-				}
-			}
-			phoneNumber := fields[2]
-			found := false
-			for _, num := range numbers {
-				if num.PhoneNumber != nil && *num.PhoneNumber == phoneNumber {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("Phone number %s is not associated with your Twilio account.", phoneNumber),
-				}
-			}
-			err := p.twilio.RemovePhoneNumber(phoneNumber)
-			if err != nil {
-				return &model.CommandResponse{
-					ResponseType: model.CommandResponseTypeEphemeral,
-					Text:         fmt.Sprintf("Could not remove webhook for phone number %s.", phoneNumber),
-				}
-			}
+func (c *Handler) executeNumberUnassign(call *commandCall) *model.CommandResponse {
+	phoneNumber := call.Arg("phone_number")
+	deleted, err := call.p.unassignNumber(phoneNumber)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not remove number assignment.",
+		}
+	}
+	if !deleted {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Phone number %s is not assigned to a team.", phoneNumber),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("New conversations on %s will go to the default team.", phoneNumber),
+	}
+}
+
+func (c *Handler) executeNumberWebhooksSetup(call *commandCall) *model.CommandResponse {
+	p, args := call.p, call.args
+	phoneNumber := call.Arg("phone_number")
+	if phoneNumber == "" {
+		return p.commandDialog(call.ctx, args, dialogNumber, call.account, "Please provide a phone number to set up a webhook for. Usage: "+commandUsage(call.path))
+	}
+	if response := call.accountNumber(phoneNumber); response != nil {
+		return response
+	}
+	if err := p.startJob(&backgroundJob{
+		Kind:        jobSetupNumber,
+		AccountSid:  call.twilioClient().Account().AccountSid,
+		PhoneNumber: phoneNumber,
+		Scan:        call.Flag("scan"),
+		UserId:      args.UserId,
+		ChannelId:   args.ChannelId,
+	}); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not set up phone number %s: %s", phoneNumber, err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Setting up webhook for phone number %s. This may take a few seconds.", phoneNumber),
+	}
+}
+
+func (c *Handler) executeNumberWebhooksRemove(call *commandCall) *model.CommandResponse {
+	phoneNumber := call.Arg("phone_number")
+	if response := call.accountNumber(phoneNumber); response != nil {
+		return response
+	}
+	count, err := call.twilioClient().RemovePhoneNumber(call.ctx, phoneNumber, call.Flag("scan"))
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not remove webhook for phone number %s: %s", phoneNumber, twilioErrorText(err)),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Webhook removed for phone number %s and %d of its conversations.", phoneNumber, count),
+	}
+}
+
+func (c *Handler) executeNumberWebhooksRepoint(call *commandCall) *model.CommandResponse {
+	p, args := call.p, call.args
+	oldWebhook := call.Arg("old_url")
+	if oldWebhook == "" {
+		previous, err := p.getPreviousWebhookURL()
+		if err != nil || previous == "" {
 			return &model.CommandResponse{
 				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Webhook removed for phone number %s.", phoneNumber),
+				Text:         "No previous webhook URL is known. Usage: " + commandUsage(call.path),
 			}
-		default:
+		}
+		oldWebhook = previous
+	}
+	// Without an account selected every account is repointed
+	accountSid := ""
+	if call.account != nil {
+		accountSid = call.account.AccountSid
+	}
+	if err := p.startJob(&backgroundJob{
+		Kind:       jobRepointWebhooks,
+		AccountSid: accountSid,
+		OldWebhook: oldWebhook,
+		UserId:     args.UserId,
+		ChannelId:  args.ChannelId,
+	}); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not move webhooks: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Moving webhooks from %s to %s. This may take a while.", oldWebhook, p.getWebhookURL()),
+	}
+}
+
+func (c *Handler) executeFlowList(call *commandCall) *model.CommandResponse {
+	flows, err := call.p.getFlows()
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not get flows.",
+		}
+	}
+	if len(flows) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "No flows configured.",
+		}
+	}
+	names := make([]string, 0, len(flows))
+	for name := range flows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	text := "Flows:\n"
+	for _, name := range names {
+		text += fmt.Sprintf("- %s (keywords: %s)\n", name, strings.Join(flows[name].Keywords, ", "))
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func (c *Handler) executeFlowShow(call *commandCall) *model.CommandResponse {
+	flows, err := call.p.getFlows()
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not get flows.",
+		}
+	}
+	name := call.Arg("name")
+	flow, ok := flows[name]
+	if !ok {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Flow %s does not exist.", name),
+		}
+	}
+	data, _ := json.MarshalIndent(flow, "", "  ")
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("```json\n%s\n```", string(data)),
+	}
+}
+
+func (c *Handler) executeFlowSet(call *commandCall) *model.CommandResponse {
+	// The JSON is taken from the raw command so whitespace inside replies
+	// survives
+	var flow flowDefinition
+	if err := json.Unmarshal([]byte(call.Arg("json")), &flow); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Invalid flow JSON: %s", err.Error()),
+		}
+	}
+	if err := call.p.saveFlow(&flow); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not save flow: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Flow %s saved.", flow.Name),
+	}
+}
+
+func (c *Handler) executeFlowDelete(call *commandCall) *model.CommandResponse {
+	name := call.Arg("name")
+	deleted, err := call.p.deleteFlow(name)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not delete flow.",
+		}
+	}
+	if !deleted {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Flow %s does not exist.", name),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Flow %s deleted.", name),
+	}
+}
+
+func (c *Handler) executeFlowReset(call *commandCall) *model.CommandResponse {
+	// The flow state outlives the conversation, so a SID is taken as is
+	conversationSid := call.Arg("conversation")
+	if !ConversationSidIsValid(conversationSid) {
+		var response *model.CommandResponse
+		conversationSid, response = call.conversation(call.twilioClient())
+		if response != nil {
+			return response
+		}
+	}
+	call.p.clearFlowState(conversationSid)
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Twilio conversation %s is no longer in a flow.", conversationSid),
+	}
+}
+
+func (c *Handler) executeRouteList(call *commandCall) *model.CommandResponse {
+	rules, err := call.p.getRoutingRules()
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not get routing rules.",
+		}
+	}
+	if len(rules) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "No routing rules configured. New conversations get their own channel in the team of the receiving number.",
+		}
+	}
+	text := "Routing rules:\n"
+	for i, rule := range rules {
+		data, _ := json.Marshal(rule)
+		text += fmt.Sprintf("%d. `%s`\n", i+1, string(data))
+	}
+	if tags, err := call.p.getContactTags(); err == nil && len(tags) > 0 {
+		numbers := make([]string, 0, len(tags))
+		for number := range tags {
+			numbers = append(numbers, number)
+		}
+		sort.Strings(numbers)
+		text += "Contact tags:\n"
+		for _, number := range numbers {
+			text += fmt.Sprintf("- %s: %s\n", number, strings.Join(tags[number], ", "))
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func (c *Handler) executeRouteAdd(call *commandCall) *model.CommandResponse {
+	p := call.p
+	var rule routingRule
+	if err := json.Unmarshal([]byte(call.Arg("json")), &rule); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Invalid rule JSON: %s", err.Error()),
+		}
+	}
+	if rule.Team != "" {
+		if _, appErr := p.API.GetTeamByName(rule.Team); appErr != nil {
 			return &model.CommandResponse{
 				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         "Unknown webhooks subcommand. Available subcommands are setup <phone_number>, remove <phone_number>. Use /twilio help for more information.",
+				Text:         fmt.Sprintf("Could not find team %s.", rule.Team),
 			}
 		}
 	}
+	if err := p.saveRoutingRule(&rule); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not save routing rule: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Routing rule %s saved.", rule.Name),
+	}
+}
+
+func (c *Handler) executeRouteRemove(call *commandCall) *model.CommandResponse {
+	name := call.Arg("name")
+	deleted, err := call.p.deleteRoutingRule(name)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not remove routing rule.",
+		}
+	}
+	if !deleted {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Routing rule %s does not exist.", name),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Routing rule %s removed.", name),
+	}
+}
+
+func (c *Handler) executeRouteTag(call *commandCall) *model.CommandResponse {
+	number := call.Arg("number")
+	var tags []string
+	for _, word := range call.Words("tags") {
+		for _, tag := range strings.Split(word, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !hasTag(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if err := call.p.setContactTags(number, tags); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not save contact tags: %s", err.Error()),
+		}
+	}
+	if len(tags) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Removed the contact tags of %s.", number),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Contact tags of %s set to %s.", number, strings.Join(tags, ", ")),
+	}
+}
+
+func (c *Handler) executeRouteTest(call *commandCall) *model.CommandResponse {
+	p := call.p
+	route, err := p.resolveRoute(call.Arg("from"), call.Arg("to"), "", call.Arg("text"))
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not resolve route: %s", err.Error()),
+		}
+	}
+	rule := route.Rule
+	if rule == "" {
+		rule = "(none, using defaults)"
+	}
+	teamName := route.TeamId
+	if team, appErr := p.API.GetTeam(route.TeamId); appErr == nil {
+		teamName = team.Name
+	}
+	var users []string
+	for _, userId := range route.UserIds {
+		if user, appErr := p.API.GetUser(userId); appErr == nil {
+			users = append(users, user.Username)
+		}
+	}
+	destination := "own channel"
+	if route.Mode == routeModeThread {
+		destination = "thread in ~" + route.Inbox
+	}
+	privacy := "public"
+	if route.Private {
+		privacy = "private"
+	}
+	senderTags := "(none)"
+	if len(route.Tags) > 0 {
+		senderTags = strings.Join(route.Tags, ", ")
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Rule: %s\nSender tags: %s\nTeam: %s\nDestination: %s (%s)\nMembers: %s", rule, senderTags, teamName, destination, privacy, strings.Join(users, ", ")),
+	}
+}
+
+func (c *Handler) executeDoctorMappings(call *commandCall) *model.CommandResponse {
+	fix := call.Flag("fix")
+	accountSid := ""
+	if call.account != nil {
+		accountSid = call.account.AccountSid
+	}
+	if err := call.p.startJob(&backgroundJob{
+		Kind:       jobDoctorMappings,
+		AccountSid: accountSid,
+		Fix:        fix,
+		UserId:     call.args.UserId,
+		ChannelId:  call.args.ChannelId,
+	}); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not check mappings: %s", err.Error()),
+		}
+	}
+	text := "Checking conversation mappings. This may take a while."
+	if fix {
+		text = "Checking and repairing conversation mappings. This may take a while."
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func (c *Handler) executeRebuild(call *commandCall) *model.CommandResponse {
+	accountSid := ""
+	if call.account != nil {
+		accountSid = call.account.AccountSid
+	}
+	if err := call.p.startJob(&backgroundJob{
+		Kind:       jobRebuildMappings,
+		AccountSid: accountSid,
+		UserId:     call.args.UserId,
+		ChannelId:  call.args.ChannelId,
+	}); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not rebuild mappings: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         "Rebuilding conversation mappings. This may take a while.",
+	}
+}
+
+func (c *Handler) executeBackupExport(call *commandCall) *model.CommandResponse {
+	if err := call.p.sendBackup(call.args.UserId); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not export backup: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         "The backup was sent to you in a direct message from the Twilio bot.",
+	}
+}
+
+func (c *Handler) executeBackupRestore(call *commandCall) *model.CommandResponse {
+	mode := call.Arg("mode")
+	if mode == "" {
+		mode = backupModeSkip
+	}
+	backup, err := call.p.readBackupPost(call.args.UserId, call.Arg("post"))
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not read backup: %s", err.Error()),
+		}
+	}
+	summary, err := call.p.restoreBackup(backup, mode, call.Flag("dry-run"))
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not restore backup: %s", err.Error()),
+		}
+	}
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Unknown number command. Available commands are list, webhooks [setup|remove] <phone_number>. Use /twilio help for more information.",
+		Text:         summary.Text(),
 	}
 }
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// commandNode is a command under /twilio, or a group of them. The tree of
+// nodes is the only description of the commands: dispatch, argument checks,
+// usage errors, /twilio help and autocomplete are all generated from it.
+type commandNode struct {
+	Name string
+	// Help is a short description, shown in autocomplete and /twilio help
+	Help string
+	// Details are added to the help in /twilio help
+	Details string
+	// Admin limits the command, or every command of the group, to system
+	// admins
+	Admin    bool
+	Args     []commandArg
+	Children []*commandNode
+	Run      func(call *commandCall) *model.CommandResponse
+}
+
+// commandArg is an argument of a command. Arguments are positional unless
+// they are a --name flag or a --name value option.
+type commandArg struct {
+	Name string
+	Help string
+	// Hint is the placeholder of an option value, <name> when empty
+	Hint string
+	// Optional arguments may be left out, positional ones only at the end
+	Optional bool
+	// Rest takes all remaining words, for names and texts with spaces
+	Rest bool
+	// Raw takes the rest of the command untouched by word splitting
+	Raw    bool
+	Flag   bool
+	Option bool
+	// Choices the value must be one of, offered as a list in autocomplete
+	Choices []model.AutocompleteListItem
+	// Suggestions is the dynamic list autocomplete fetches values from
+	Suggestions string
+	Validate    func(value string) error
+}
+
+// commandCall is a command being run, with its arguments checked against the
+// command node.
+type commandCall struct {
+	ctx     context.Context
+	args    *model.CommandArgs
+	p       *TwilioPlugin
+	account *twilioAccount
+	root    *commandNode
+	path    []*commandNode
+	values  map[string][]string
+}
+
+// Arg returns the value of the argument or option, empty when left out.
+func (call *commandCall) Arg(name string) string {
+	return strings.Join(call.values[name], " ")
+}
+
+// Words returns the words of an argument taking the rest of the command.
+func (call *commandCall) Words(name string) []string {
+	return call.values[name]
+}
+
+// Flag reports whether the --name flag was given.
+func (call *commandCall) Flag(name string) bool {
+	return len(call.values[name]) > 0
+}
+
+// twilioClient returns the client of the account selected with --account.
+func (call *commandCall) twilioClient() ITwilioClient {
+	return call.p.commandTwilioClient(call.account, nil)
+}
+
+// command returns the command words, like /twilio channel connect.
+func (call *commandCall) command() string {
+	return commandPath(call.path)
+}
+
+func commandPath(path []*commandNode) string {
+	var words []string
+	for _, node := range path {
+		words = append(words, node.Name)
+	}
+	return "/" + strings.Join(words, " ")
+}
+
+// dispatch finds the command in the tree, checks the permissions and
+// arguments and runs it. Anything that does not fit gets the usage.
+func dispatch(ctx context.Context, args *model.CommandArgs, p *TwilioPlugin, account *twilioAccount, root *commandNode, fields []string) *model.CommandResponse {
+	path := []*commandNode{root}
+	node := root
+	for node.Run == nil {
+		if len(fields) == 0 {
+			return usageResponse(fmt.Sprintf("Available %s commands are %s.", commandPath(path), childSummary(node)))
+		}
+		child := node.child(fields[0])
+		if child == nil {
+			return usageResponse(fmt.Sprintf("Unknown command: %s. Available %s commands are %s.", fields[0], commandPath(path), childSummary(node)))
+		}
+		path = append(path, child)
+		node = child
+		fields = fields[1:]
+	}
+
+	for i, parent := range path {
+		if parent.Admin && !p.API.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+			return &model.CommandResponse{
+				ResponseType: model.CommandResponseTypeEphemeral,
+				Text:         fmt.Sprintf("Only system administrators can use %s.", commandPath(path[:i+1])),
+			}
+		}
+	}
+
+	var words []string
+	for _, parent := range path {
+		words = append(words, parent.Name)
+	}
+	values, err := node.parse(rawCommandArgument(args.Command, words), fields)
+	if err != nil {
+		return usageResponse(fmt.Sprintf("%s Usage: %s.", err.Error(), commandUsage(path)))
+	}
+	return node.Run(&commandCall{
+		ctx:     ctx,
+		args:    args,
+		p:       p,
+		account: account,
+		root:    root,
+		path:    path,
+		values:  values,
+	})
+}
+
+func usageResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text + " Use /twilio help for more information.",
+	}
+}
+
+// find returns the path to the command with the words, nil when there is
+// no such command.
+func (node *commandNode) find(words []string) []*commandNode {
+	path := []*commandNode{node}
+	for _, word := range words {
+		child := path[len(path)-1].child(word)
+		if child == nil {
+			return nil
+		}
+		path = append(path, child)
+	}
+	if path[len(path)-1].Run == nil {
+		return nil
+	}
+	return path
+}
+
+func (node *commandNode) hasArg(name string) bool {
+	for _, arg := range node.Args {
+		if arg.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *commandNode) child(name string) *commandNode {
+	for _, child := range node.Children {
+		if strings.EqualFold(child.Name, name) {
+			return child
+		}
+	}
+	return nil
+}
+
+// parse matches the command fields to the arguments of the node. Raw is the
+// command text after the command words, taken as is by a Raw argument.
+func (node *commandNode) parse(raw string, fields []string) (map[string][]string, error) {
+	values := map[string][]string{}
+	var options []string
+	for _, arg := range node.Args {
+		switch {
+		case arg.Flag:
+			var given bool
+			if fields, given = extractFlag(fields, arg.Name); given {
+				values[arg.Name] = []string{"--" + arg.Name}
+			}
+		case arg.Option:
+			options = append(options, arg.Name)
+		}
+	}
+	fields, found := extractOptions(fields, options...)
+	for name, value := range found {
+		values[name] = []string{value}
+	}
+
+	for _, arg := range node.Args {
+		if arg.Flag || arg.Option {
+			continue
+		}
+		switch {
+		case arg.Raw:
+			if raw != "" {
+				values[arg.Name] = []string{raw}
+			}
+			fields = nil
+		case arg.Rest:
+			if len(fields) > 0 {
+				values[arg.Name] = fields
+			}
+			fields = nil
+		case len(fields) > 0:
+			values[arg.Name] = fields[:1]
+			fields = fields[1:]
+		}
+		if len(values[arg.Name]) == 0 && !arg.Optional {
+			return nil, errors.Errorf("Missing %s.", arg.usage())
+		}
+	}
+	if len(fields) > 0 {
+		return nil, errors.Errorf("Unexpected argument %s.", fields[0])
+	}
+
+	for _, arg := range node.Args {
+		value := strings.Join(values[arg.Name], " ")
+		if value == "" || arg.Flag {
+			continue
+		}
+		if len(arg.Choices) > 0 {
+			value = strings.ToLower(value)
+			if !arg.hasChoice(value) {
+				return nil, errors.Errorf("Invalid %s %s, use one of %s.", arg.Name, value, arg.choiceList(", "))
+			}
+			values[arg.Name] = []string{value}
+		}
+		if arg.Validate != nil {
+			if err := arg.Validate(value); err != nil {
+				return nil, errors.Errorf("Invalid %s %s: %s.", arg.Name, value, err.Error())
+			}
+		}
+	}
+	return values, nil
+}
+
+func (arg *commandArg) hasChoice(value string) bool {
+	for _, choice := range arg.Choices {
+		if choice.Item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (arg *commandArg) choiceList(separator string) string {
+	var items []string
+	for _, choice := range arg.Choices {
+		items = append(items, choice.Item)
+	}
+	return strings.Join(items, separator)
+}
+
+// usage describes the argument the way the usage of its command shows it.
+func (arg *commandArg) usage() string {
+	var text string
+	switch {
+	case arg.Flag:
+		return "[--" + arg.Name + "]"
+	case arg.Option && len(arg.Choices) > 0:
+		text = "--" + arg.Name + " " + arg.choiceList("|")
+	case arg.Option:
+		text = "--" + arg.Name + " " + arg.hint()
+	case len(arg.Choices) > 0:
+		text = arg.choiceList("|")
+	default:
+		text = arg.Name
+	}
+	if arg.Optional {
+		return "[" + text + "]"
+	}
+	if arg.Option {
+		return text
+	}
+	return "<" + text + ">"
+}
+
+func (arg *commandArg) hint() string {
+	if arg.Hint != "" {
+		return arg.Hint
+	}
+	return "<" + arg.Name + ">"
+}
+
+// argsUsage lists the arguments of the command.
+func (node *commandNode) argsUsage() string {
+	var parts []string
+	for _, arg := range node.Args {
+		parts = append(parts, arg.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// summary is the command with its arguments, or the group with its commands.
+func (node *commandNode) summary() string {
+	if node.Run == nil {
+		return node.Name + " [" + strings.Join(childNames(node), "|") + "]"
+	}
+	return strings.TrimSpace(node.Name + " " + node.argsUsage())
+}
+
+func childSummary(node *commandNode) string {
+	var summaries []string
+	for _, child := range node.Children {
+		summaries = append(summaries, child.summary())
+	}
+	return strings.Join(summaries, ", ")
+}
+
+func commandUsage(path []*commandNode) string {
+	return strings.TrimSpace(commandPath(path) + " " + path[len(path)-1].argsUsage())
+}
+
+// helpText renders the tree below the root for /twilio help.
+func helpText(root *commandNode) string {
+	text := "**Command structure**\n"
+	var walk func(node *commandNode, depth int)
+	walk = func(node *commandNode, depth int) {
+		line := strings.Repeat("\t", depth) + "**"
+		if node.Run == nil {
+			line += node.Name + ":**"
+		} else {
+			line += strings.TrimSpace(node.Name+" "+node.argsUsage()) + ":** " + node.Help
+			if node.Details != "" {
+				line += ". " + node.Details
+			}
+		}
+		if node.Admin {
+			line += " (system admins only)"
+		}
+		text += line + "\n"
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+	}
+	for _, child := range root.Children {
+		walk(child, 1)
+	}
+	return text
+}
+
+// autocompleteData turns the node and everything below it into autocomplete
+// data.
+func (node *commandNode) autocompleteData() *model.AutocompleteData {
+	data := &model.AutocompleteData{
+		Trigger:  node.Name,
+		HelpText: node.Help,
+	}
+	if node.Admin {
+		data.RoleID = model.SystemAdminRoleId
+	}
+	if node.Run == nil {
+		data.Hint = "[" + strings.Join(childNames(node), "|") + "]"
+		data.HelpText = fmt.Sprintf("%s commands are %s", node.Name, childSummary(node))
+		for _, child := range node.Children {
+			data.AddCommand(child.autocompleteData())
+		}
+		return data
+	}
+
+	data.Hint = node.argsUsage()
+	// Positional arguments have to come before named ones
+	for _, arg := range node.Args {
+		switch {
+		case arg.Flag || arg.Option:
+		case arg.Suggestions != "":
+			data.AddDynamicListArgument(arg.Help, arg.Suggestions, !arg.Optional)
+		case len(arg.Choices) > 0:
+			data.AddStaticListArgument(arg.Help, !arg.Optional, arg.Choices)
+		default:
+			data.AddTextArgument(arg.Help, arg.usage(), "")
+		}
+	}
+	for _, arg := range node.Args {
+		if arg.Flag {
+			data.AddStaticListArgument(arg.Help, false, []model.AutocompleteListItem{
+				{Item: "--" + arg.Name, HelpText: arg.Help},
+			})
+		}
+	}
+	for _, arg := range node.Args {
+		switch {
+		case !arg.Option:
+		case len(arg.Choices) > 0:
+			data.AddNamedStaticListArgument(arg.Name, arg.Help, false, arg.Choices)
+		case arg.Suggestions != "":
+			data.AddNamedDynamicListArgument(arg.Name, arg.Help, arg.Suggestions, false)
+		default:
+			data.AddNamedTextArgument(arg.Name, arg.Help, arg.hint(), "", false)
+		}
+	}
+	return data
+}
+
+func childNames(node *commandNode) []string {
+	var names []string
+	for _, child := range node.Children {
+		names = append(names, child.Name)
+	}
+	return names
+}
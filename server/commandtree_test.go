@@ -0,0 +1,208 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+func TestCommandNodeParse(t *testing.T) {
+	node := &commandNode{
+		Name: "list",
+		Args: []commandArg{
+			{Name: "fix", Flag: true},
+			{Name: "state", Option: true, Optional: true, Choices: []model.AutocompleteListItem{{Item: "active"}, {Item: "closed"}}},
+			{Name: "page", Option: true, Optional: true},
+			{Name: "number", Validate: func(value string) error {
+				if !strings.HasPrefix(value, "+") {
+					return errors.New("needs a leading +")
+				}
+				return nil
+			}},
+			{Name: "text", Optional: true, Rest: true},
+		},
+	}
+	raw := &commandNode{
+		Name: "set",
+		Args: []commandArg{{Name: "json", Raw: true}},
+	}
+
+	tests := []struct {
+		name   string
+		node   *commandNode
+		raw    string
+		fields []string
+		want   map[string][]string
+		err    string
+	}{{
+		name:   "positional only",
+		node:   node,
+		fields: []string{"+1555"},
+		want:   map[string][]string{"number": {"+1555"}},
+	}, {
+		name:   "flag anywhere",
+		node:   node,
+		fields: []string{"+1555", "--FIX"},
+		want:   map[string][]string{"number": {"+1555"}, "fix": {"--fix"}},
+	}, {
+		name:   "option with separate value",
+		node:   node,
+		fields: []string{"--state", "closed", "+1555"},
+		want:   map[string][]string{"number": {"+1555"}, "state": {"closed"}},
+	}, {
+		name:   "option with equals and choice in upper case",
+		node:   node,
+		fields: []string{"+1555", "--state=ACTIVE"},
+		want:   map[string][]string{"number": {"+1555"}, "state": {"active"}},
+	}, {
+		name:   "options between rest words",
+		node:   node,
+		fields: []string{"+1555", "hello", "--page", "abc", "world"},
+		want:   map[string][]string{"number": {"+1555"}, "page": {"abc"}, "text": {"hello", "world"}},
+	}, {
+		name:   "option without value stays a word",
+		node:   node,
+		fields: []string{"+1555", "--page"},
+		want:   map[string][]string{"number": {"+1555"}, "text": {"--page"}},
+	}, {
+		name:   "unknown choice",
+		node:   node,
+		fields: []string{"+1555", "--state", "gone"},
+		err:    "Invalid state gone, use one of active, closed.",
+	}, {
+		name:   "validation fails",
+		node:   node,
+		fields: []string{"1555"},
+		err:    "Invalid number 1555: needs a leading +.",
+	}, {
+		name:   "missing required argument",
+		node:   node,
+		fields: []string{"--fix"},
+		err:    "Missing <number>.",
+	}, {
+		name:   "raw takes the text as is",
+		node:   raw,
+		raw:    `{"reply": "a  set  b"}`,
+		fields: []string{`{"reply":`, `"a`, `set`, `b"}`},
+		want:   map[string][]string{"json": {`{"reply": "a  set  b"}`}},
+	}, {
+		name:   "missing raw argument",
+		node:   raw,
+		raw:    "",
+		fields: nil,
+		err:    "Missing <json>.",
+	}, {
+		name:   "unexpected argument",
+		node:   &commandNode{Name: "list"},
+		fields: []string{"extra"},
+		err:    "Unexpected argument extra.",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := test.node.parse(test.raw, test.fields)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("parse error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.want) {
+				t.Fatalf("parse = %v, want %v", values, test.want)
+			}
+		})
+	}
+}
+
+func TestRawCommandArgument(t *testing.T) {
+	words := []string{"twilio", "flow", "set"}
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{{
+		name:    "plain",
+		command: `/twilio flow set {"name": "menu"}`,
+		want:    `{"name": "menu"}`,
+	}, {
+		name:    "value with the command word",
+		command: `/twilio flow set {"reply": "we set  it up"}`,
+		want:    `{"reply": "we set  it up"}`,
+	}, {
+		name:    "new line after the command",
+		command: "/twilio Flow SET\n{\n  \"name\": \"menu\"\n}",
+		want:    "{\n  \"name\": \"menu\"\n}",
+	}, {
+		name:    "nothing after the command",
+		command: "/twilio flow set ",
+		want:    "",
+	}, {
+		name:    "other command",
+		command: `/twilio flow list {"name": "menu"}`,
+		want:    "",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rawCommandArgument(test.command, words); got != test.want {
+				t.Fatalf("rawCommandArgument(%q) = %q, want %q", test.command, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtractCommandOptions(t *testing.T) {
+	words := []string{"twilio", "flow", "set"}
+	tests := []struct {
+		name     string
+		command  string
+		raw      string
+		selector string
+		refresh  bool
+	}{{
+		name:    "no options",
+		command: `/twilio flow set {"reply": "a  b"}`,
+		raw:     `{"reply": "a  b"}`,
+	}, {
+		name:     "account named like the command word",
+		command:  `/twilio --account set flow set {"name": "menu"}`,
+		raw:      `{"name": "menu"}`,
+		selector: "set",
+	}, {
+		name:     "account with equals and refresh",
+		command:  `/twilio --account=brand flow --refresh set {"name": "menu"}`,
+		raw:      `{"name": "menu"}`,
+		selector: "brand",
+		refresh:  true,
+	}, {
+		name:     "options after the JSON",
+		command:  "/twilio flow set {\n  \"reply\": \"a  b\"\n} --account brand-a --REFRESH",
+		raw:      "{\n  \"reply\": \"a  b\"\n}",
+		selector: "brand-a",
+		refresh:  true,
+	}, {
+		name:     "account with equals after the JSON",
+		command:  `/twilio flow set {"name": "menu"} --account=brand-a`,
+		raw:      `{"name": "menu"}`,
+		selector: "brand-a",
+	}, {
+		name:    "account without a value stays",
+		command: `/twilio flow set {"name": "menu"} --account`,
+		raw:     `{"name": "menu"} --account`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			command, selector, refresh := extractCommandOptions(test.command)
+			if selector != test.selector || refresh != test.refresh {
+				t.Fatalf("extractCommandOptions(%q) = %q, %v, want %q, %v", test.command, selector, refresh, test.selector, test.refresh)
+			}
+			if got := rawCommandArgument(command, words); got != test.raw {
+				t.Fatalf("rawCommandArgument(%q) = %q, want %q", command, got, test.raw)
+			}
+		})
+	}
+}
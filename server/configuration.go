@@ -1,20 +1,33 @@
 package main
 
 import (
+	"net/http"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
 type configuration struct {
-	TeamName        string
-	TwilioSid       string
-	TwilioToken     string
-	TeamId          string
-	InstallUserId   string
-	AutoAddUsers    string
-	AutoAddUsersIds *[]string
-	PhoneNumber     string
+	TeamName           string
+	TwilioSid          string
+	TwilioToken        string
+	TwilioApiKeySid    string
+	TwilioApiKeySecret string
+	TwilioAccounts     string
+	TwilioRegion       string
+	TwilioEdge         string
+	TwilioAPIBaseURL   string
+	TwilioMediaBaseURL string
+	HTTPTimeoutSeconds int
+	HTTPProxy          string
+	HTTPCABundle       string
+	TeamId             string
+	InstallUserId      string
+	AutoAddUsers       string
+	AutoAddUsersIds    *[]string
+	PhoneNumber        string
+	Accounts           []*twilioAccount
+	HTTPClient         *http.Client
 }
 
 func (p *TwilioPlugin) getConfiguration() *configuration {
@@ -62,10 +75,58 @@ func (p *TwilioPlugin) OnConfigurationChange() error {
 	}
 
 	if configuration.TwilioSid == "" || configuration.TwilioToken == "" {
-		return errors.New("Twilio SID and Token must be set")
+		return errors.New("Twilio SID and Token must be set, the Token is needed to validate webhooks even with an API Key")
+	}
+
+	accounts, aerr := parseTwilioAccounts(configuration)
+	if aerr != nil {
+		return aerr
+	}
+	configuration.Accounts = accounts
+
+	httpClient, herr := newTwilioHTTPClient(configuration)
+	if herr != nil {
+		return herr
+	}
+	configuration.HTTPClient = httpClient
+
+	// Only ask Twilio when something that affects the clients changed, this
+	// runs on every change of the server configuration too
+	if !twilioTransportEqual(p.getConfiguration(), configuration) || !twilioAccountsEqual(p.getConfiguration().Accounts, accounts) {
+		for _, account := range accounts {
+			ok, rerr := checkTwilioAccount(account, httpClient)
+			if rerr != nil {
+				// Could not reach Twilio, do not block the configuration on it
+				p.API.LogWarn("Could not check Twilio account", "account", account.Name, "error", rerr.Error())
+				continue
+			}
+			if !ok && account.Region != "" {
+				return errors.Errorf("Twilio account %s was not found in region %s", account.Name, account.Region)
+			}
+			if !ok {
+				return errors.Errorf("Twilio rejected the credentials of account %s", account.Name)
+			}
+		}
 	}
 
 	p.setConfiguration(configuration)
 
+	// Rebuild the clients so new credentials and the webhook URL apply
+	// without restarting the plugin
+	p.initializeTwilioClients()
+	if p.client != nil {
+		p.checkWebhookURL()
+	}
+
 	return nil
 }
+
+// twilioTransportEqual reports whether two configurations use the same HTTP
+// settings for Twilio.
+func twilioTransportEqual(a, b *configuration) bool {
+	return a.TwilioAPIBaseURL == b.TwilioAPIBaseURL &&
+		a.TwilioMediaBaseURL == b.TwilioMediaBaseURL &&
+		a.HTTPTimeoutSeconds == b.HTTPTimeoutSeconds &&
+		a.HTTPProxy == b.HTTPProxy &&
+		a.HTTPCABundle == b.HTTPCABundle
+}
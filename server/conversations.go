@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+const (
+	conversationPageSize    = 20
+	maxConversationPageSize = 100
+)
+
+// conversationFilter narrows down a conversation listing. Dates are given as
+// YYYY-MM-DD and filter on the creation date. Address is the customer side of
+// the conversation and ProxyAddress our number.
+type conversationFilter struct {
+	State        string
+	StartDate    string
+	EndDate      string
+	Address      string
+	ProxyAddress string
+}
+
+// conversationPage is one page of a conversation listing. Twilio lists
+// conversations in its own order, so only the conversations within a page are
+// sorted by last activity. NextPage is the cursor of the following page and
+// empty on the last one.
+type conversationPage struct {
+	Conversations []twiliov1.ConversationsV1Conversation
+	NextPage      string
+}
+
+// ListConversationsPage fetches a single page of conversations. The cursor is
+// taken from the NextPage of the page before, or empty for the first page.
+// Conversations of a customer address are listed through the participant
+// conversations of that address, and those on one of our numbers from the
+// number index. The other filters are then applied to the page after it is
+// fetched.
+func (tc *TwilioClient) ListConversationsPage(ctx context.Context, filter *conversationFilter, cursor string, pageSize int) (*conversationPage, error) {
+	pageToken, pageNumber, err := decodePageCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if pageSize <= 0 || pageSize > maxConversationPageSize {
+		pageSize = maxConversationPageSize
+	}
+	if filter.ProxyAddress != "" {
+		return tc.listNumberConversationsPage(ctx, filter, pageNumber, pageSize)
+	}
+	rc := tc.rest(ctx)
+
+	var conversations []twiliov1.ConversationsV1Conversation
+	var nextPageUrl *string
+	if filter.Address != "" {
+		params := &twiliov1.ListParticipantConversationParams{}
+		params.SetAddress(filter.Address)
+		params.SetPageSize(pageSize)
+		page, err := rc.ConversationsV1.PageParticipantConversation(params, pageToken, pageNumber)
+		if err != nil {
+			tc.p.API.LogError("Error looking up conversations by address", "address", filter.Address, "error", err.Error())
+			return nil, classifyTwilioError(err)
+		}
+		for _, record := range page.Conversations {
+			conversation := participantConversation(record)
+			if filter.matches(&conversation) {
+				conversations = append(conversations, conversation)
+			}
+		}
+		nextPageUrl = page.Meta.NextPageUrl
+	} else {
+		params := filter.listParams()
+		params.SetPageSize(pageSize)
+		page, err := rc.ConversationsV1.PageConversation(params, pageToken, pageNumber)
+		if err != nil {
+			tc.p.API.LogError("Error getting conversations", "error", err.Error())
+			return nil, classifyTwilioError(err)
+		}
+		conversations = page.Conversations
+		nextPageUrl = page.Meta.NextPageUrl
+	}
+
+	sortByLastActivity(conversations)
+	result := &conversationPage{Conversations: conversations}
+	if token, number, ok := nextPage(nextPageUrl); ok {
+		result.NextPage = encodePageCursor(token, number)
+	}
+	return result, nil
+}
+
+// listNumberConversationsPage pages through the number index of our number,
+// most recently active first. The fetched conversations refresh the activity
+// in the index. The page number of the cursor is the offset
+// into the index.
+func (tc *TwilioClient) listNumberConversationsPage(ctx context.Context, filter *conversationFilter, pageNumber string, pageSize int) (*conversationPage, error) {
+	offset := 0
+	if pageNumber != "" {
+		var err error
+		if offset, err = strconv.Atoi(pageNumber); err != nil || offset < 0 {
+			return nil, errors.New("invalid page cursor")
+		}
+	}
+	sids, err := tc.p.numberConversations(tc.account.AccountSid, filter.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	var page []string
+	for i := len(sids) - 1 - offset; i >= 0 && len(page) < pageSize; i-- {
+		page = append(page, sids[i])
+	}
+
+	results := fetchAll(ctx, page, func(ctx context.Context, sid string) (*twiliov1.ConversationsV1Conversation, error) {
+		return tc.lookups().GetConversation(ctx, sid)
+	})
+	var conversations []twiliov1.ConversationsV1Conversation
+	for i, result := range results {
+		if errors.Is(result.Err, errTwilioNotFound) {
+			tc.p.unindexConversationNumber(tc.account.AccountSid, filter.ProxyAddress, page[i])
+			continue
+		}
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		tc.p.touchConversationNumber(tc.account.AccountSid, filter.ProxyAddress, page[i], lastActivity(result.Value))
+		if filter.matches(result.Value) {
+			conversations = append(conversations, *result.Value)
+		}
+	}
+
+	sortByLastActivity(conversations)
+	result := &conversationPage{Conversations: conversations}
+	if next := offset + len(page); next < len(sids) {
+		result.NextPage = encodePageCursor("", strconv.Itoa(next))
+	}
+	return result, nil
+}
+
+// eachConversationPage calls fn with every page of conversations matching the
+// filter, so only one page is held in memory at a time.
+func (tc *TwilioClient) eachConversationPage(ctx context.Context, filter *conversationFilter, fn func([]twiliov1.ConversationsV1Conversation) error) error {
+	cursor := ""
+	for {
+		page, err := tc.ListConversationsPage(ctx, filter, cursor, maxConversationPageSize)
+		if err != nil {
+			return err
+		}
+		if err := fn(page.Conversations); err != nil {
+			return err
+		}
+		if page.NextPage == "" {
+			return nil
+		}
+		cursor = page.NextPage
+	}
+}
+
+func (f *conversationFilter) IsValid() error {
+	switch f.State {
+	case "", "active", "inactive", "closed":
+	default:
+		return errors.Errorf("unknown state %s, use active, inactive or closed", f.State)
+	}
+	for _, date := range []string{f.StartDate, f.EndDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return errors.Errorf("invalid date %s, use YYYY-MM-DD", date)
+		}
+	}
+	return nil
+}
+
+func (f *conversationFilter) listParams() *twiliov1.ListConversationParams {
+	params := &twiliov1.ListConversationParams{}
+	if f.State != "" {
+		params.SetState(f.State)
+	}
+	if f.StartDate != "" {
+		params.SetStartDate(f.StartDate + "T00:00:00Z")
+	}
+	if f.EndDate != "" {
+		params.SetEndDate(f.EndDate + "T23:59:59Z")
+	}
+	return params
+}
+
+// matches applies the filter to a conversation from the participant
+// conversations lookup or the number index, which can not filter by
+// themselves.
+func (f *conversationFilter) matches(conversation *twiliov1.ConversationsV1Conversation) bool {
+	if f.State != "" && (conversation.State == nil || !strings.EqualFold(*conversation.State, f.State)) {
+		return false
+	}
+	if conversation.DateCreated != nil {
+		created := conversation.DateCreated.UTC().Format("2006-01-02")
+		if f.StartDate != "" && created < f.StartDate {
+			return false
+		}
+		if f.EndDate != "" && created > f.EndDate {
+			return false
+		}
+	}
+	return true
+}
+
+// participantConversation converts a participant conversations record to the
+// conversation it is about.
+func participantConversation(record twiliov1.ConversationsV1ParticipantConversation) twiliov1.ConversationsV1Conversation {
+	return twiliov1.ConversationsV1Conversation{
+		AccountSid:     record.AccountSid,
+		ChatServiceSid: record.ChatServiceSid,
+		Sid:            record.ConversationSid,
+		FriendlyName:   record.ConversationFriendlyName,
+		UniqueName:     record.ConversationUniqueName,
+		Attributes:     record.ConversationAttributes,
+		State:          record.ConversationState,
+		DateCreated:    record.ConversationDateCreated,
+		DateUpdated:    record.ConversationDateUpdated,
+	}
+}
+
+// sortByLastActivity puts the most recently active conversations first.
+func sortByLastActivity(conversations []twiliov1.ConversationsV1Conversation) {
+	sort.SliceStable(conversations, func(i, j int) bool {
+		return lastActivity(&conversations[i]).After(lastActivity(&conversations[j]))
+	})
+}
+
+// lastActivity is when the conversation was last updated, or created when it
+// never was.
+func lastActivity(conversation *twiliov1.ConversationsV1Conversation) time.Time {
+	if conversation.DateUpdated != nil {
+		return *conversation.DateUpdated
+	}
+	if conversation.DateCreated != nil {
+		return *conversation.DateCreated
+	}
+	return time.Time{}
+}
+
+// nextPage returns the page token and number of the next page of a Twilio
+// list, which the Page functions take instead of the URL.
+func nextPage(nextPageUrl *string) (string, string, bool) {
+	if nextPageUrl == nil || *nextPageUrl == "" {
+		return "", "", false
+	}
+	parsed, err := url.Parse(*nextPageUrl)
+	if err != nil {
+		return "", "", false
+	}
+	query := parsed.Query()
+	return query.Get("PageToken"), query.Get("Page"), true
+}
+
+// encodePageCursor packs the page token and number into a cursor short enough
+// to pass around in a command.
+func encodePageCursor(pageToken, pageNumber string) string {
+	values := url.Values{}
+	values.Set("t", pageToken)
+	values.Set("p", pageNumber)
+	return base64.RawURLEncoding.EncodeToString([]byte(values.Encode()))
+}
+
+func decodePageCursor(cursor string) (string, string, error) {
+	if cursor == "" {
+		return "", "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", errors.New("invalid page cursor")
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return "", "", errors.New("invalid page cursor")
+	}
+	return values.Get("t"), values.Get("p"), nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	conversationSettingsPrefix  = "twilio-by-Co-"
+	channelSettingsPrefix       = "twilio-by-Ch-"
+	postSettingsPrefix          = "twilio-by-Po-"
+	conversationStoreVersionKey = "twilio-store-version"
+
+	// Layout of the stored mappings. Version 1 kept a full copy of the
+	// settings under every key, version 2 keeps them under the conversation
+	// key only, the channel and post keys point to it.
+	conversationStoreVersion = 2
+
+	// Attempts of an update racing with another one on the same conversation
+	conversationStoreRetries = 3
+)
+
+var errConversationConflict = errors.New("Conversation settings were changed at the same time")
+
+// ConversationStore keeps the mappings between Twilio conversations and the
+// channels or threads they are linked to. Lookups return nil when there is no
+// mapping.
+type ConversationStore interface {
+	Get(conversationSid string) (*conversationSettings, error)
+	GetByChannel(channelId string) (*conversationSettings, error)
+	GetByPost(postId string) (*conversationSettings, error)
+	// Save stores the settings and returns the ones they replaced, if any.
+	Save(settings *conversationSettings) (*conversationSettings, error)
+	// Delete removes the mapping and returns it, or nil when there was none.
+	Delete(conversationSid string) (*conversationSettings, error)
+	List() ([]*conversationSettings, error)
+	// Migrate brings the stored mappings to the current layout.
+	Migrate() error
+}
+
+// conversationRef is stored under the channel and post keys.
+type conversationRef struct {
+	ConversationSid string `json:"conversation_sid"`
+}
+
+// conversationIndexKey is the channel or post key the settings are found by.
+func conversationIndexKey(settings *conversationSettings) string {
+	if settings.Type == "post" && settings.RootPostId != "" {
+		return postSettingsPrefix + settings.RootPostId
+	}
+	if settings.ChannelId != "" {
+		return channelSettingsPrefix + settings.ChannelId
+	}
+	return ""
+}
+
+// kvConversationStore keeps the mappings in the plugin KV store. The settings
+// under the conversation key are the source of truth and are only changed
+// with compare-and-set. The channel and post keys are written before and
+// removed after them, and are only followed when the settings point back, so
+// an update failing halfway leaves no wrong mapping behind.
+type kvConversationStore struct {
+	api plugin.API
+}
+
+func newKVConversationStore(api plugin.API) *kvConversationStore {
+	return &kvConversationStore{api: api}
+}
+
+func (s *kvConversationStore) Get(conversationSid string) (*conversationSettings, error) {
+	settings, _, err := s.get(conversationSid)
+	return settings, err
+}
+
+func (s *kvConversationStore) get(conversationSid string) (*conversationSettings, []byte, error) {
+	data, appErr := s.api.KVGet(conversationSettingsPrefix + conversationSid)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "Could not get conversation settings")
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+	var settings conversationSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, nil, errors.Wrap(err, "Could not unmarshal conversation settings")
+	}
+	return &settings, data, nil
+}
+
+func (s *kvConversationStore) GetByChannel(channelId string) (*conversationSettings, error) {
+	return s.getByIndex(channelSettingsPrefix+channelId, func(settings *conversationSettings) bool {
+		return settings.Type != "post" && settings.ChannelId == channelId
+	})
+}
+
+func (s *kvConversationStore) GetByPost(postId string) (*conversationSettings, error) {
+	return s.getByIndex(postSettingsPrefix+postId, func(settings *conversationSettings) bool {
+		return settings.Type == "post" && settings.RootPostId == postId
+	})
+}
+
+func (s *kvConversationStore) getByIndex(key string, pointsBack func(*conversationSettings) bool) (*conversationSettings, error) {
+	ref, _, err := s.getRef(key)
+	if err != nil || ref == nil {
+		return nil, err
+	}
+	settings, _, err := s.get(ref.ConversationSid)
+	if err != nil || settings == nil || !pointsBack(settings) {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// getRef reads a channel or post key. Version 1 stored full settings there,
+// which carry the conversation SID as well.
+func (s *kvConversationStore) getRef(key string) (*conversationRef, []byte, error) {
+	data, appErr := s.api.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "Could not get conversation reference")
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+	var ref conversationRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return nil, nil, errors.Wrap(err, "Could not unmarshal conversation reference")
+	}
+	if ref.ConversationSid == "" {
+		return nil, nil, nil
+	}
+	return &ref, data, nil
+}
+
+func (s *kvConversationStore) setRef(key, conversationSid string) error {
+	data, err := json.Marshal(&conversationRef{ConversationSid: conversationSid})
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal conversation reference")
+	}
+	if appErr := s.api.KVSet(key, data); appErr != nil {
+		return errors.Wrap(appErr, "Could not save conversation reference")
+	}
+	return nil
+}
+
+// deleteRef removes a channel or post key unless it was taken over by
+// another conversation in the meantime.
+func (s *kvConversationStore) deleteRef(key, conversationSid string) {
+	ref, data, err := s.getRef(key)
+	if err != nil || ref == nil || ref.ConversationSid != conversationSid {
+		return
+	}
+	if _, appErr := s.api.KVCompareAndDelete(key, data); appErr != nil {
+		s.api.LogWarn("Could not delete conversation reference", "key", key, "error", appErr.Error())
+	}
+}
+
+func (s *kvConversationStore) Save(settings *conversationSettings) (*conversationSettings, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not marshal conversation settings")
+	}
+	key := conversationIndexKey(settings)
+	for attempt := 0; attempt < conversationStoreRetries; attempt++ {
+		previous, previousData, err := s.get(settings.ConversationSid)
+		if err != nil {
+			return nil, err
+		}
+		if key != "" {
+			if err := s.setRef(key, settings.ConversationSid); err != nil {
+				return nil, err
+			}
+		}
+		saved, appErr := s.api.KVCompareAndSet(conversationSettingsPrefix+settings.ConversationSid, previousData, data)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not save conversation settings")
+		}
+		if !saved {
+			continue
+		}
+		if previous != nil {
+			if previousKey := conversationIndexKey(previous); previousKey != "" && previousKey != key {
+				s.deleteRef(previousKey, settings.ConversationSid)
+			}
+		}
+		return previous, nil
+	}
+	return nil, errConversationConflict
+}
+
+func (s *kvConversationStore) Delete(conversationSid string) (*conversationSettings, error) {
+	for attempt := 0; attempt < conversationStoreRetries; attempt++ {
+		settings, data, err := s.get(conversationSid)
+		if err != nil || settings == nil {
+			return nil, err
+		}
+		deleted, appErr := s.api.KVCompareAndDelete(conversationSettingsPrefix+conversationSid, data)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not delete conversation settings")
+		}
+		if !deleted {
+			continue
+		}
+		if key := conversationIndexKey(settings); key != "" {
+			s.deleteRef(key, conversationSid)
+		}
+		return settings, nil
+	}
+	return nil, errConversationConflict
+}
+
+func (s *kvConversationStore) List() ([]*conversationSettings, error) {
+	keys, err := s.listKeys(conversationSettingsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []*conversationSettings
+	for _, key := range keys {
+		settings, err := s.Get(strings.TrimPrefix(key, conversationSettingsPrefix))
+		if err != nil {
+			s.api.LogWarn("Could not read conversation settings", "key", key, "error", err.Error())
+			continue
+		}
+		if settings != nil {
+			result = append(result, settings)
+		}
+	}
+	return result, nil
+}
+
+func (s *kvConversationStore) listKeys(prefixes ...string) ([]string, error) {
+	var result []string
+	for page := 0; ; page++ {
+		keys, appErr := s.api.KVList(page, 100)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not list conversation settings")
+		}
+		for _, key := range keys {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					result = append(result, key)
+					break
+				}
+			}
+		}
+		if len(keys) < 100 {
+			return result, nil
+		}
+	}
+}
+
+func (s *kvConversationStore) Migrate() error {
+	version := 1
+	data, appErr := s.api.KVGet(conversationStoreVersionKey)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Could not get conversation store version")
+	}
+	if data != nil {
+		parsed, err := strconv.Atoi(string(data))
+		if err != nil {
+			return errors.Wrap(err, "Could not parse conversation store version")
+		}
+		version = parsed
+	}
+	if version >= conversationStoreVersion {
+		return nil
+	}
+
+	if version < 2 {
+		if err := s.migrateRefs(); err != nil {
+			return err
+		}
+	}
+
+	if appErr := s.api.KVSet(conversationStoreVersionKey, []byte(strconv.Itoa(conversationStoreVersion))); appErr != nil {
+		return errors.Wrap(appErr, "Could not save conversation store version")
+	}
+	s.api.LogInfo("Migrated conversation settings", "from", version, "to", conversationStoreVersion)
+	return nil
+}
+
+// migrateRefs replaces the copies of the settings under the channel and post
+// keys by references. A copy whose conversation key went missing restores it.
+func (s *kvConversationStore) migrateRefs() error {
+	keys, err := s.listKeys(channelSettingsPrefix, postSettingsPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, appErr := s.api.KVGet(key)
+		if appErr != nil || data == nil {
+			continue
+		}
+		var copied conversationSettings
+		if err := json.Unmarshal(data, &copied); err != nil || copied.ConversationSid == "" {
+			s.api.LogWarn("Skipping unreadable conversation settings", "key", key)
+			continue
+		}
+		if copied.ChannelId != "" {
+			if _, appErr := s.api.KVCompareAndSet(conversationSettingsPrefix+copied.ConversationSid, nil, data); appErr != nil {
+				return errors.Wrap(appErr, "Could not restore conversation settings")
+			}
+		}
+		if err := s.setRef(key, copied.ConversationSid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryConversationStore keeps the mappings in memory, for tests and tools
+// that run without a server. Like the KV store it points the channel and post
+// keys to the conversation that saved them last.
+type memoryConversationStore struct {
+	lock          sync.Mutex
+	conversations map[string]conversationSettings
+	refs          map[string]string
+}
+
+func newMemoryConversationStore() *memoryConversationStore {
+	return &memoryConversationStore{
+		conversations: map[string]conversationSettings{},
+		refs:          map[string]string{},
+	}
+}
+
+func (s *memoryConversationStore) Get(conversationSid string) (*conversationSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if settings, ok := s.conversations[conversationSid]; ok {
+		return &settings, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryConversationStore) GetByChannel(channelId string) (*conversationSettings, error) {
+	return s.getByIndex(channelSettingsPrefix+channelId, func(settings *conversationSettings) bool {
+		return settings.Type != "post" && settings.ChannelId == channelId
+	}), nil
+}
+
+func (s *memoryConversationStore) GetByPost(postId string) (*conversationSettings, error) {
+	return s.getByIndex(postSettingsPrefix+postId, func(settings *conversationSettings) bool {
+		return settings.Type == "post" && settings.RootPostId == postId
+	}), nil
+}
+
+func (s *memoryConversationStore) getByIndex(key string, pointsBack func(*conversationSettings) bool) *conversationSettings {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	settings, ok := s.conversations[s.refs[key]]
+	if !ok || !pointsBack(&settings) {
+		return nil
+	}
+	return &settings
+}
+
+func (s *memoryConversationStore) Save(settings *conversationSettings) (*conversationSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := conversationIndexKey(settings)
+	if key != "" {
+		s.refs[key] = settings.ConversationSid
+	}
+	previous, ok := s.conversations[settings.ConversationSid]
+	s.conversations[settings.ConversationSid] = *settings
+	if !ok {
+		return nil, nil
+	}
+	if previousKey := conversationIndexKey(&previous); previousKey != "" && previousKey != key {
+		s.deleteRef(previousKey, settings.ConversationSid)
+	}
+	return &previous, nil
+}
+
+// deleteRef removes a channel or post key unless it was taken over by
+// another conversation.
+func (s *memoryConversationStore) deleteRef(key, conversationSid string) {
+	if s.refs[key] == conversationSid {
+		delete(s.refs, key)
+	}
+}
+
+func (s *memoryConversationStore) Delete(conversationSid string) (*conversationSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	settings, ok := s.conversations[conversationSid]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.conversations, conversationSid)
+	if key := conversationIndexKey(&settings); key != "" {
+		s.deleteRef(key, conversationSid)
+	}
+	return &settings, nil
+}
+
+func (s *memoryConversationStore) List() ([]*conversationSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make([]*conversationSettings, 0, len(s.conversations))
+	for _, settings := range s.conversations {
+		settings := settings
+		result = append(result, &settings)
+	}
+	return result, nil
+}
+
+func (s *memoryConversationStore) Migrate() error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func conversationStores() map[string]func() ConversationStore {
+	return map[string]func() ConversationStore{
+		"kv":     func() ConversationStore { return newKVConversationStore(newTestKVAPI()) },
+		"memory": func() ConversationStore { return newMemoryConversationStore() },
+	}
+}
+
+func channelSettings(conversationSid, channelId string) *conversationSettings {
+	return &conversationSettings{ConversationSid: conversationSid, TeamId: "team", ChannelId: channelId, Type: "channel"}
+}
+
+func threadSettings(conversationSid, channelId, rootPostId string) *conversationSettings {
+	return &conversationSettings{ConversationSid: conversationSid, TeamId: "team", ChannelId: channelId, Type: "post", RootPostId: rootPostId}
+}
+
+func mustSave(t *testing.T, store ConversationStore, settings *conversationSettings) *conversationSettings {
+	t.Helper()
+	previous, err := store.Save(settings)
+	if err != nil {
+		t.Fatalf("Save(%s) failed: %v", settings.ConversationSid, err)
+	}
+	return previous
+}
+
+func assertConversation(t *testing.T, what string, settings *conversationSettings, err error, conversationSid string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s failed: %v", what, err)
+	}
+	switch {
+	case conversationSid == "" && settings != nil:
+		t.Fatalf("%s = %s, want none", what, settings.ConversationSid)
+	case conversationSid != "" && settings == nil:
+		t.Fatalf("%s = none, want %s", what, conversationSid)
+	case conversationSid != "" && settings.ConversationSid != conversationSid:
+		t.Fatalf("%s = %s, want %s", what, settings.ConversationSid, conversationSid)
+	}
+}
+
+func TestConversationStore(t *testing.T) {
+	for name, newStore := range conversationStores() {
+		t.Run(name, func(t *testing.T) {
+			t.Run("save returns the replaced settings", func(t *testing.T) {
+				store := newStore()
+				if previous := mustSave(t, store, channelSettings("CH1", "channel1")); previous != nil {
+					t.Fatalf("first Save replaced %+v", previous)
+				}
+				previous := mustSave(t, store, channelSettings("CH1", "channel2"))
+				if previous == nil || previous.ChannelId != "channel1" {
+					t.Fatalf("second Save replaced %+v, want channel1", previous)
+				}
+				settings, err := store.Get("CH1")
+				assertConversation(t, "Get", settings, err, "CH1")
+				if settings.ChannelId != "channel2" {
+					t.Fatalf("Get channel = %s, want channel2", settings.ChannelId)
+				}
+			})
+
+			t.Run("moving the link updates the channel and post keys", func(t *testing.T) {
+				store := newStore()
+				mustSave(t, store, channelSettings("CH1", "channel1"))
+				settings, err := store.GetByChannel("channel1")
+				assertConversation(t, "GetByChannel", settings, err, "CH1")
+
+				mustSave(t, store, threadSettings("CH1", "channel1", "post1"))
+				settings, err = store.GetByChannel("channel1")
+				assertConversation(t, "GetByChannel after the move", settings, err, "")
+				settings, err = store.GetByPost("post1")
+				assertConversation(t, "GetByPost", settings, err, "CH1")
+
+				mustSave(t, store, channelSettings("CH1", "channel2"))
+				settings, err = store.GetByPost("post1")
+				assertConversation(t, "GetByPost after the move", settings, err, "")
+				settings, err = store.GetByChannel("channel2")
+				assertConversation(t, "GetByChannel", settings, err, "CH1")
+			})
+
+			t.Run("a channel taken over stays with the new conversation", func(t *testing.T) {
+				store := newStore()
+				mustSave(t, store, channelSettings("CH1", "channel1"))
+				mustSave(t, store, channelSettings("CH2", "channel1"))
+				settings, err := store.GetByChannel("channel1")
+				assertConversation(t, "GetByChannel", settings, err, "CH2")
+
+				if _, err := store.Delete("CH1"); err != nil {
+					t.Fatalf("Delete failed: %v", err)
+				}
+				settings, err = store.GetByChannel("channel1")
+				assertConversation(t, "GetByChannel after deleting the old conversation", settings, err, "CH2")
+			})
+
+			t.Run("delete removes the mapping", func(t *testing.T) {
+				store := newStore()
+				mustSave(t, store, threadSettings("CH1", "channel1", "post1"))
+				deleted, err := store.Delete("CH1")
+				assertConversation(t, "Delete", deleted, err, "CH1")
+				deleted, err = store.Delete("CH1")
+				assertConversation(t, "second Delete", deleted, err, "")
+				settings, err := store.GetByPost("post1")
+				assertConversation(t, "GetByPost", settings, err, "")
+				settings, err = store.Get("CH1")
+				assertConversation(t, "Get", settings, err, "")
+			})
+
+			t.Run("list returns every conversation", func(t *testing.T) {
+				store := newStore()
+				mustSave(t, store, channelSettings("CH1", "channel1"))
+				mustSave(t, store, threadSettings("CH2", "channel1", "post1"))
+				list, err := store.List()
+				if err != nil {
+					t.Fatalf("List failed: %v", err)
+				}
+				var sids []string
+				for _, settings := range list {
+					sids = append(sids, settings.ConversationSid)
+				}
+				sort.Strings(sids)
+				if len(sids) != 2 || sids[0] != "CH1" || sids[1] != "CH2" {
+					t.Fatalf("List = %v, want [CH1 CH2]", sids)
+				}
+			})
+		})
+	}
+}
+
+func TestKVConversationStoreConflict(t *testing.T) {
+	t.Run("retries after a concurrent write", func(t *testing.T) {
+		api := newTestKVAPI()
+		store := newKVConversationStore(api)
+		mustSave(t, store, channelSettings("CH1", "channel1"))
+
+		concurrent, _ := json.Marshal(channelSettings("CH1", "channel2"))
+		api.beforeCompare = func(key string) {
+			if key == conversationSettingsPrefix+"CH1" {
+				api.beforeCompare = nil
+				api.KVSet(key, concurrent)
+			}
+		}
+		previous := mustSave(t, store, channelSettings("CH1", "channel3"))
+		if previous == nil || previous.ChannelId != "channel2" {
+			t.Fatalf("Save replaced %+v, want the concurrent channel2", previous)
+		}
+		settings, err := store.GetByChannel("channel3")
+		assertConversation(t, "GetByChannel", settings, err, "CH1")
+		settings, err = store.GetByChannel("channel2")
+		assertConversation(t, "GetByChannel of the replaced channel", settings, err, "")
+	})
+
+	t.Run("gives up when every attempt conflicts", func(t *testing.T) {
+		api := newTestKVAPI()
+		store := newKVConversationStore(api)
+		mustSave(t, store, channelSettings("CH1", "channel1"))
+
+		attempt := 0
+		api.beforeCompare = func(key string) {
+			attempt++
+			data, _ := json.Marshal(&conversationSettings{ConversationSid: "CH1", ChannelId: "channel1", RootPostId: string(rune('a' + attempt))})
+			api.KVSet(key, data)
+		}
+		if _, err := store.Save(channelSettings("CH1", "channel2")); !errors.Is(err, errConversationConflict) {
+			t.Fatalf("Save error = %v, want a conflict", err)
+		}
+		if attempt != conversationStoreRetries {
+			t.Fatalf("Save tried %d times, want %d", attempt, conversationStoreRetries)
+		}
+		if _, err := store.Delete("CH1"); !errors.Is(err, errConversationConflict) {
+			t.Fatalf("Delete error = %v, want a conflict", err)
+		}
+	})
+}
+
+func TestKVConversationStoreMigrate(t *testing.T) {
+	api := newTestKVAPI()
+	store := newKVConversationStore(api)
+
+	// Version 1 kept a full copy of the settings under every key
+	channel, _ := json.Marshal(channelSettings("CH1", "channel1"))
+	thread, _ := json.Marshal(threadSettings("CH2", "channel1", "post1"))
+	api.KVSet(conversationSettingsPrefix+"CH1", channel)
+	api.KVSet(channelSettingsPrefix+"channel1", channel)
+	api.KVSet(postSettingsPrefix+"post1", thread)
+
+	if err := store.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if version, _ := api.KVGet(conversationStoreVersionKey); string(version) != "2" {
+		t.Fatalf("store version = %q, want 2", version)
+	}
+	for key, sid := range map[string]string{channelSettingsPrefix + "channel1": "CH1", postSettingsPrefix + "post1": "CH2"} {
+		data, _ := api.KVGet(key)
+		var ref map[string]interface{}
+		if err := json.Unmarshal(data, &ref); err != nil {
+			t.Fatalf("%s is not JSON: %v", key, err)
+		}
+		if len(ref) != 1 || ref["conversation_sid"] != sid {
+			t.Fatalf("%s = %s, want a reference to %s", key, data, sid)
+		}
+	}
+
+	// The conversation key missing from the thread copy is restored
+	settings, err := store.Get("CH2")
+	assertConversation(t, "Get", settings, err, "CH2")
+	settings, err = store.GetByPost("post1")
+	assertConversation(t, "GetByPost", settings, err, "CH2")
+	settings, err = store.GetByChannel("channel1")
+	assertConversation(t, "GetByChannel", settings, err, "CH1")
+
+	// Running it again leaves the references alone
+	before, _ := api.KVGet(channelSettingsPrefix + "channel1")
+	if err := store.Migrate(); err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+	if after, _ := api.KVGet(channelSettingsPrefix + "channel1"); string(after) != string(before) {
+		t.Fatalf("second Migrate changed the reference to %s", after)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	dialogConnect      = "connect"
+	dialogConversation = "conversation"
+	dialogNumber       = "number"
+
+	// Submissions of the dialogs, and the buttons opening them
+	dialogPath          = "/dialog/submit/{dialog}"
+	dialogURL           = "/plugins/sx.paul.mattermost.twilio/dialog/submit/"
+	dialogOpenPath      = "/dialog/open"
+	dialogOpenActionURL = "/plugins/sx.paul.mattermost.twilio" + dialogOpenPath
+
+	// How the channel of a new conversation is chosen
+	dialogLinkChannel = "channel"
+	dialogLinkRoute   = "route"
+)
+
+// dialogState travels with a dialog from opening to submission.
+type dialogState struct {
+	AccountSid string `json:"account_sid,omitempty"`
+}
+
+// openDialog opens one of the dialogs for the user, filled with the numbers
+// and conversations of the account.
+func (p *TwilioPlugin) openDialog(ctx context.Context, triggerId, userId, channelId, kind string, account *twilioAccount) error {
+	twilioClient := p.commandTwilioClient(account, nil)
+	state, _ := json.Marshal(&dialogState{AccountSid: twilioClient.Account().AccountSid})
+
+	var dialog *model.Dialog
+	var err error
+	switch kind {
+	case dialogConnect:
+		dialog, err = p.connectDialog(ctx, twilioClient, channelId)
+	case dialogConversation:
+		dialog, err = p.conversationDialog(ctx, twilioClient, channelId)
+	case dialogNumber:
+		dialog, err = p.numberDialog(ctx, twilioClient, userId)
+	default:
+		return errors.Errorf("Unknown dialog %s", kind)
+	}
+	if err != nil {
+		return err
+	}
+	dialog.CallbackId = kind
+	dialog.State = string(state)
+
+	if appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: triggerId,
+		URL:       dialogURL + kind,
+		Dialog:    *dialog,
+	}); appErr != nil {
+		return errors.Wrap(appErr, "Could not open dialog")
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) connectDialog(ctx context.Context, twilioClient ITwilioClient, channelId string) (*model.Dialog, error) {
+	existing, err := p.store.GetByChannel(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.Errorf("This channel is already linked to Twilio conversation %s. Please disconnect first before connecting to a new conversation.", existing.ConversationSid)
+	}
+	suggestions, err := p.conversationSuggestions(ctx, twilioClient)
+	if err != nil {
+		return nil, err
+	}
+	var options []*model.PostActionOptions
+	for _, item := range p.withoutLinked(suggestions) {
+		text := item.Item
+		if item.Hint != "" {
+			text = item.Hint
+		}
+		if item.HelpText != "" {
+			text += " (" + item.HelpText + ")"
+		}
+		options = append(options, &model.PostActionOptions{Text: text, Value: item.Item})
+	}
+	return &model.Dialog{
+		Title:            "Connect channel",
+		IntroductionText: "Link this channel to a Twilio conversation. Pick one of the recently active conversations or enter another one.",
+		SubmitLabel:      "Connect",
+		Elements: []model.DialogElement{{
+			DisplayName: "Conversation",
+			Name:        "conversation",
+			Type:        "select",
+			Options:     options,
+			Optional:    true,
+			HelpText:    "Recent conversations that are not linked to a channel yet.",
+		}, {
+			DisplayName: "Other conversation",
+			Name:        "other",
+			Type:        "text",
+			Optional:    true,
+			Placeholder: "SID, phone number or name",
+			HelpText:    "Used instead of the selection when given.",
+		}},
+	}, nil
+}
+
+func (p *TwilioPlugin) conversationDialog(ctx context.Context, twilioClient ITwilioClient, channelId string) (*model.Dialog, error) {
+	numbers, err := p.numberSuggestions(ctx, twilioClient)
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) == 0 {
+		return nil, errors.New("No phone numbers found.")
+	}
+	var numberOptions []*model.PostActionOptions
+	for _, item := range numbers {
+		numberOptions = append(numberOptions, &model.PostActionOptions{Text: item.Item, Value: item.Item})
+	}
+	linkOptions := []*model.PostActionOptions{
+		{Text: "A new channel, routed like incoming conversations", Value: dialogLinkRoute},
+	}
+	if existing, err := p.store.GetByChannel(channelId); err == nil && existing == nil {
+		linkOptions = append(linkOptions, &model.PostActionOptions{Text: "This channel", Value: dialogLinkChannel})
+	}
+	return &model.Dialog{
+		Title:            "New conversation",
+		IntroductionText: "Start a Twilio conversation with a phone number. The first message is posted in the linked channel and sent from there.",
+		SubmitLabel:      "Start",
+		Elements: []model.DialogElement{{
+			DisplayName: "Phone number",
+			Name:        "phone",
+			Type:        "text",
+			SubType:     "tel",
+			Placeholder: "+1XXXXXXXXXX",
+		}, {
+			DisplayName: "From",
+			Name:        "from",
+			Type:        "select",
+			Options:     numberOptions,
+			Default:     numberOptions[0].Value,
+		}, {
+			DisplayName: "First message",
+			Name:        "message",
+			Type:        "textarea",
+			MaxLength:   1600,
+		}, {
+			DisplayName: "Channel",
+			Name:        "link",
+			Type:        "select",
+			Options:     linkOptions,
+			Default:     dialogLinkRoute,
+		}},
+	}, nil
+}
+
+func (p *TwilioPlugin) numberDialog(ctx context.Context, twilioClient ITwilioClient, userId string) (*model.Dialog, error) {
+	numbers, err := p.numberSuggestions(ctx, twilioClient)
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) == 0 {
+		return nil, errors.New("No phone numbers found.")
+	}
+	var numberOptions []*model.PostActionOptions
+	for _, item := range numbers {
+		numberOptions = append(numberOptions, &model.PostActionOptions{Text: item.Item, Value: item.Item})
+	}
+	dialog := &model.Dialog{
+		Title:            "Set up number",
+		IntroductionText: "Send the conversations on a number to Mattermost. Twilio will post these events to the plugin: " + strings.Join(webhookFilters, ", ") + ".",
+		SubmitLabel:      "Set up",
+		Elements: []model.DialogElement{{
+			DisplayName: "Phone number",
+			Name:        "number",
+			Type:        "select",
+			Options:     numberOptions,
+		}},
+	}
+
+	// Routing numbers to teams is up to system admins
+	if !p.API.HasPermissionTo(userId, model.PermissionManageSystem) {
+		return dialog, nil
+	}
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Could not list teams")
+	}
+	var teamOptions []*model.PostActionOptions
+	for _, team := range teams {
+		teamOptions = append(teamOptions, &model.PostActionOptions{Text: team.DisplayName, Value: team.Name})
+	}
+	dialog.Elements = append(dialog.Elements, model.DialogElement{
+		DisplayName: "Team",
+		Name:        "team",
+		Type:        "select",
+		Options:     teamOptions,
+		Optional:    true,
+		HelpText:    "Sends new conversations on the number to the team instead of the default one.",
+	}, model.DialogElement{
+		DisplayName: "Users",
+		Name:        "users",
+		Type:        "text",
+		Optional:    true,
+		Placeholder: "@alice, @bob",
+		HelpText:    "Added to the channels of new conversations on the number.",
+	})
+	return dialog, nil
+}
+
+// handleDialogOpen opens a dialog when a button offering it is pressed.
+func (p *TwilioPlugin) handleDialogOpen(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var request model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || userId == "" || request.UserId != userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	kind, _ := request.Context["dialog"].(string)
+	accountSid, _ := request.Context["account"].(string)
+	var account *twilioAccount
+	if accountSid != "" {
+		if account = p.findTwilioAccount(accountSid); account == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if _, _, err := p.actionChannel(userId, request.ChannelId, request.TeamId); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+	defer cancel()
+	response := &model.PostActionIntegrationResponse{}
+	if err := p.openDialog(ctx, request.TriggerId, userId, request.ChannelId, kind, account); err != nil {
+		response.EphemeralText = "Could not open dialog: " + twilioErrorText(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// dialogAction is a button opening one of the dialogs.
+func dialogAction(kind, name string, account *twilioAccount) *model.PostAction {
+	actionContext := map[string]interface{}{"dialog": kind}
+	if account != nil {
+		actionContext["account"] = account.AccountSid
+	}
+	return &model.PostAction{
+		Id:   "dialog" + kind,
+		Name: name,
+		Type: model.PostActionTypeButton,
+		Integration: &model.PostActionIntegration{
+			URL:     dialogOpenActionURL,
+			Context: actionContext,
+		},
+	}
+}
+
+// handleDialogSubmit handles the submission of a dialog. Invalid input is
+// reported next to the field, so the user can correct it. The channel, team
+// and account come from the request body, so they are checked the way
+// Mattermost checks them for slash commands.
+func (p *TwilioPlugin) handleDialogSubmit(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var request model.SubmitDialogRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || userId == "" || request.UserId != userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.Cancelled {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var state dialogState
+	if request.State != "" {
+		if err := json.Unmarshal([]byte(request.State), &state); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if state.AccountSid != "" && !p.hasTwilioAccount(state.AccountSid) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	channel, teamId, err := p.actionChannel(userId, request.ChannelId, request.TeamId)
+	if err != nil {
+		p.API.LogDebug("Rejected dialog submission", "user_id", userId, "channel_id", request.ChannelId, "error", err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	request.ChannelId = channel.Id
+	request.TeamId = teamId
+	twilioClient := p.getTwilioClient(state.AccountSid)
+
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+	defer cancel()
+	var response *model.SubmitDialogResponse
+	switch mux.Vars(r)["dialog"] {
+	case dialogConnect:
+		response = p.submitConnectDialog(ctx, twilioClient, &request)
+	case dialogConversation:
+		response = p.submitConversationDialog(ctx, twilioClient, &request)
+	case dialogNumber:
+		response = p.submitNumberDialog(ctx, twilioClient, &request)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (p *TwilioPlugin) submitConnectDialog(ctx context.Context, twilioClient ITwilioClient, request *model.SubmitDialogRequest) *model.SubmitDialogResponse {
+	conversationSid, _ := request.Submission["conversation"].(string)
+	other, _ := request.Submission["other"].(string)
+	if other = strings.TrimSpace(other); other != "" {
+		conversations, complete, err := p.resolveConversation(ctx, twilioClient, request.UserId, request.TeamId, strings.Fields(other))
+		switch {
+		case err != nil:
+			return dialogFieldError("other", "Could not find the conversation: "+twilioErrorText(err))
+		case len(conversations) == 0 && !complete:
+			return dialogFieldError("other", fmt.Sprintf("No conversation matches among the first %d of the account, use its SID.", maxNamedConversationPages*maxConversationPageSize))
+		case len(conversations) == 0:
+			return dialogFieldError("other", "No conversation matches.")
+		case len(conversations) > 1:
+			return dialogFieldError("other", fmt.Sprintf("%d conversations match, use the SID of one of them.", len(conversations)))
+		}
+		conversationSid = *conversations[0].Sid
+	}
+	if conversationSid == "" {
+		return dialogFieldError("conversation", "Pick a conversation or enter another one.")
+	}
+
+	existing, err := p.store.GetByChannel(request.ChannelId)
+	if err != nil {
+		return &model.SubmitDialogResponse{Error: "Could not read conversation settings."}
+	}
+	if existing != nil {
+		return &model.SubmitDialogResponse{Error: fmt.Sprintf("This channel is already linked to Twilio conversation %s.", existing.ConversationSid)}
+	}
+	conv, err := twilioClient.GetConversation(ctx, conversationSid)
+	if err != nil {
+		return &model.SubmitDialogResponse{Error: fmt.Sprintf("Could not find Twilio conversation with SID %s: %s", conversationSid, twilioErrorText(err))}
+	}
+	if err := p.saveConversationSettings(&conversationSettings{
+		ConversationSid: conversationSid,
+		TeamId:          request.TeamId,
+		ChannelId:       request.ChannelId,
+		ChatServiceSid:  conv.ChatServiceSid,
+		AccountSid:      twilioClient.Account().AccountSid,
+	}); err != nil {
+		return &model.SubmitDialogResponse{Error: "Could not save conversation settings."}
+	}
+	p.sendDialogResult(request, fmt.Sprintf("This channel is now linked to Twilio conversation %s.", conversationSid))
+	return &model.SubmitDialogResponse{}
+}
+
+func (p *TwilioPlugin) submitConversationDialog(ctx context.Context, twilioClient ITwilioClient, request *model.SubmitDialogRequest) *model.SubmitDialogResponse {
+	phone, _ := request.Submission["phone"].(string)
+	from, _ := request.Submission["from"].(string)
+	message, _ := request.Submission["message"].(string)
+	link, _ := request.Submission["link"].(string)
+	phone = strings.Join(strings.Fields(phone), "")
+	if !strings.HasPrefix(phone, "+") || len(phone) < 8 {
+		return dialogFieldError("phone", "Enter the number in international format, like +1XXXXXXXXXX.")
+	}
+	if strings.TrimSpace(message) == "" {
+		return dialogFieldError("message", "Enter the first message.")
+	}
+	if link == dialogLinkChannel {
+		if existing, err := p.store.GetByChannel(request.ChannelId); err != nil || existing != nil {
+			return dialogFieldError("link", "This channel is already linked to a conversation.")
+		}
+	} else {
+		// The route may pick a team the user is not in, check it before
+		// anything is started in Twilio
+		route, err := p.resolveRoute(phone, from, "", message)
+		if err != nil {
+			return &model.SubmitDialogResponse{Error: "Could not resolve where the conversation goes: " + err.Error()}
+		}
+		if !p.API.HasPermissionToTeam(request.UserId, route.TeamId, model.PermissionViewTeam) {
+			return dialogFieldError("link", "New conversations from this number go to a team you are not a member of, link it to this channel instead.")
+		}
+	}
+
+	conversationSid, err := twilioClient.CreateConversation(ctx, phone, from)
+	if err != nil && conversationSid == "" {
+		return &model.SubmitDialogResponse{Error: "Could not start the conversation: " + twilioErrorText(err)}
+	}
+	if err != nil {
+		p.API.LogWarn("Could not add webhook to new conversation", "sid", conversationSid, "error", err.Error())
+	}
+
+	var settings *conversationSettings
+	if link == dialogLinkChannel {
+		conv, err := twilioClient.GetConversation(ctx, conversationSid)
+		if err != nil {
+			return &model.SubmitDialogResponse{Error: fmt.Sprintf("Started conversation %s but could not get its details: %s", conversationSid, twilioErrorText(err))}
+		}
+		settings = &conversationSettings{
+			ConversationSid: conversationSid,
+			TeamId:          request.TeamId,
+			ChannelId:       request.ChannelId,
+			ChatServiceSid:  conv.ChatServiceSid,
+			AccountSid:      twilioClient.Account().AccountSid,
+		}
+		if err := p.saveConversationSettings(settings); err != nil {
+			return &model.SubmitDialogResponse{Error: fmt.Sprintf("Started conversation %s but could not link it to this channel.", conversationSid)}
+		}
+	} else {
+		settings, err = p.getOrCreateConversationSettings(ctx, twilioClient.Account().AccountSid, conversationSid, phone, message)
+		if err != nil {
+			return &model.SubmitDialogResponse{Error: fmt.Sprintf("Started conversation %s but could not create its channel: %s", conversationSid, twilioErrorText(err))}
+		}
+		// The conversation settings may have come from elsewhere, like the
+		// attributes of the conversation
+		if !p.API.HasPermissionToTeam(request.UserId, settings.TeamId, model.PermissionViewTeam) {
+			return &model.SubmitDialogResponse{Error: fmt.Sprintf("Started conversation %s, but its channel is in a team you are not a member of, so the first message was not sent.", conversationSid)}
+		}
+		if _, appErr := p.API.AddUserToChannel(settings.ChannelId, request.UserId, request.UserId); appErr != nil {
+			p.API.LogWarn("Could not add user to channel", "user_id", request.UserId, "channel_id", settings.ChannelId, "error", appErr.Error())
+		}
+	}
+
+	// Posting the message in the linked channel sends it to the conversation
+	post := &model.Post{
+		UserId:    request.UserId,
+		ChannelId: settings.ChannelId,
+		Message:   message,
+	}
+	if settings.Type == "post" {
+		post.RootId = settings.RootPostId
+	}
+	if _, appErr := p.API.CreatePost(post); appErr != nil {
+		return &model.SubmitDialogResponse{Error: fmt.Sprintf("Started conversation %s but could not send the first message.", conversationSid)}
+	}
+	p.sendDialogResult(request, fmt.Sprintf("Started Twilio conversation %s with %s, %s.", conversationSid, phone, p.conversationLinkText(conversationSid)))
+	return &model.SubmitDialogResponse{}
+}
+
+func (p *TwilioPlugin) submitNumberDialog(ctx context.Context, twilioClient ITwilioClient, request *model.SubmitDialogRequest) *model.SubmitDialogResponse {
+	phoneNumber, _ := request.Submission["number"].(string)
+	teamName, _ := request.Submission["team"].(string)
+	usernames, _ := request.Submission["users"].(string)
+	if phoneNumber == "" {
+		return dialogFieldError("number", "Pick a phone number.")
+	}
+	// The submission is not limited to the options of the dialog
+	numbers, err := twilioClient.AccountNumbersStrings(ctx)
+	if err != nil {
+		return &model.SubmitDialogResponse{Error: "Could not find phone numbers: " + twilioErrorText(err)}
+	}
+	if !slices.Contains(numbers, phoneNumber) {
+		return dialogFieldError("number", fmt.Sprintf("Phone number %s is not associated with your Twilio account.", phoneNumber))
+	}
+
+	var assignment *numberAssignment
+	if teamName != "" || strings.TrimSpace(usernames) != "" {
+		if !p.API.HasPermissionTo(request.UserId, model.PermissionManageSystem) {
+			return &model.SubmitDialogResponse{Error: "Only system administrators can assign numbers to teams."}
+		}
+		if teamName == "" {
+			return dialogFieldError("team", "Pick the team the users work in.")
+		}
+		team, appErr := p.API.GetTeamByName(teamName)
+		if appErr != nil {
+			return dialogFieldError("team", fmt.Sprintf("Could not find team %s.", teamName))
+		}
+		userIds, unknown := p.lookupUserIds(usernames)
+		if unknown != "" {
+			return dialogFieldError("users", fmt.Sprintf("Could not find user %s.", unknown))
+		}
+		assignment = &numberAssignment{Number: phoneNumber, TeamId: team.Id, UserIds: userIds}
+	}
+
+	// Save the assignment first, so conversations the setup brings in already
+	// go to the team
+	text := fmt.Sprintf("Setting up webhook for phone number %s. This may take a few seconds.", phoneNumber)
+	if assignment != nil {
+		if err := p.assignNumber(assignment); err != nil {
+			return &model.SubmitDialogResponse{Error: "Could not save number assignment."}
+		}
+		text += fmt.Sprintf(" New conversations on it will go to team %s.", teamName)
+	}
+	if err := p.startJob(&backgroundJob{
+		Kind:        jobSetupNumber,
+		AccountSid:  twilioClient.Account().AccountSid,
+		PhoneNumber: phoneNumber,
+		UserId:      request.UserId,
+		ChannelId:   request.ChannelId,
+	}); err != nil {
+		return &model.SubmitDialogResponse{Error: fmt.Sprintf("Could not set up phone number %s: %s", phoneNumber, err.Error())}
+	}
+	p.sendDialogResult(request, text)
+	return &model.SubmitDialogResponse{}
+}
+
+func dialogFieldError(field, text string) *model.SubmitDialogResponse {
+	return &model.SubmitDialogResponse{Errors: map[string]string{field: text}}
+}
+
+// sendDialogResult tells the user what the submitted dialog did.
+func (p *TwilioPlugin) sendDialogResult(request *model.SubmitDialogRequest, text string) {
+	bot, err := p.getBot()
+	if err != nil {
+		p.API.LogError("Could not get bot", "error", err.Error())
+		return
+	}
+	p.API.SendEphemeralPost(request.UserId, &model.Post{
+		UserId:    bot.UserId,
+		ChannelId: request.ChannelId,
+		Message:   text,
+	})
+}
+
+// commandDialog opens a dialog for a command run without its arguments.
+// Commands run without a client that can show dialogs get the usage.
+func (p *TwilioPlugin) commandDialog(ctx context.Context, args *model.CommandArgs, kind string, account *twilioAccount, usage string) *model.CommandResponse {
+	if args.TriggerId == "" {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         usage,
+		}
+	}
+	if err := p.openDialog(ctx, args.TriggerId, args.UserId, args.ChannelId, kind, account); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not open dialog: " + twilioErrorText(err),
+		}
+	}
+	return &model.CommandResponse{}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+// mappingIssue is an inconsistency found by the mappings check. Issues that
+// can be repaired carry the fix.
+type mappingIssue struct {
+	Text string
+	fix  func(ctx context.Context) error
+}
+
+// doctorMappingsAsync checks the conversation mappings against the channels
+// and Twilio, repairs what it can when asked to, and reports the result to
+// the user that ran the command.
+func (p *TwilioPlugin) doctorMappingsAsync(ctx context.Context, clients []ITwilioClient, fix bool, args *model.CommandArgs) {
+	issues := p.checkMappings(ctx, clients)
+	if ctx.Err() != nil {
+		return
+	}
+
+	var message string
+	if len(issues) == 0 {
+		message = "No mapping issues found."
+	} else {
+		message = fmt.Sprintf("Found %d mapping issues:\n", len(issues))
+		fixable := 0
+		for _, issue := range issues {
+			message += "- " + issue.Text
+			switch {
+			case issue.fix == nil:
+				message += " (no automatic fix)"
+			case !fix:
+				fixable++
+			default:
+				if err := issue.fix(ctx); err != nil {
+					message += " (could not fix: " + twilioErrorText(err) + ")"
+				} else {
+					message += " (fixed)"
+				}
+			}
+			message += "\n"
+		}
+		if fixable > 0 {
+			message += fmt.Sprintf("Run `/twilio doctor mappings --fix` to repair the %d issues that can be fixed.", fixable)
+		}
+	}
+
+	bot, err := p.getBot()
+	if err != nil {
+		p.API.LogError("Could not get bot", "error", err.Error())
+		return
+	}
+	p.API.SendEphemeralPost(args.UserId, &model.Post{
+		UserId:    bot.UserId,
+		ChannelId: args.ChannelId,
+		Message:   message,
+	})
+}
+
+// checkMappings returns every inconsistency between the stored mappings, the
+// conversation channels and the conversations on the numbers of the clients.
+// Parts that could not be checked are reported as issues as well.
+func (p *TwilioPlugin) checkMappings(ctx context.Context, clients []ITwilioClient) []*mappingIssue {
+	// Look past the cache, the check is about what Twilio has now
+	ctx = withCacheRefresh(ctx)
+
+	var issues []*mappingIssue
+	all, err := p.store.List()
+	if err != nil {
+		return []*mappingIssue{{Text: "Could not list conversation mappings: " + err.Error()}}
+	}
+	issues = append(issues, p.checkStoredMappings(ctx, all)...)
+	issues = append(issues, p.checkConversationChannels(ctx, clients)...)
+	for _, twilioClient := range clients {
+		issues = append(issues, p.checkConversationWebhooks(ctx, twilioClient)...)
+	}
+	return issues
+}
+
+// checkStoredMappings finds mappings to channels or threads that are gone and
+// to conversations that no longer exist in Twilio.
+func (p *TwilioPlugin) checkStoredMappings(ctx context.Context, all []*conversationSettings) []*mappingIssue {
+	var issues []*mappingIssue
+	results := fetchAll(ctx, all, p.checkStoredMapping)
+	for i, result := range results {
+		if result.Err != nil {
+			issues = append(issues, &mappingIssue{
+				Text: fmt.Sprintf("Could not check conversation %s: %s", all[i].ConversationSid, twilioErrorText(result.Err)),
+			})
+		} else if result.Value != nil {
+			issues = append(issues, result.Value)
+		}
+	}
+	return issues
+}
+
+func (p *TwilioPlugin) checkStoredMapping(ctx context.Context, settings *conversationSettings) (*mappingIssue, error) {
+	stale := func(text string, args ...interface{}) *mappingIssue {
+		return &mappingIssue{
+			Text: fmt.Sprintf(text, args...),
+			fix: func(ctx context.Context) error {
+				p.deleteConversationSettings(settings)
+				return nil
+			},
+		}
+	}
+
+	channel, appErr := p.API.GetChannel(settings.ChannelId)
+	if appErr != nil {
+		return stale("Conversation %s is mapped to channel %s, which does not exist", settings.ConversationSid, settings.ChannelId), nil
+	}
+	if channel.DeleteAt != 0 {
+		return stale("Conversation %s is mapped to archived channel ~%s", settings.ConversationSid, channel.Name), nil
+	}
+	if settings.Type == "post" {
+		if _, appErr := p.API.GetPost(settings.RootPostId); appErr != nil {
+			return stale("Conversation %s is mapped to a thread in ~%s that was deleted", settings.ConversationSid, channel.Name), nil
+		}
+	}
+	if settings.AccountSid != "" && !p.hasTwilioAccount(settings.AccountSid) {
+		return &mappingIssue{
+			Text: fmt.Sprintf("Conversation %s of ~%s belongs to Twilio account %s, which is not configured", settings.ConversationSid, channel.Name, settings.AccountSid),
+		}, nil
+	}
+
+	_, err := p.getSettingsTwilioClient(settings).GetConversation(ctx, settings.ConversationSid)
+	if errors.Is(err, errTwilioNotFound) {
+		return stale("Conversation %s of ~%s no longer exists in Twilio", settings.ConversationSid, channel.Name), nil
+	}
+	return nil, err
+}
+
+// checkConversationChannels finds channels created for a conversation that
+// is not mapped to any channel anymore.
+func (p *TwilioPlugin) checkConversationChannels(ctx context.Context, clients []ITwilioClient) []*mappingIssue {
+	unmapped, err := p.unmappedConversationChannels()
+	if err != nil {
+		return []*mappingIssue{{Text: "Could not list conversation channels: " + err.Error()}}
+	}
+
+	var issues []*mappingIssue
+	results := fetchAll(ctx, unmapped, func(ctx context.Context, channel *model.Channel) (*mappingIssue, error) {
+		conversationSid, _ := channel.Props["twilio_conversation_sid"].(string)
+		twilioClient, conv, err := findConversationClient(ctx, clients, conversationSid)
+		if err != nil {
+			return nil, err
+		}
+		if conv == nil {
+			return &mappingIssue{
+				Text: fmt.Sprintf("Channel ~%s was created for conversation %s, which no longer exists in Twilio", channel.Name, conversationSid),
+			}, nil
+		}
+		return &mappingIssue{
+			Text: fmt.Sprintf("Channel ~%s was created for conversation %s, which is not mapped to it", channel.Name, conversationSid),
+			fix: func(ctx context.Context) error {
+				return p.saveConversationSettings(&conversationSettings{
+					ConversationSid: conversationSid,
+					TeamId:          channel.TeamId,
+					ChannelId:       channel.Id,
+					ChatServiceSid:  conv.ChatServiceSid,
+					AccountSid:      twilioClient.Account().AccountSid,
+				})
+			},
+		}, nil
+	})
+	for i, result := range results {
+		if result.Err != nil {
+			issues = append(issues, &mappingIssue{
+				Text: fmt.Sprintf("Could not check channel ~%s: %s", unmapped[i].Name, twilioErrorText(result.Err)),
+			})
+		} else {
+			issues = append(issues, result.Value)
+		}
+	}
+	return issues
+}
+
+// unmappedConversationChannels returns the channels created for a
+// conversation that is not mapped to any channel, in channels that are not
+// mapped to another conversation.
+func (p *TwilioPlugin) unmappedConversationChannels() ([]*model.Channel, error) {
+	channels, err := p.listConversationChannels()
+	if err != nil {
+		return nil, err
+	}
+	var unmapped []*model.Channel
+	for _, channel := range channels {
+		conversationSid, _ := channel.Props["twilio_conversation_sid"].(string)
+		settings, err := p.store.Get(conversationSid)
+		if err != nil || settings != nil {
+			continue
+		}
+		if linked, err := p.store.GetByChannel(channel.Id); err != nil || linked != nil {
+			continue
+		}
+		unmapped = append(unmapped, channel)
+	}
+	return unmapped, nil
+}
+
+// listConversationChannels returns the channels carrying a conversation prop:
+// the public channels of all teams and the private ones the bot is in.
+func (p *TwilioPlugin) listConversationChannels() ([]*model.Channel, error) {
+	bot, err := p.getBot()
+	if err != nil {
+		return nil, err
+	}
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Could not list teams")
+	}
+
+	seen := map[string]bool{}
+	var result []*model.Channel
+	add := func(channels []*model.Channel) {
+		for _, channel := range channels {
+			if sid, ok := channel.Props["twilio_conversation_sid"].(string); ok && sid != "" && !seen[channel.Id] {
+				seen[channel.Id] = true
+				result = append(result, channel)
+			}
+		}
+	}
+	for _, team := range teams {
+		for page := 0; ; page++ {
+			channels, appErr := p.API.GetPublicChannelsForTeam(team.Id, page, 100)
+			if appErr != nil {
+				return nil, errors.Wrapf(appErr, "Could not list channels of team %s", team.Name)
+			}
+			add(channels)
+			if len(channels) < 100 {
+				break
+			}
+		}
+		channels, appErr := p.API.GetChannelsForTeamForUser(team.Id, bot.UserId, false)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "Could not list channels of the bot in team %s", team.Name)
+		}
+		add(channels)
+	}
+	return result, nil
+}
+
+// findConversationClient looks the conversation up in every client and
+// returns the one it belongs to, or nil when none has it.
+func findConversationClient(ctx context.Context, clients []ITwilioClient, conversationSid string) (ITwilioClient, *twiliov1.ConversationsV1Conversation, error) {
+	for _, twilioClient := range clients {
+		conv, err := twilioClient.GetConversation(ctx, conversationSid)
+		if err == nil {
+			return twilioClient, conv, nil
+		}
+		if !errors.Is(err, errTwilioNotFound) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, nil
+}
+
+// checkConversationWebhooks finds open conversations on the numbers of the
+// account that do not send their events to this server.
+func (p *TwilioPlugin) checkConversationWebhooks(ctx context.Context, twilioClient ITwilioClient) []*mappingIssue {
+	account := twilioClient.Account().Name
+	numbers, err := twilioClient.AccountNumbersStrings(ctx)
+	if err != nil {
+		return []*mappingIssue{{Text: fmt.Sprintf("Could not list the numbers of account %s: %s", account, twilioErrorText(err))}}
+	}
+
+	var issues []*mappingIssue
+	var conversations []twiliov1.ConversationsV1Conversation
+	seen := map[string]bool{}
+	for _, number := range numbers {
+		found, err := twilioClient.FindConversationsByProxyAddress(ctx, number, false)
+		if err != nil {
+			issues = append(issues, &mappingIssue{
+				Text: fmt.Sprintf("Could not list the conversations on %s: %s", number, twilioErrorText(err)),
+			})
+			continue
+		}
+		for _, conv := range found {
+			if conv.Sid == nil || seen[*conv.Sid] || (conv.State != nil && *conv.State == "closed") {
+				continue
+			}
+			seen[*conv.Sid] = true
+			conversations = append(conversations, conv)
+		}
+	}
+
+	webhook := p.getWebhookURL()
+	results := fetchAll(ctx, conversations, func(ctx context.Context, conv twiliov1.ConversationsV1Conversation) (bool, error) {
+		webhooks, err := twilioClient.ListConversationWebhooks(ctx, *conv.Sid)
+		if err != nil {
+			return false, err
+		}
+		for _, existing := range webhooks {
+			if strings.EqualFold(scopedWebhookURL(&existing), webhook) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	for i, result := range results {
+		conversationSid := *conversations[i].Sid
+		if result.Err != nil {
+			issues = append(issues, &mappingIssue{
+				Text: fmt.Sprintf("Could not check the webhooks of conversation %s: %s", conversationSid, twilioErrorText(result.Err)),
+			})
+		} else if !result.Value {
+			issues = append(issues, &mappingIssue{
+				Text: fmt.Sprintf("Conversation %s of account %s has no webhook to this server", conversationSid, account),
+				fix: func(ctx context.Context) error {
+					return twilioClient.AddWebhookToConversation(ctx, conversationSid)
+				},
+			})
+		}
+	}
+	return issues
+}
+
+func scopedWebhookURL(webhook *twiliov1.ConversationsV1ConversationScopedWebhook) string {
+	if webhook.Configuration == nil {
+		return ""
+	}
+	if configMap, ok := (*webhook.Configuration).(map[string]interface{}); ok {
+		if u, ok := configMap["url"].(string); ok {
+			return u
+		}
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Requests sent to Twilio at the same time by one operation
+	fetchConcurrency = 5
+	// Retries of a request that was rate limited or failed temporarily
+	fetchRetries = 3
+)
+
+// Wait before the first retry, doubled for every further one. A variable so
+// tests do not have to wait for it.
+var fetchBackoff = time.Second
+
+// fetchResult is the outcome of fetching one item.
+type fetchResult[R any] struct {
+	Value R
+	Err   error
+}
+
+// fetchAll calls fetch for every item with a bounded number of calls running at
+// once and returns the results in the order of the items. Rate limited and
+// temporarily failed calls are retried, and a rate limit pauses all workers so
+// the operation backs off as a whole. Items not fetched before the context is
+// done get the context error.
+func fetchAll[T, R any](ctx context.Context, items []T, fetch func(context.Context, T) (R, error)) []fetchResult[R] {
+	results := make([]fetchResult[R], len(items))
+	if len(items) == 0 {
+		return results
+	}
+
+	gate := &fetchGate{}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(fetchConcurrency, len(items)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i].Value, results[i].Err = fetchWithRetry(ctx, gate, items[i], fetch)
+			}
+		}()
+	}
+
+	fed := 0
+feed:
+	for ; fed < len(items); fed++ {
+		select {
+		case next <- fed:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	for i := fed; i < len(items); i++ {
+		results[i].Err = ctx.Err()
+	}
+	return results
+}
+
+func fetchWithRetry[T, R any](ctx context.Context, gate *fetchGate, item T, fetch func(context.Context, T) (R, error)) (R, error) {
+	for attempt := 0; ; attempt++ {
+		if err := gate.wait(ctx); err != nil {
+			var zero R
+			return zero, err
+		}
+		value, err := fetch(ctx, item)
+		if err == nil || attempt >= fetchRetries || !isRetryableTwilioError(err) {
+			return value, err
+		}
+		delay := fetchBackoff << attempt
+		if errors.Is(err, errTwilioRateLimited) {
+			gate.pause(delay)
+			continue
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return value, err
+		}
+	}
+}
+
+// fetchGate holds back all workers of an operation while Twilio rate limits.
+type fetchGate struct {
+	lock  sync.Mutex
+	until time.Time
+}
+
+func (g *fetchGate) pause(delay time.Duration) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if until := time.Now().Add(delay); until.After(g.until) {
+		g.until = until
+	}
+}
+
+func (g *fetchGate) wait(ctx context.Context) error {
+	g.lock.Lock()
+	delay := time.Until(g.until)
+	g.lock.Unlock()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	return sleepContext(ctx, delay)
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchError sums up the failed items of a fetchAll call. It unwraps to the
+// first error so its kind can still be tested with errors.Is.
+type fetchError struct {
+	Failed int
+	Total  int
+	First  error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("%d of %d requests failed, first error: %s", e.Failed, e.Total, e.First.Error())
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.First
+}
+
+// fetchErrors returns a fetchError when any item failed.
+func fetchErrors[R any](results []fetchResult[R]) error {
+	var aggregated *fetchError
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if aggregated == nil {
+			aggregated = &fetchError{Total: len(results), First: result.Err}
+		}
+		aggregated.Failed++
+	}
+	if aggregated == nil {
+		return nil
+	}
+	return aggregated
+}
+
+// fetchSucceeded returns the number of items that did not fail.
+func fetchSucceeded[R any](results []fetchResult[R]) int {
+	succeeded := 0
+	for _, result := range results {
+		if result.Err == nil {
+			succeeded++
+		}
+	}
+	return succeeded
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFetchAllKeepsOrder(t *testing.T) {
+	items := make([]int, 50)
+	for i := range items {
+		items[i] = i
+	}
+	var running, most int32
+	results := fetchAll(context.Background(), items, func(ctx context.Context, item int) (int, error) {
+		now := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			seen := atomic.LoadInt32(&most)
+			if now <= seen || atomic.CompareAndSwapInt32(&most, seen, now) {
+				break
+			}
+		}
+		return item * 2, nil
+	})
+	for i, result := range results {
+		if result.Err != nil || result.Value != i*2 {
+			t.Fatalf("result %d = %d, %v, want %d", i, result.Value, result.Err, i*2)
+		}
+	}
+	if most > fetchConcurrency {
+		t.Fatalf("%d fetches ran at once, want at most %d", most, fetchConcurrency)
+	}
+	if err := fetchErrors(results); err != nil {
+		t.Fatalf("fetchErrors = %v, want none", err)
+	}
+}
+
+func TestFetchAllErrors(t *testing.T) {
+	backoff := fetchBackoff
+	fetchBackoff = time.Millisecond
+	defer func() { fetchBackoff = backoff }()
+
+	var lock sync.Mutex
+	calls := map[string]int{}
+	results := fetchAll(context.Background(), []string{"ok", "missing", "flaky"}, func(ctx context.Context, item string) (string, error) {
+		lock.Lock()
+		calls[item]++
+		attempt := calls[item]
+		lock.Unlock()
+		switch {
+		case item == "missing":
+			return "", errTwilioNotFound
+		case item == "flaky" && attempt == 1:
+			return "", errTwilioTransient
+		}
+		return item, nil
+	})
+
+	if results[0].Value != "ok" || results[2].Value != "flaky" || results[2].Err != nil {
+		t.Fatalf("results = %+v, want ok and flaky to succeed", results)
+	}
+	if !errors.Is(results[1].Err, errTwilioNotFound) {
+		t.Fatalf("missing error = %v, want not found", results[1].Err)
+	}
+	if calls["missing"] != 1 || calls["flaky"] != 2 {
+		t.Fatalf("calls = %v, want missing once and flaky retried once", calls)
+	}
+
+	err := fetchErrors(results)
+	var aggregated *fetchError
+	if !errors.As(err, &aggregated) || aggregated.Failed != 1 || aggregated.Total != 3 {
+		t.Fatalf("fetchErrors = %v, want 1 of 3 failed", err)
+	}
+	if !errors.Is(err, errTwilioNotFound) {
+		t.Fatalf("fetchErrors = %v, want it to unwrap to not found", err)
+	}
+}
+
+func TestFetchAllCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	items := make([]int, 20)
+	results := fetchAll(ctx, items, func(ctx context.Context, item int) (int, error) {
+		cancel()
+		return 1, nil
+	})
+	cancelled := 0
+	for _, result := range results {
+		if result.Err != nil {
+			if !errors.Is(result.Err, context.Canceled) {
+				t.Fatalf("error = %v, want context cancelled", result.Err)
+			}
+			cancelled++
+		}
+	}
+	if cancelled == 0 {
+		t.Fatal("no item got the context error")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	flowDefinitionsKey = "twilio-flows"
+	flowStatePrefix    = "twilio-flow-state-"
+
+	// A conversation that stops answering a flow question is dropped out of
+	// the flow after this long, so the next message starts fresh.
+	flowStateExpirySeconds = 60 * 60
+
+	flowActionEnd     = "end"
+	flowActionRoute   = "route"
+	flowActionHandoff = "handoff"
+)
+
+/*
+ Flows are small keyword driven state machines evaluated on inbound messages
+ before anything is posted to Mattermost. A flow is started when an inbound
+ message matches one of its keywords and then moves between steps based on
+ the options of the current step.
+
+	{
+		"name": "menu",
+		"keywords": ["menu", "help"],
+		"start": "main",
+		"steps": {
+			"main": {"reply": "Reply 1 for sales, 2 for support", "options": {"1": "sales", "2": "support"}},
+			"sales": {"reply": "Connecting you with sales", "action": "route", "channel": "sales"},
+			"support": {"reply": "Someone will be with you shortly", "action": "handoff"}
+		}
+	}
+
+ A step with options asks a question and waits for the answer. Otherwise the
+ step action decides what happens after the reply is sent:
+	end (default): the message is answered by the flow and not posted
+	route: a conversation that is not linked yet is threaded into the given
+	       channel of the team its number is assigned to, linked ones stay
+	       where they are
+	handoff: the message is posted as usual for a human to pick up
+*/
+
+type flowDefinition struct {
+	Name     string               `json:"name"`
+	Keywords []string             `json:"keywords"`
+	Start    string               `json:"start"`
+	Steps    map[string]*flowStep `json:"steps"`
+}
+
+type flowStep struct {
+	Reply   string            `json:"reply,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+	Action  string            `json:"action,omitempty"`
+	Channel string            `json:"channel,omitempty"`
+}
+
+type flowState struct {
+	Flow      string `json:"flow"`
+	Step      string `json:"step"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type flowOutcome struct {
+	// Handled means the flow answered the message and it should not be posted.
+	Handled bool
+	Action  string
+	Channel string
+}
+
+func (f *flowDefinition) IsValid() error {
+	if f.Name == "" {
+		return errors.New("flow must have a name")
+	}
+	if len(f.Keywords) == 0 {
+		return errors.Errorf("flow %s must have at least one keyword", f.Name)
+	}
+	if _, ok := f.Steps[f.Start]; !ok {
+		return errors.Errorf("flow %s start step %q does not exist", f.Name, f.Start)
+	}
+	for name, step := range f.Steps {
+		if step == nil {
+			return errors.Errorf("flow %s step %s is empty", f.Name, name)
+		}
+		for option, next := range step.Options {
+			if _, ok := f.Steps[next]; !ok {
+				return errors.Errorf("flow %s step %s option %s points to missing step %q", f.Name, name, option, next)
+			}
+		}
+		switch step.Action {
+		case "", flowActionEnd, flowActionHandoff:
+		case flowActionRoute:
+			if step.Channel == "" {
+				return errors.Errorf("flow %s step %s routes without a channel", f.Name, name)
+			}
+		default:
+			return errors.Errorf("flow %s step %s has unknown action %q", f.Name, name, step.Action)
+		}
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) getFlows() (map[string]*flowDefinition, error) {
+	flows := map[string]*flowDefinition{}
+	data, err := p.API.KVGet(flowDefinitionsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get flows")
+	}
+	if data == nil {
+		return flows, nil
+	}
+	if err := json.Unmarshal(data, &flows); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal flows")
+	}
+	return flows, nil
+}
+
+func (p *TwilioPlugin) saveFlows(flows map[string]*flowDefinition) error {
+	data, err := json.Marshal(flows)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal flows")
+	}
+	if err := p.API.KVSet(flowDefinitionsKey, data); err != nil {
+		return errors.Wrap(err, "Could not save flows")
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) saveFlow(flow *flowDefinition) error {
+	if err := flow.IsValid(); err != nil {
+		return err
+	}
+	flows, err := p.getFlows()
+	if err != nil {
+		return err
+	}
+	flows[flow.Name] = flow
+	return p.saveFlows(flows)
+}
+
+func (p *TwilioPlugin) deleteFlow(name string) (bool, error) {
+	flows, err := p.getFlows()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := flows[name]; !ok {
+		return false, nil
+	}
+	delete(flows, name)
+	return true, p.saveFlows(flows)
+}
+
+func (p *TwilioPlugin) getFlowState(conversationSid string) (*flowState, error) {
+	data, err := p.API.KVGet(flowStatePrefix + conversationSid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get flow state")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var state flowState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal flow state")
+	}
+	return &state, nil
+}
+
+func (p *TwilioPlugin) saveFlowState(conversationSid string, state *flowState) error {
+	state.UpdatedAt = model.GetMillis()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal flow state")
+	}
+	if err := p.API.KVSetWithExpiry(flowStatePrefix+conversationSid, data, flowStateExpirySeconds); err != nil {
+		return errors.Wrap(err, "Could not save flow state")
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) clearFlowState(conversationSid string) {
+	if err := p.API.KVDelete(flowStatePrefix + conversationSid); err != nil {
+		p.API.LogError("Could not clear flow state", "sid", conversationSid, "error", err.Error())
+	}
+}
+
+// runConversationFlow evaluates the configured flows against an inbound
+// message. A nil outcome means no flow applied and the message should be
+// posted as usual.
+func (p *TwilioPlugin) runConversationFlow(ctx context.Context, accountSid, conversationSid, body string) (*flowOutcome, error) {
+	flows, err := p.getFlows()
+	if err != nil || len(flows) == 0 {
+		return nil, err
+	}
+	input := strings.ToLower(strings.TrimSpace(body))
+
+	state, err := p.getFlowState(conversationSid)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		if flow, ok := flows[state.Flow]; ok {
+			if step, ok := flow.Steps[state.Step]; ok {
+				for option, next := range step.Options {
+					if strings.EqualFold(option, input) {
+						return p.executeFlowStep(ctx, accountSid, conversationSid, flow, next)
+					}
+				}
+			}
+		}
+		// The answer did not match, fall back to keywords or a human
+		p.clearFlowState(conversationSid)
+	}
+
+	names := make([]string, 0, len(flows))
+	for name := range flows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flow := flows[name]
+		for _, keyword := range flow.Keywords {
+			if strings.EqualFold(strings.TrimSpace(keyword), input) {
+				return p.executeFlowStep(ctx, accountSid, conversationSid, flow, flow.Start)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (p *TwilioPlugin) executeFlowStep(ctx context.Context, accountSid, conversationSid string, flow *flowDefinition, stepName string) (*flowOutcome, error) {
+	step, ok := flow.Steps[stepName]
+	if !ok {
+		return nil, errors.Errorf("flow %s has no step %s", flow.Name, stepName)
+	}
+	p.API.LogDebug("Executing flow step", "sid", conversationSid, "flow", flow.Name, "step", stepName)
+
+	if step.Reply != "" {
+		if err := p.getTwilioClient(accountSid).SendMessageToConversation(ctx, conversationSid, step.Reply); err != nil {
+			return nil, errors.Wrap(err, "Could not send flow reply")
+		}
+	}
+
+	if len(step.Options) > 0 {
+		if err := p.saveFlowState(conversationSid, &flowState{Flow: flow.Name, Step: stepName}); err != nil {
+			return nil, err
+		}
+		return &flowOutcome{Handled: true}, nil
+	}
+
+	p.clearFlowState(conversationSid)
+	switch step.Action {
+	case flowActionRoute:
+		return &flowOutcome{Action: flowActionRoute, Channel: step.Channel}, nil
+	case flowActionHandoff:
+		return &flowOutcome{Action: flowActionHandoff}, nil
+	}
+	return &flowOutcome{Handled: true, Action: flowActionEnd}, nil
+}
+
+// routeConversationToChannel links a conversation that is not linked yet to a
+// thread in the named channel of the team its number is assigned to. A
+// conversation that already has a channel or thread keeps it, so established
+// customers are not moved away from their channel.
+func (p *TwilioPlugin) routeConversationToChannel(ctx context.Context, accountSid, conversationSid, channelName, author string) (*conversationSettings, error) {
+	existing, err := p.store.Get(conversationSid)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return p.getConversationSettings(ctx, conversationSid)
+	}
+
+	twilioClient := p.getTwilioClient(accountSid)
+	participants, err := twilioClient.GetConversationParticipants(ctx, conversationSid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get conversation participants")
+	}
+	conv, err := twilioClient.GetConversation(ctx, conversationSid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get conversation details")
+	}
+	var messagingServiceSid string
+	if conv.MessagingServiceSid != nil {
+		messagingServiceSid = *conv.MessagingServiceSid
+	}
+	route, err := p.numberRoute(proxyAddress(participants), messagingServiceSid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not resolve team for conversation")
+	}
+
+	channel, appErr := p.API.GetChannelByName(route.TeamId, channelName, false)
+	if appErr != nil {
+		return nil, errors.Wrapf(appErr, "Could not find channel %s", channelName)
+	}
+	unlock, err := p.lockConversation(ctx, conversationSid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if existing, err := p.store.Get(conversationSid); err == nil && existing != nil {
+		return p.getConversationSettings(ctx, conversationSid)
+	}
+	return p.createConversationThread(ctx, twilioClient, conversationSid, channel, author)
+}
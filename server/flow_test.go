@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// testFlowClient records the replies a flow sends.
+type testFlowClient struct {
+	ITwilioClient
+	sent []string
+}
+
+func (c *testFlowClient) SendMessageToConversation(ctx context.Context, conversationSid, message string) error {
+	c.sent = append(c.sent, message)
+	return nil
+}
+
+func newTestFlowPlugin(t *testing.T, flows ...*flowDefinition) (*TwilioPlugin, *testFlowClient) {
+	t.Helper()
+	client := &testFlowClient{}
+	p := &TwilioPlugin{twilio: client}
+	p.SetAPI(newTestKVAPI())
+	for _, flow := range flows {
+		if err := p.saveFlow(flow); err != nil {
+			t.Fatalf("saveFlow failed: %v", err)
+		}
+	}
+	return p, client
+}
+
+func menuFlow() *flowDefinition {
+	return &flowDefinition{
+		Name:     "menu",
+		Keywords: []string{"menu", "help"},
+		Start:    "main",
+		Steps: map[string]*flowStep{
+			"main":    {Reply: "Reply 1 for sales, 2 for support, 3 for hours", Options: map[string]string{"1": "sales", "2": "support", "3": "hours"}},
+			"sales":   {Reply: "Connecting you with sales", Action: flowActionRoute, Channel: "sales"},
+			"support": {Reply: "Someone will be with you shortly", Action: flowActionHandoff},
+			"hours":   {Reply: "We are open 9 to 5"},
+		},
+	}
+}
+
+func TestConversationFlow(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     *flowOutcome
+		replies  []string
+		waiting  string
+	}{{
+		name:     "no keyword",
+		messages: []string{"hello"},
+		want:     nil,
+	}, {
+		name:     "keyword starts the flow",
+		messages: []string{"  MENU "},
+		want:     &flowOutcome{Handled: true},
+		replies:  []string{"Reply 1 for sales, 2 for support, 3 for hours"},
+		waiting:  "main",
+	}, {
+		name:     "route",
+		messages: []string{"menu", "1"},
+		want:     &flowOutcome{Action: flowActionRoute, Channel: "sales"},
+		replies:  []string{"Reply 1 for sales, 2 for support, 3 for hours", "Connecting you with sales"},
+	}, {
+		name:     "handoff",
+		messages: []string{"help", "2"},
+		want:     &flowOutcome{Action: flowActionHandoff},
+		replies:  []string{"Reply 1 for sales, 2 for support, 3 for hours", "Someone will be with you shortly"},
+	}, {
+		name:     "end",
+		messages: []string{"menu", "3"},
+		want:     &flowOutcome{Handled: true, Action: flowActionEnd},
+		replies:  []string{"Reply 1 for sales, 2 for support, 3 for hours", "We are open 9 to 5"},
+	}, {
+		name:     "unknown answer leaves the flow",
+		messages: []string{"menu", "4"},
+		want:     nil,
+		replies:  []string{"Reply 1 for sales, 2 for support, 3 for hours"},
+	}, {
+		name:     "keyword as answer starts over",
+		messages: []string{"menu", "menu"},
+		want:     &flowOutcome{Handled: true},
+		replies:  []string{"Reply 1 for sales, 2 for support, 3 for hours", "Reply 1 for sales, 2 for support, 3 for hours"},
+		waiting:  "main",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, client := newTestFlowPlugin(t, menuFlow())
+			var outcome *flowOutcome
+			for _, message := range test.messages {
+				var err error
+				if outcome, err = p.runConversationFlow(context.Background(), "AC1", "CH1", message); err != nil {
+					t.Fatalf("runConversationFlow(%q) failed: %v", message, err)
+				}
+			}
+			if !reflect.DeepEqual(outcome, test.want) {
+				t.Fatalf("outcome = %+v, want %+v", outcome, test.want)
+			}
+			if !reflect.DeepEqual(client.sent, test.replies) {
+				t.Fatalf("replies = %q, want %q", client.sent, test.replies)
+			}
+			state, err := p.getFlowState("CH1")
+			if err != nil {
+				t.Fatalf("getFlowState failed: %v", err)
+			}
+			switch {
+			case test.waiting == "" && state != nil:
+				t.Fatalf("conversation still waits in step %s", state.Step)
+			case test.waiting != "" && (state == nil || state.Flow != "menu" || state.Step != test.waiting):
+				t.Fatalf("flow state = %+v, want waiting in %s", state, test.waiting)
+			}
+		})
+	}
+}
+
+func TestFlowDefinitionIsValid(t *testing.T) {
+	broken := func(change func(*flowDefinition)) *flowDefinition {
+		flow := menuFlow()
+		change(flow)
+		return flow
+	}
+	tests := []struct {
+		name  string
+		flow  *flowDefinition
+		valid bool
+	}{
+		{"menu", menuFlow(), true},
+		{"no name", broken(func(f *flowDefinition) { f.Name = "" }), false},
+		{"no keywords", broken(func(f *flowDefinition) { f.Keywords = nil }), false},
+		{"missing start step", broken(func(f *flowDefinition) { f.Start = "begin" }), false},
+		{"option to missing step", broken(func(f *flowDefinition) { f.Steps["main"].Options["4"] = "billing" }), false},
+		{"route without channel", broken(func(f *flowDefinition) { f.Steps["sales"].Channel = "" }), false},
+		{"unknown action", broken(func(f *flowDefinition) { f.Steps["hours"].Action = "close" }), false},
+		{"empty step", broken(func(f *flowDefinition) { f.Steps["hours"] = nil }), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.flow.IsValid(); (err == nil) != test.valid {
+				t.Fatalf("IsValid = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestRouteConversationKeepsLink(t *testing.T) {
+	p, _ := newTestFlowPlugin(t)
+	p.store = newMemoryConversationStore()
+	chatServiceSid := "IS1"
+	linked := channelSettings("CH1", "channel1")
+	linked.ChatServiceSid = &chatServiceSid
+	mustSave(t, p.store, linked)
+
+	// The test client has no participants or conversations, routing a linked
+	// conversation must not need them
+	settings, err := p.routeConversationToChannel(context.Background(), "AC1", "CH1", "sales", "+15550001111")
+	if err != nil {
+		t.Fatalf("routeConversationToChannel failed: %v", err)
+	}
+	if settings.ChannelId != "channel1" {
+		t.Fatalf("routeConversationToChannel linked channel %s, want channel1", settings.ChannelId)
+	}
+	if stored, _ := p.store.Get("CH1"); stored == nil || stored.ChannelId != "channel1" {
+		t.Fatalf("stored link = %+v, want channel1", stored)
+	}
+}
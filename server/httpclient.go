@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/twilio/twilio-go"
+	"github.com/twilio/twilio-go/client"
+)
+
+const defaultHTTPTimeoutSeconds = 30
+
+// newTwilioHTTPClient builds the HTTP client used for every request to Twilio,
+// both through the REST client and for the media service.
+func newTwilioHTTPClient(configuration *configuration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if configuration.HTTPProxy != "" {
+		proxyURL, err := url.Parse(configuration.HTTPProxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse HTTP proxy URL")
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if strings.TrimSpace(configuration.HTTPCABundle) != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(configuration.HTTPCABundle)) {
+			return nil, errors.New("failed to parse CA bundle, it must contain PEM encoded certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if configuration.TwilioAPIBaseURL != "" {
+		baseURL, err := url.Parse(configuration.TwilioAPIBaseURL)
+		if err != nil || baseURL.Scheme == "" || baseURL.Host == "" {
+			return nil, errors.Errorf("invalid Twilio API base URL %s", configuration.TwilioAPIBaseURL)
+		}
+		roundTripper = &baseURLTransport{base: baseURL, next: transport}
+	}
+
+	timeout := configuration.HTTPTimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeoutSeconds
+	}
+
+	return &http.Client{
+		Transport: roundTripper,
+		Timeout:   time.Duration(timeout) * time.Second,
+		// Same as the twilio-go default client, return redirects as they are
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// baseURLTransport sends requests for twilio.com hosts to another base URL,
+// for example a local Twilio stand-in used for testing.
+type baseURLTransport struct {
+	base *url.URL
+	next http.RoundTripper
+}
+
+func (t *baseURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Hostname(), "twilio.com") {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.base.Scheme
+	req.URL.Host = t.base.Host
+	req.URL.Path = strings.TrimSuffix(t.base.Path, "/") + req.URL.Path
+	req.Host = t.base.Host
+	return t.next.RoundTrip(req)
+}
+
+// contextHTTPClient returns a copy of the HTTP client whose requests are bound
+// to the context. The twilio-go client does not take a context, so it is
+// attached by the transport instead.
+func contextHTTPClient(ctx context.Context, httpClient *http.Client) *http.Client {
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport:     &contextTransport{ctx: ctx, timeout: httpClient.Timeout, next: next},
+		CheckRedirect: httpClient.CheckRedirect,
+	}
+}
+
+// contextTransport sends every request with its context, keeping the timeout
+// of the original client for each single request.
+type contextTransport struct {
+	ctx     context.Context
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := t.ctx, context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// newTwilioRestClient builds a REST client for the account that sends its
+// requests through the given HTTP client.
+func newTwilioRestClient(account *twilioAccount, httpClient *http.Client) *twilio.RestClient {
+	baseClient := &client.Client{
+		Credentials: client.NewCredentials(account.Username, account.Password),
+		HTTPClient:  httpClient,
+	}
+	baseClient.SetAccountSid(account.AccountSid)
+
+	restClient := twilio.NewRestClientWithParams(twilio.ClientParams{Client: baseClient})
+	restClient.SetRegion(account.Region)
+	restClient.SetEdge(account.Edge)
+	return restClient
+}
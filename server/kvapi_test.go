@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// testKVAPI is a plugin API with an in-memory KV store. Calls to the rest of
+// the API panic on the nil embedded interface.
+type testKVAPI struct {
+	plugin.API
+
+	lock sync.Mutex
+	data map[string][]byte
+
+	// Called before a compare-and-set or compare-and-delete, without the lock
+	// held, to simulate a write from another node.
+	beforeCompare func(key string)
+}
+
+func newTestKVAPI() *testKVAPI {
+	return &testKVAPI{data: map[string][]byte{}}
+}
+
+func (api *testKVAPI) KVGet(key string) ([]byte, *model.AppError) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	return api.data[key], nil
+}
+
+func (api *testKVAPI) KVSet(key string, value []byte) *model.AppError {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if value == nil {
+		delete(api.data, key)
+		return nil
+	}
+	api.data[key] = value
+	return nil
+}
+
+func (api *testKVAPI) KVSetWithExpiry(key string, value []byte, expireInSeconds int64) *model.AppError {
+	return api.KVSet(key, value)
+}
+
+func (api *testKVAPI) KVDelete(key string) *model.AppError {
+	return api.KVSet(key, nil)
+}
+
+func (api *testKVAPI) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	if api.beforeCompare != nil {
+		api.beforeCompare(key)
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	current, ok := api.data[key]
+	if oldValue == nil && ok || oldValue != nil && !bytes.Equal(current, oldValue) {
+		return false, nil
+	}
+	api.data[key] = newValue
+	return true, nil
+}
+
+func (api *testKVAPI) KVCompareAndDelete(key string, oldValue []byte) (bool, *model.AppError) {
+	if api.beforeCompare != nil {
+		api.beforeCompare(key)
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if current, ok := api.data[key]; !ok || !bytes.Equal(current, oldValue) {
+		return false, nil
+	}
+	delete(api.data, key)
+	return true, nil
+}
+
+func (api *testKVAPI) KVList(page, perPage int) ([]string, *model.AppError) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	keys := make([]string, 0, len(api.data))
+	for key := range api.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	start := page * perPage
+	if start >= len(keys) {
+		return []string{}, nil
+	}
+	end := start + perPage
+	if end > len(keys) {
+		end = len(keys)
+	}
+	return keys[start:end], nil
+}
+
+func (api *testKVAPI) LogDebug(msg string, keyValuePairs ...any) {}
+func (api *testKVAPI) LogInfo(msg string, keyValuePairs ...any)  {}
+func (api *testKVAPI) LogWarn(msg string, keyValuePairs ...any)  {}
+func (api *testKVAPI) LogError(msg string, keyValuePairs ...any) {}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"strings"
 
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 	"github.com/pkg/errors"
 )
 
@@ -13,74 +14,76 @@ type conversationSettings struct {
 	TeamId          string  `json:"team_id"`
 	ChannelId       string  `json:"channel_id"`
 	ChatServiceSid  *string `json:"chat_service_sid,omitempty"`
+	AccountSid      string  `json:"account_sid,omitempty"`
 	Type            string  `json:"type,omitempty"`
 	RootPostId      string  `json:"root_post_id,omitempty"`
 }
 
-func (p *TwilioPlugin) getChannelConversationSettings(channelId string) (*conversationSettings, error) {
+func (p *TwilioPlugin) createConversationSettings(ctx context.Context, accountSid, conversationSid, author, body string) (*conversationSettings, error) {
+	twilioClient := p.getTwilioClient(accountSid)
 
-	var settings *conversationSettings
-	data, err := p.API.KVGet("twilio-by-Ch-" + channelId)
-	if err != nil {
-		return nil, errors.Wrap(err, "Could not find conversation")
-	}
-	if err := json.Unmarshal(data, &settings); err != nil {
-		return nil, errors.Wrap(err, "Could not unmarshal conversation settings")
+	bot, appErr := p.getBot()
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Could not get bot")
 	}
-	return settings, nil
 
-}
+	var channel_name string
+	participants, errp := twilioClient.GetConversationParticipants(ctx, conversationSid)
+	if errp != nil {
+		channel_name = "Twilio Conversation " + conversationSid
 
-func (p *TwilioPlugin) getChannelConversationSid(channelId string) (string, error) {
-	settings, err := p.getChannelConversationSettings(channelId)
-	if err != nil {
-		return "", err
+	} else {
+		channel_name = "Text " + strings.Join(participants, ", ")
 	}
-	return settings.ConversationSid, nil
-}
-
-func (p *TwilioPlugin) getPostConversationSettings(postId string) (*conversationSettings, error) {
 
-	var settings *conversationSettings
-	data, err := p.API.KVGet("twilio-by-Po-" + postId)
-	if err != nil {
-		return nil, errors.Wrap(err, "Could not find conversation")
-	}
-	if err := json.Unmarshal(data, &settings); err != nil {
-		return nil, errors.Wrap(err, "Could not unmarshal conversation settings")
+	conv, errc := twilioClient.GetConversation(ctx, conversationSid)
+	if errc != nil {
+		return nil, errors.Wrap(errc, "Could not get conversation details")
 	}
-	return settings, nil
-
-}
 
-func (p *TwilioPlugin) createConversationSettings(conversationSid string) (*conversationSettings, error) {
-	configuration := p.getConfiguration()
+	// The mapping was lost while the channel or thread it pointed to is still
+	// there, the conversation attributes know where it was
+	if settings := p.settingsFromLink(conv, twilioClient.Account().AccountSid); settings != nil {
+		p.API.LogInfo("Restoring conversation mapping from its attributes", "sid", conversationSid, "channel_id", settings.ChannelId)
+		if err := p.saveConversationSettings(settings); err != nil {
+			return nil, errors.Wrap(err, "Could not save conversation settings")
+		}
+		return settings, nil
+	}
 
-	TeamId := configuration.TeamId
+	var messagingServiceSid string
+	if conv.MessagingServiceSid != nil {
+		messagingServiceSid = *conv.MessagingServiceSid
+	}
 
-	team, err := p.API.GetTeam(TeamId)
+	route, err := p.resolveRoute(author, proxyAddress(participants), messagingServiceSid, body)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Could not find team with ID %s", TeamId)
+		return nil, errors.Wrap(err, "Could not resolve route for conversation")
 	}
+	p.API.LogDebug("Resolved route", "sid", conversationSid, "rule", route.Rule, "team_id", route.TeamId, "mode", route.Mode)
 
-	bot, appErr := p.getBot()
-	if appErr != nil {
-		return nil, errors.Wrap(appErr, "Could not get bot")
+	team, err := p.API.GetTeam(route.TeamId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not find team with ID %s", route.TeamId)
 	}
 
-	var channel_name string
-	participants, errp := p.twilio.GetConversationParticipants(conversationSid)
-	if errp != nil {
-		channel_name = "Twilio Conversation " + conversationSid
+	if route.Mode == routeModeThread {
+		inbox, cerr := p.API.GetChannelByName(team.Id, route.Inbox, false)
+		if cerr != nil {
+			return nil, errors.Wrapf(cerr, "Could not find inbox channel %s", route.Inbox)
+		}
+		return p.createConversationThread(ctx, twilioClient, conversationSid, inbox, author)
+	}
 
-	} else {
-		channel_name = "Text " + strings.Join(participants, ", ")
+	channelType := model.ChannelTypeOpen
+	if route.Private {
+		channelType = model.ChannelTypePrivate
 	}
 
 	channel := &model.Channel{
 		TeamId:      team.Id,
-		Type:        model.ChannelTypeOpen,
-		Name:        "twilio" + strings.ToLower(conversationSid),
+		Type:        channelType,
+		Name:        conversationChannelName(conversationSid),
 		DisplayName: channel_name,
 		Props: map[string]interface{}{
 			"twilio_conversation_sid": conversationSid,
@@ -88,23 +91,30 @@ func (p *TwilioPlugin) createConversationSettings(conversationSid string) (*conv
 		CreatorId: bot.UserId,
 	}
 
-	channel_new, cerr := p.API.CreateChannel(channel)
-
-	if cerr != nil {
-		return nil, errors.Wrap(cerr, "Could not create channel for conversation")
+	// A channel left behind by an earlier attempt, or created by another node
+	// before it could save the settings, is taken over instead
+	channel_new, err := p.findConversationChannel(team.Id, bot.UserId, conversationSid)
+	if err != nil {
+		return nil, err
 	}
-
-	if configuration.AutoAddUsersIds != nil {
-		for _, userId := range *configuration.AutoAddUsersIds {
-			if _, err := p.API.AddUserToChannel(channel_new.Id, userId, userId); err != nil {
-				p.API.LogError("Could not add user to channel", "user_id", userId, "channel_id", channel_new.Id, "error", err.Error())
+	if channel_new == nil {
+		var cerr *model.AppError
+		channel_new, cerr = p.API.CreateChannel(channel)
+		if cerr != nil {
+			existing, ferr := p.findConversationChannel(team.Id, bot.UserId, conversationSid)
+			if ferr != nil || existing == nil {
+				return nil, errors.Wrap(cerr, "Could not create channel for conversation")
 			}
+			channel_new = existing
 		}
+	} else {
+		p.API.LogInfo("Adopting existing channel for conversation", "sid", conversationSid, "channel_id", channel_new.Id)
 	}
 
-	conv, errc := p.twilio.GetConversation(conversationSid)
-	if errc != nil {
-		return nil, errors.Wrap(errc, "Could not get conversation details")
+	for _, userId := range route.UserIds {
+		if _, err := p.API.AddUserToChannel(channel_new.Id, userId, userId); err != nil {
+			p.API.LogError("Could not add user to channel", "user_id", userId, "channel_id", channel_new.Id, "error", err.Error())
+		}
 	}
 
 	var chatServiceSid *string
@@ -117,6 +127,7 @@ func (p *TwilioPlugin) createConversationSettings(conversationSid string) (*conv
 		TeamId:          team.Id,
 		ChannelId:       channel_new.Id,
 		ChatServiceSid:  chatServiceSid,
+		AccountSid:      twilioClient.Account().AccountSid,
 	}
 
 	if err := p.saveConversationSettings(settings); err != nil {
@@ -126,23 +137,22 @@ func (p *TwilioPlugin) createConversationSettings(conversationSid string) (*conv
 	return settings, nil
 }
 
-func (p *TwilioPlugin) getConversationSettings(conversationSid string) (*conversationSettings, error) {
-	var settings conversationSettings
-	data, err := p.API.KVGet("twilio-by-Co-" + conversationSid)
+func (p *TwilioPlugin) getConversationSettings(ctx context.Context, conversationSid string) (*conversationSettings, error) {
+	settings, err := p.store.Get(conversationSid)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not find conversation")
+		return nil, err
 	}
-	if err := json.Unmarshal(data, &settings); err != nil {
-		return nil, errors.Wrap(err, "Could not unmarshal conversation settings")
+	if settings == nil {
+		return nil, errors.Errorf("Conversation %s is not linked", conversationSid)
 	}
 	if settings.ChatServiceSid == nil {
-		conv, errc := p.twilio.GetConversation(conversationSid)
+		conv, errc := p.getSettingsTwilioClient(settings).GetConversation(ctx, conversationSid)
 		if errc != nil {
 			return nil, errors.Wrap(errc, "Could not get conversation details")
 		}
 		if conv.ChatServiceSid != nil {
 			settings.ChatServiceSid = conv.ChatServiceSid
-			if err := p.saveConversationSettings(&settings); err != nil {
+			if err := p.saveConversationSettings(settings); err != nil {
 				return nil, errors.Wrap(err, "Could not save updated conversation settings")
 			}
 		}
@@ -150,43 +160,116 @@ func (p *TwilioPlugin) getConversationSettings(conversationSid string) (*convers
 	if settings.Type == "" {
 		settings.Type = "channel"
 	}
-	return &settings, nil
+	return settings, nil
 }
 
-func (p *TwilioPlugin) getOrCreateConversationSettings(conversationSid string) (*conversationSettings, error) {
-	settings, err := p.getConversationSettings(conversationSid)
+// conversationLinkText describes where a conversation is linked to.
+func (p *TwilioPlugin) conversationLinkText(conversationSid string) string {
+	settings, err := p.store.Get(conversationSid)
+	if err != nil || settings == nil {
+		return "not linked"
+	}
+	channel, appErr := p.API.GetChannel(settings.ChannelId)
+	if appErr != nil {
+		return "linked to a missing channel"
+	}
+	if settings.Type == "post" {
+		return "linked to a thread in ~" + channel.Name
+	}
+	return "linked to ~" + channel.Name
+}
+
+func (p *TwilioPlugin) getOrCreateConversationSettings(ctx context.Context, accountSid, conversationSid, author, body string) (*conversationSettings, error) {
+	existing, err := p.store.Get(conversationSid)
 	if err != nil {
-		return p.createConversationSettings(conversationSid)
+		return nil, err
 	}
-	return settings, nil
+	if existing != nil {
+		return p.getConversationSettings(ctx, conversationSid)
+	}
+
+	// Messages of a new conversation can arrive at the same time on several
+	// nodes, only one of them may create the channel
+	unlock, err := p.lockConversation(ctx, conversationSid)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if existing, err := p.store.Get(conversationSid); err == nil && existing != nil {
+		return p.getConversationSettings(ctx, conversationSid)
+	}
+	return p.createConversationSettings(ctx, accountSid, conversationSid, author, body)
 }
 
-func (p *TwilioPlugin) saveConversationSettings(settings *conversationSettings) error {
-	data, err := json.Marshal(settings)
+// lockConversation takes a cluster wide lock on the conversation, held while
+// its channel or thread is created.
+func (p *TwilioPlugin) lockConversation(ctx context.Context, conversationSid string) (func(), error) {
+	mutex, err := cluster.NewMutex(p.API, conversationLockPrefix+conversationSid)
 	if err != nil {
-		return errors.Wrap(err, "Could not marshal conversation settings")
+		return nil, errors.Wrap(err, "Could not create conversation lock")
 	}
-	if err := p.API.KVSet("twilio-by-Co-"+settings.ConversationSid, data); err != nil {
-		return errors.Wrap(err, "Could not save conversation settings")
+	if err := mutex.LockWithContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "Could not lock conversation")
 	}
-	if settings.Type == "post" && settings.RootPostId != "" {
-		if err := p.API.KVSet("twilio-by-Po-"+settings.RootPostId, data); err != nil {
-			return errors.Wrap(err, "Could not save conversation settings by post")
+	return mutex.Unlock, nil
+}
+
+func conversationChannelName(conversationSid string) string {
+	return "twilio" + strings.ToLower(conversationSid)
+}
+
+// findConversationChannel looks for a channel created for the conversation,
+// first by its name and then by the conversation prop among the channels of
+// the bot, in case it was renamed. It returns nil when there is none.
+func (p *TwilioPlugin) findConversationChannel(teamId, botId, conversationSid string) (*model.Channel, error) {
+	if channel, appErr := p.API.GetChannelByName(teamId, conversationChannelName(conversationSid), true); appErr == nil {
+		if sid, ok := channel.Props["twilio_conversation_sid"].(string); ok && sid != conversationSid {
+			return nil, errors.Errorf("Channel %s belongs to conversation %s", channel.Name, sid)
 		}
-	} else {
-		if err := p.API.KVSet("twilio-by-Ch-"+settings.ChannelId, data); err != nil {
-			return errors.Wrap(err, "Could not save conversation settings by channel")
+		if channel.DeleteAt != 0 {
+			return nil, errors.Errorf("Channel %s of the conversation was archived", channel.Name)
 		}
+		return channel, nil
 	}
+
+	channels, appErr := p.API.GetChannelsForTeamForUser(teamId, botId, false)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Could not list channels of the bot")
+	}
+	for _, channel := range channels {
+		if sid, ok := channel.Props["twilio_conversation_sid"].(string); ok && sid == conversationSid {
+			return channel, nil
+		}
+	}
+	return nil, nil
+}
+
+// saveConversationSettings stores the settings and updates the linked channel
+// index of all nodes.
+func (p *TwilioPlugin) saveConversationSettings(settings *conversationSettings) error {
+	previous, err := p.store.Save(settings)
+	if err != nil {
+		return err
+	}
+	if previous == nil || conversationIndexKey(previous) != conversationIndexKey(settings) {
+		if previous != nil {
+			p.publishLinkChange(previous, true)
+		}
+		p.syncConversationLink(settings, false)
+	}
+	p.publishLinkChange(settings, false)
 	return nil
 }
 
 func (p *TwilioPlugin) deleteConversationSettings(settings *conversationSettings) {
-	p.API.KVDelete("twilio-by-Co-" + settings.ConversationSid)
-	if settings.ChannelId != "" {
-		p.API.KVDelete("twilio-by-Ch-" + settings.ChannelId)
+	deleted, err := p.store.Delete(settings.ConversationSid)
+	if err != nil {
+		p.API.LogError("Could not delete conversation settings", "sid", settings.ConversationSid, "error", err.Error())
+		return
 	}
-	if settings.RootPostId != "" {
-		p.API.KVDelete("twilio-by-Po-" + settings.RootPostId)
+	if deleted != nil {
+		p.publishLinkChange(deleted, true)
+		p.syncConversationLink(deleted, true)
 	}
 }
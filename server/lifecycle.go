@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	jobKeyPrefix  = "twilio-job-"
+	jobLockPrefix = "twilio-joblock-"
+
+	// How long a job waits for its lock before leaving it to the node that
+	// holds it.
+	jobLockTimeout = 2 * time.Second
+
+	// How long OnDeactivate waits for in-flight work and cancelled jobs before
+	// giving up on them.
+	shutdownTimeout = 15 * time.Second
+
+	jobSetupNumber     = "setup-number"
+	jobRepointWebhooks = "repoint-webhooks"
+	jobDoctorMappings  = "doctor-mappings"
+	jobRebuildMappings = "rebuild-mappings"
+)
+
+// backgroundJob is long running work started from a command. Jobs are stored
+// in the KV store until they finish, so work cut short by a deactivation is
+// started again on the next activation.
+type backgroundJob struct {
+	Id          string `json:"id"`
+	Kind        string `json:"kind"`
+	AccountSid  string `json:"account_sid,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+	OldWebhook  string `json:"old_webhook,omitempty"`
+	Fix         bool   `json:"fix,omitempty"`
+	Scan        bool   `json:"scan,omitempty"`
+	UserId      string `json:"user_id"`
+	ChannelId   string `json:"channel_id"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func (p *TwilioPlugin) startLifecycle() {
+	p.lifecycleLock.Lock()
+	defer p.lifecycleLock.Unlock()
+	p.lifecycleCtx, p.lifecycleCancel = context.WithCancel(context.Background())
+	p.jobsCtx, p.jobsCancel = context.WithCancel(p.lifecycleCtx)
+	p.lifecycleStopping = false
+}
+
+// lifecycleContext is cancelled when the plugin is deactivated.
+func (p *TwilioPlugin) lifecycleContext() context.Context {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.lifecycleCtx == nil {
+		return context.Background()
+	}
+	return p.lifecycleCtx
+}
+
+// jobsContext is cancelled as soon as the plugin starts deactivating.
+func (p *TwilioPlugin) jobsContext() context.Context {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.jobsCtx == nil {
+		return context.Background()
+	}
+	return p.jobsCtx
+}
+
+// trackWork registers in-flight work that deactivation should wait for. It
+// returns false when the plugin is already shutting down.
+func (p *TwilioPlugin) trackWork() (func(), bool) {
+	return p.track(&p.inflight)
+}
+
+// trackJob registers a running background job.
+func (p *TwilioPlugin) trackJob() (func(), bool) {
+	return p.track(&p.jobs)
+}
+
+// track adds to the wait group unless the plugin is shutting down. The lock
+// keeps the check and the registration together, so no work is added once
+// OnDeactivate has started waiting.
+func (p *TwilioPlugin) track(group *sync.WaitGroup) (func(), bool) {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.lifecycleStopping || (p.lifecycleCtx != nil && p.lifecycleCtx.Err() != nil) {
+		return func() {}, false
+	}
+	group.Add(1)
+	return group.Done, true
+}
+
+// OnDeactivate stops accepting new work and cancels the background jobs,
+// which resume on the next activation. Messages and webhooks in flight get
+// until the shutdown timeout to finish before they are cancelled too.
+func (p *TwilioPlugin) OnDeactivate() error {
+	p.lifecycleLock.Lock()
+	p.lifecycleStopping = true
+	cancel, cancelJobs := p.lifecycleCancel, p.jobsCancel
+	p.lifecycleLock.Unlock()
+
+	if cancelJobs != nil {
+		cancelJobs()
+	}
+	deadline := time.After(shutdownTimeout)
+	if !waitBefore(&p.inflight, deadline) {
+		p.API.LogWarn("Timed out waiting for in-flight work")
+	}
+	if cancel != nil {
+		cancel()
+	}
+	if !waitBefore(&p.jobs, deadline) {
+		p.API.LogWarn("Timed out waiting for background jobs to stop, they resume on the next activation")
+	}
+	return nil
+}
+
+// waitBefore waits for the group until the deadline, returning false when
+// the deadline came first.
+func waitBefore(group *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// startJob records the job and runs it in the background.
+func (p *TwilioPlugin) startJob(job *backgroundJob) error {
+	if job.Id == "" {
+		job.Id = model.NewId()
+		job.CreatedAt = model.GetMillis()
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal job")
+	}
+	if err := p.API.KVSet(jobKeyPrefix+job.Id, data); err != nil {
+		return errors.Wrap(err, "Could not save job")
+	}
+
+	done, ok := p.trackJob()
+	if !ok {
+		return errors.New("plugin is shutting down, the job will run on the next activation")
+	}
+	go func() {
+		defer done()
+		ctx := p.jobsContext()
+		unlock, ok := p.lockJob(ctx, job)
+		if !ok {
+			return
+		}
+		defer unlock()
+		// Another node may have finished the job while we waited for the lock
+		if data, appErr := p.API.KVGet(jobKeyPrefix + job.Id); appErr != nil || data == nil {
+			return
+		}
+		p.runJob(ctx, job)
+		if ctx.Err() != nil {
+			p.API.LogInfo("Job interrupted by deactivation", "job_id", job.Id, "kind", job.Kind)
+			return
+		}
+		if err := p.API.KVDelete(jobKeyPrefix + job.Id); err != nil {
+			p.API.LogError("Could not delete finished job", "job_id", job.Id, "error", err.Error())
+		}
+	}()
+	return nil
+}
+
+// lockJob takes the cluster wide lock of the job, so a job resumed by every
+// node on activation only runs on one of them. It returns false when another
+// node holds the lock.
+func (p *TwilioPlugin) lockJob(ctx context.Context, job *backgroundJob) (func(), bool) {
+	mutex, err := cluster.NewMutex(p.API, jobLockPrefix+job.Id)
+	if err != nil {
+		p.API.LogError("Could not create job lock", "job_id", job.Id, "error", err.Error())
+		return nil, false
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, jobLockTimeout)
+	defer cancel()
+	if err := mutex.LockWithContext(lockCtx); err != nil {
+		p.API.LogInfo("Job is running on another node", "job_id", job.Id, "kind", job.Kind)
+		return nil, false
+	}
+	return mutex.Unlock, true
+}
+
+func (p *TwilioPlugin) runJob(ctx context.Context, job *backgroundJob) {
+	args := &model.CommandArgs{
+		UserId:    job.UserId,
+		ChannelId: job.ChannelId,
+	}
+	switch job.Kind {
+	case jobSetupNumber:
+		p.getTwilioClient(job.AccountSid).SetupPhoneNumberAsync(ctx, job.PhoneNumber, job.Scan, args)
+	case jobRepointWebhooks:
+		p.repointWebhooksAsync(ctx, p.jobTwilioClients(job), job.OldWebhook, args)
+	case jobDoctorMappings:
+		p.doctorMappingsAsync(ctx, p.jobTwilioClients(job), job.Fix, args)
+	case jobRebuildMappings:
+		p.rebuildMappingsAsync(ctx, p.jobTwilioClients(job), args)
+	default:
+		p.API.LogWarn("Unknown job kind", "job_id", job.Id, "kind", job.Kind)
+	}
+}
+
+// jobTwilioClients returns the client of the job account, or of every
+// account when the job is not limited to one.
+func (p *TwilioPlugin) jobTwilioClients(job *backgroundJob) []ITwilioClient {
+	if job.AccountSid != "" {
+		return []ITwilioClient{p.getTwilioClient(job.AccountSid)}
+	}
+	var clients []ITwilioClient
+	for _, account := range p.getConfiguration().Accounts {
+		clients = append(clients, p.getTwilioClient(account.AccountSid))
+	}
+	return clients
+}
+
+// resumeJobs starts the jobs left unfinished by the last deactivation. Every
+// node resumes them on activation, the job lock makes sure each runs once.
+func (p *TwilioPlugin) resumeJobs() {
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, 100)
+		if appErr != nil {
+			p.API.LogError("Could not list jobs", "error", appErr.Error())
+			return
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, jobKeyPrefix) {
+				continue
+			}
+			data, appErr := p.API.KVGet(key)
+			if appErr != nil || data == nil {
+				continue
+			}
+			var job backgroundJob
+			if err := json.Unmarshal(data, &job); err != nil {
+				p.API.LogError("Could not unmarshal job", "key", key, "error", err.Error())
+				continue
+			}
+			p.API.LogInfo("Resuming job", "job_id", job.Id, "kind", job.Kind)
+			if err := p.startJob(&job); err != nil {
+				p.API.LogError("Could not resume job", "job_id", job.Id, "error", err.Error())
+			}
+		}
+		if len(keys) < 100 {
+			return
+		}
+	}
+}
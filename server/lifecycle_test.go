@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnDeactivateCancelsJobs(t *testing.T) {
+	p := &TwilioPlugin{}
+	p.SetAPI(newTestKVAPI())
+	p.startLifecycle()
+
+	done, ok := p.trackJob()
+	if !ok {
+		t.Fatal("trackJob refused a job before deactivation")
+	}
+	ctx := p.jobsContext()
+	go func() {
+		defer done()
+		<-ctx.Done()
+	}()
+
+	started := time.Now()
+	if err := p.OnDeactivate(); err != nil {
+		t.Fatalf("OnDeactivate failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("OnDeactivate waited %s for a cancelled job", elapsed)
+	}
+	if _, ok := p.trackJob(); ok {
+		t.Fatal("trackJob accepted a job after deactivation")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+const (
+	conversationLockPrefix = "twilio-lock-Co-"
+
+	linkChangedEventId = "twilio_link_changed"
+)
+
+// linkIndex keeps the linked channels and threads in memory, so posts in
+// channels that are not linked are skipped without asking the server.
+type linkIndex struct {
+	lock     sync.RWMutex
+	channels map[string]*conversationSettings
+	posts    map[string]*conversationSettings
+}
+
+func newLinkIndex() *linkIndex {
+	return &linkIndex{
+		channels: map[string]*conversationSettings{},
+		posts:    map[string]*conversationSettings{},
+	}
+}
+
+func (i *linkIndex) set(settings *conversationSettings) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if settings.Type == "post" && settings.RootPostId != "" {
+		i.posts[settings.RootPostId] = settings
+	} else if settings.ChannelId != "" {
+		i.channels[settings.ChannelId] = settings
+	}
+}
+
+func (i *linkIndex) remove(settings *conversationSettings) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if settings.RootPostId != "" {
+		delete(i.posts, settings.RootPostId)
+	}
+	if settings.ChannelId != "" && settings.Type != "post" {
+		if existing, ok := i.channels[settings.ChannelId]; ok && existing.ConversationSid == settings.ConversationSid {
+			delete(i.channels, settings.ChannelId)
+		}
+	}
+}
+
+// lookup returns the settings a post belongs to, the thread link taking
+// precedence over the channel link.
+func (i *linkIndex) lookup(channelId, rootId string) *conversationSettings {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	if rootId != "" {
+		if settings, ok := i.posts[rootId]; ok {
+			return settings
+		}
+	}
+	return i.channels[channelId]
+}
+
+// linkChangedEvent tells the other cluster nodes about a link that was saved
+// or removed.
+type linkChangedEvent struct {
+	Removed  bool                  `json:"removed"`
+	Settings *conversationSettings `json:"settings"`
+}
+
+// loadLinkIndex fills the index from the stored conversation settings.
+func (p *TwilioPlugin) loadLinkIndex() error {
+	all, err := p.store.List()
+	if err != nil {
+		return err
+	}
+	for _, settings := range all {
+		p.links.set(settings)
+	}
+	return nil
+}
+
+// publishLinkChange updates the local index and the index of the other nodes.
+func (p *TwilioPlugin) publishLinkChange(settings *conversationSettings, removed bool) {
+	if p.links == nil {
+		return
+	}
+	if removed {
+		p.links.remove(settings)
+	} else {
+		p.links.set(settings)
+	}
+
+	data, err := json.Marshal(&linkChangedEvent{Removed: removed, Settings: settings})
+	if err != nil {
+		p.API.LogError("Could not marshal link change", "error", err.Error())
+		return
+	}
+	if err := p.API.PublishPluginClusterEvent(model.PluginClusterEvent{
+		Id:   linkChangedEventId,
+		Data: data,
+	}, model.PluginClusterEventSendOptions{
+		SendType: model.PluginClusterEventSendTypeReliable,
+	}); err != nil {
+		p.API.LogError("Could not publish link change", "error", err.Error())
+	}
+}
+
+func (p *TwilioPlugin) OnPluginClusterEvent(c *plugin.Context, ev model.PluginClusterEvent) {
+	if ev.Id != linkChangedEventId || p.links == nil {
+		return
+	}
+	var event linkChangedEvent
+	if err := json.Unmarshal(ev.Data, &event); err != nil || event.Settings == nil {
+		p.API.LogError("Could not unmarshal link change event")
+		return
+	}
+	if event.Removed {
+		p.links.remove(event.Settings)
+	} else {
+		p.links.set(event.Settings)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// The number index keeps the conversations each of our numbers takes
+	// part in. Twilio only looks up conversations by the customer address,
+	// so the index is filled whenever the participants of a conversation are
+	// fetched, a participant is added or the plugin starts a conversation.
+	// Every conversation has its own key under the prefix of the number, so
+	// busy numbers do not rewrite one growing list. The value is the Unix
+	// time of the last activity seen on the conversation.
+	numberIndexPrefix = "twilio-num-"
+
+	// Attempts of an activity update racing with another one on the same
+	// conversation
+	numberIndexRetries = 5
+
+	// Set once every conversation of a number was scanned into the index,
+	// until then lookups of the number scan the account.
+	numberScannedPrefix = "twilio-numscan-"
+)
+
+func numberIndexKeyPrefix(accountSid, number string) string {
+	return numberIndexPrefix + accountSid + "-" + number + "-"
+}
+
+func numberScannedKey(accountSid, number string) string {
+	return numberScannedPrefix + accountSid + "-" + number
+}
+
+// numberConversations returns the SIDs of the indexed conversations on our
+// number, most recently active first.
+func (p *TwilioPlugin) numberConversations(accountSid, number string) ([]string, error) {
+	prefix := numberIndexKeyPrefix(accountSid, number)
+	type entry struct {
+		sid      string
+		activity int64
+	}
+	var entries []entry
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, 100)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not list number index")
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			data, appErr := p.API.KVGet(key)
+			if appErr != nil {
+				return nil, errors.Wrap(appErr, "Could not get number index")
+			}
+			if data == nil {
+				continue
+			}
+			activity, _ := strconv.ParseInt(string(data), 10, 64)
+			entries = append(entries, entry{sid: strings.TrimPrefix(key, prefix), activity: activity})
+		}
+		if len(keys) < 100 {
+			break
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].activity > entries[j].activity
+	})
+	sids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		sids = append(sids, entry.sid)
+	}
+	return sids, nil
+}
+
+// indexConversationNumber records that the conversation is on our number. A
+// conversation already in the index keeps its entry.
+func (p *TwilioPlugin) indexConversationNumber(accountSid, number, conversationSid string) {
+	if accountSid == "" || number == "" || conversationSid == "" {
+		return
+	}
+	key := numberIndexKeyPrefix(accountSid, number) + conversationSid
+	activity := []byte(strconv.FormatInt(time.Now().Unix(), 10))
+	if _, appErr := p.API.KVCompareAndSet(key, nil, activity); appErr != nil {
+		p.API.LogWarn("Could not index conversation number", "sid", conversationSid, "number", number, "error", appErr.Error())
+	}
+}
+
+// touchConversationNumber records activity on a conversation of our number,
+// moving it up in the index. Older activity than the one recorded is ignored.
+func (p *TwilioPlugin) touchConversationNumber(accountSid, number, conversationSid string, activity time.Time) {
+	if accountSid == "" || number == "" || conversationSid == "" || activity.IsZero() {
+		return
+	}
+	key := numberIndexKeyPrefix(accountSid, number) + conversationSid
+	updated := []byte(strconv.FormatInt(activity.Unix(), 10))
+	for attempt := 0; attempt < numberIndexRetries; attempt++ {
+		previous, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			p.API.LogWarn("Could not get number index", "sid", conversationSid, "number", number, "error", appErr.Error())
+			return
+		}
+		if recorded, err := strconv.ParseInt(string(previous), 10, 64); err == nil && recorded >= activity.Unix() {
+			return
+		}
+		saved, appErr := p.API.KVCompareAndSet(key, previous, updated)
+		if appErr != nil {
+			p.API.LogWarn("Could not update number index", "sid", conversationSid, "number", number, "error", appErr.Error())
+			return
+		}
+		if saved {
+			return
+		}
+	}
+}
+
+// noteConversationActivity moves a conversation that just had a message up
+// in the index of our number.
+func (p *TwilioPlugin) noteConversationActivity(ctx context.Context, accountSid, conversationSid string) {
+	participants, err := p.getTwilioClient(accountSid).GetConversationParticipants(ctx, conversationSid)
+	if err != nil {
+		p.API.LogWarn("Could not get participants to update the number index", "sid", conversationSid, "error", err.Error())
+		return
+	}
+	p.touchConversationNumber(accountSid, proxyAddress(participants), conversationSid, time.Now())
+}
+
+// unindexConversationNumber drops a conversation that no longer exists from
+// the index of our number.
+func (p *TwilioPlugin) unindexConversationNumber(accountSid, number, conversationSid string) {
+	if appErr := p.API.KVDelete(numberIndexKeyPrefix(accountSid, number) + conversationSid); appErr != nil {
+		p.API.LogWarn("Could not remove conversation from number index", "sid", conversationSid, "number", number, "error", appErr.Error())
+	}
+}
+
+// numberScanned tells whether the index of our number was completed by a
+// scan of the account.
+func (p *TwilioPlugin) numberScanned(accountSid, number string) (bool, error) {
+	data, appErr := p.API.KVGet(numberScannedKey(accountSid, number))
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "Could not get number scan state")
+	}
+	return data != nil, nil
+}
+
+func (p *TwilioPlugin) setNumberScanned(accountSid, number string) {
+	if appErr := p.API.KVSet(numberScannedKey(accountSid, number), []byte("true")); appErr != nil {
+		p.API.LogWarn("Could not save number scan state", "number", number, "error", appErr.Error())
+	}
+}
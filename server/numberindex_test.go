@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNumberIndex(t *testing.T) {
+	p := &TwilioPlugin{}
+	api := newTestKVAPI()
+	p.SetAPI(api)
+
+	p.indexConversationNumber("AC1", "+1555", "CH1")
+	p.indexConversationNumber("AC1", "+1555", "CH2")
+	p.indexConversationNumber("AC1", "+1555", "CH1")
+	p.indexConversationNumber("AC1", "+1666", "CH3")
+	p.indexConversationNumber("AC2", "+1555", "CH4")
+	api.KVSet(numberIndexKeyPrefix("AC1", "+1555")+"CH1", []byte("100"))
+	api.KVSet(numberIndexKeyPrefix("AC1", "+1555")+"CH2", []byte("200"))
+
+	sids, err := p.numberConversations("AC1", "+1555")
+	if err != nil {
+		t.Fatalf("numberConversations failed: %v", err)
+	}
+	if want := []string{"CH2", "CH1"}; !reflect.DeepEqual(sids, want) {
+		t.Fatalf("numberConversations = %v, want %v", sids, want)
+	}
+
+	p.touchConversationNumber("AC1", "+1555", "CH1", time.Unix(300, 0))
+	p.touchConversationNumber("AC1", "+1555", "CH2", time.Unix(150, 0))
+	if sids, _ = p.numberConversations("AC1", "+1555"); !reflect.DeepEqual(sids, []string{"CH1", "CH2"}) {
+		t.Fatalf("numberConversations after new activity on CH1 = %v, want [CH1 CH2]", sids)
+	}
+	if data, _ := api.KVGet(numberIndexKeyPrefix("AC1", "+1555") + "CH2"); string(data) != "200" {
+		t.Fatalf("older activity changed CH2 to %s, want 200", data)
+	}
+
+	p.unindexConversationNumber("AC1", "+1555", "CH2")
+	if sids, _ = p.numberConversations("AC1", "+1555"); !reflect.DeepEqual(sids, []string{"CH1"}) {
+		t.Fatalf("numberConversations after removing CH2 = %v, want [CH1]", sids)
+	}
+
+	if scanned, _ := p.numberScanned("AC1", "+1555"); scanned {
+		t.Fatal("number is scanned before any scan")
+	}
+	p.setNumberScanned("AC1", "+1555")
+	if scanned, _ := p.numberScanned("AC1", "+1555"); !scanned {
+		t.Fatal("number is not scanned after the scan")
+	}
+	if sids, _ = p.numberConversations("AC1", "+1555"); !reflect.DeepEqual(sids, []string{"CH1"}) {
+		t.Fatalf("numberConversations after the scan = %v, want [CH1]", sids)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const numberAssignmentsKey = "twilio-number-assignments"
+
+// numberAssignment maps one of our Twilio numbers, or a messaging service
+// SID, to the team and members that new conversations on it go to.
+type numberAssignment struct {
+	Number  string   `json:"number"`
+	TeamId  string   `json:"team_id"`
+	UserIds []string `json:"user_ids,omitempty"`
+}
+
+func (p *TwilioPlugin) getNumberAssignments() (map[string]*numberAssignment, error) {
+	assignments := map[string]*numberAssignment{}
+	data, err := p.API.KVGet(numberAssignmentsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get number assignments")
+	}
+	if data == nil {
+		return assignments, nil
+	}
+	if err := json.Unmarshal(data, &assignments); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal number assignments")
+	}
+	return assignments, nil
+}
+
+func (p *TwilioPlugin) saveNumberAssignments(assignments map[string]*numberAssignment) error {
+	data, err := json.Marshal(assignments)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal number assignments")
+	}
+	if err := p.API.KVSet(numberAssignmentsKey, data); err != nil {
+		return errors.Wrap(err, "Could not save number assignments")
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) assignNumber(assignment *numberAssignment) error {
+	assignments, err := p.getNumberAssignments()
+	if err != nil {
+		return err
+	}
+	assignments[assignment.Number] = assignment
+	return p.saveNumberAssignments(assignments)
+}
+
+func (p *TwilioPlugin) unassignNumber(number string) (bool, error) {
+	assignments, err := p.getNumberAssignments()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := assignments[number]; !ok {
+		return false, nil
+	}
+	delete(assignments, number)
+	return true, p.saveNumberAssignments(assignments)
+}
+
+// findNumberAssignment looks up the assignment for our number first and then
+// for the messaging service the conversation belongs to.
+func (p *TwilioPlugin) findNumberAssignment(number, messagingServiceSid string) (*numberAssignment, error) {
+	assignments, err := p.getNumberAssignments()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{number, messagingServiceSid} {
+		if key == "" {
+			continue
+		}
+		for assigned, assignment := range assignments {
+			if strings.EqualFold(assigned, key) {
+				return assignment, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// numberRoute is where new conversations on our number go without a routing
+// rule: the team of its assignment, or the configured team when the number is
+// not assigned. The configured users are added unless the assignment names
+// its own.
+func (p *TwilioPlugin) numberRoute(number, messagingServiceSid string) (*routingDecision, error) {
+	configuration := p.getConfiguration()
+	decision := &routingDecision{
+		TeamId: configuration.TeamId,
+		Mode:   routeModeChannel,
+	}
+	if configuration.AutoAddUsersIds != nil {
+		decision.UserIds = append(decision.UserIds, *configuration.AutoAddUsersIds...)
+	}
+
+	assignment, err := p.findNumberAssignment(number, messagingServiceSid)
+	if err != nil {
+		return nil, err
+	}
+	if assignment != nil {
+		decision.TeamId = assignment.TeamId
+		if len(assignment.UserIds) > 0 {
+			decision.UserIds = append([]string{}, assignment.UserIds...)
+		}
+	}
+	return decision, nil
+}
+
+// lookupUserIds returns the IDs of the comma-separated usernames, or the
+// first username that does not exist.
+func (p *TwilioPlugin) lookupUserIds(usernames string) ([]string, string) {
+	var userIds []string
+	for _, username := range strings.Split(usernames, ",") {
+		username = strings.TrimPrefix(strings.TrimSpace(username), "@")
+		if username == "" {
+			continue
+		}
+		user, appErr := p.API.GetUserByUsername(username)
+		if appErr != nil {
+			return nil, username
+		}
+		userIds = append(userIds, user.Id)
+	}
+	return userIds, ""
+}
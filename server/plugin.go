@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost/server/public/model"
@@ -10,6 +12,9 @@ import (
 	"github.com/mattermost/mattermost/server/public/pluginapi"
 )
 
+// How long forwarding a post with its files to Twilio may take.
+const postForwardTimeout = 2 * time.Minute
+
 type TwilioPlugin struct {
 	plugin.MattermostPlugin
 
@@ -20,7 +25,28 @@ type TwilioPlugin struct {
 	configuration     *configuration
 	bot               *twilioBot
 	commandHandler    Command
+	twilioLock        sync.RWMutex
 	twilio            ITwilioClient
+	twilioClients     map[string]ITwilioClient
+
+	// Cancelled on deactivation, in-flight work is tracked so deactivation can
+	// wait for it. No new work is accepted once stopping is set. Background
+	// jobs have their own context, cancelled first as they resume on the next
+	// activation.
+	lifecycleLock     sync.RWMutex
+	lifecycleCtx      context.Context
+	lifecycleCancel   context.CancelFunc
+	lifecycleStopping bool
+	inflight          sync.WaitGroup
+	jobsCtx           context.Context
+	jobsCancel        context.CancelFunc
+	jobs              sync.WaitGroup
+
+	links *linkIndex
+	store ConversationStore
+
+	// Serializes the writes of links to the conversation attributes
+	linkSyncLock sync.Mutex
 }
 
 func (p *TwilioPlugin) OnInstall(c *plugin.Context, event model.OnInstallEvent) error {
@@ -31,6 +57,8 @@ func (p *TwilioPlugin) OnInstall(c *plugin.Context, event model.OnInstallEvent)
 }
 
 func (p *TwilioPlugin) OnActivate() error {
+	p.startLifecycle()
+	p.links = newLinkIndex()
 	p.client = pluginapi.NewClient(p.API, p.Driver)
 	p.initializeRouter()
 	p.commandHandler = NewCommandHandler(p.client)
@@ -39,7 +67,16 @@ func (p *TwilioPlugin) OnActivate() error {
 		return err
 	}
 	p.bot = bot
-	p.twilio = NewTwilioClient(p)
+	p.initializeTwilioClients()
+	p.store = newKVConversationStore(p.API)
+	if err := p.store.Migrate(); err != nil {
+		return err
+	}
+	if err := p.loadLinkIndex(); err != nil {
+		return err
+	}
+	p.checkWebhookURL()
+	p.resumeJobs()
 	return nil
 }
 
@@ -57,7 +94,12 @@ func (p *TwilioPlugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post)
 		return
 	}
 
-	configuration := p.getConfiguration()
+	// Most posts are in channels that are not linked, skip them before asking
+	// the server for anything
+	settings := p.links.lookup(post.ChannelId, post.RootId)
+	if settings == nil || settings.ConversationSid == "" {
+		return
+	}
 
 	p.API.LogDebug("Message posted", "post", post)
 	channel, err := p.API.GetChannel(post.ChannelId)
@@ -66,20 +108,30 @@ func (p *TwilioPlugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post)
 		return
 	}
 	p.API.LogDebug("Channel info", "channel", channel)
-	if channel.TeamId != configuration.TeamId {
-		return
-	}
 
-	sid, errs := p.getChannelConversationSid(channel.Id)
-	if errs != nil || sid == "" {
+	// Only forward from the team the conversation was assigned to
+	if settings.TeamId != channel.TeamId {
 		return
 	}
+	sid := settings.ConversationSid
+	twilioClient := p.getSettingsTwilioClient(settings)
 	p.API.LogDebug("Found conversation sid", "sid", sid)
 	if sentByPlugin, oks := post.GetProp("sent_by_twilio").(bool); oks && sentByPlugin {
 		return
 	}
+	done, ok := p.trackWork()
+	if !ok {
+		p.API.LogWarn("Plugin is shutting down, message not sent to conversation", "sid", sid, "post_id", post.Id)
+		return
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(p.lifecycleContext(), postForwardTimeout)
+	defer cancel()
+
 	p.API.LogDebug("Sending message to conversation", "sid", sid, "message", post.Message)
-	p.twilio.SendMessageToConversation(sid, post.Message)
+	if err := twilioClient.SendMessageToConversation(ctx, sid, post.Message); err != nil {
+		p.API.LogError("Could not send message to conversation", "sid", sid, "post_id", post.Id, "error", err.Error())
+	}
 
 	if len(post.FileIds) > 0 {
 		for _, fileId := range post.FileIds {
@@ -94,7 +146,9 @@ func (p *TwilioPlugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post)
 				continue
 			}
 			p.API.LogDebug("Sending media to conversation", "sid", sid, "fileName", fileInfo.Name)
-			p.twilio.SendMediaToConversation(sid, fileInfo, filedata)
+			if err := twilioClient.SendMediaToConversation(ctx, sid, fileInfo, filedata); err != nil {
+				p.API.LogError("Could not send media to conversation", "sid", sid, "file_id", fileId, "error", err.Error())
+			}
 		}
 	}
 
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+// Key of the conversation attributes the link to Mattermost is kept under
+const conversationLinkAttribute = "mattermost"
+
+// conversationLink is kept in the attributes of a linked Twilio conversation,
+// so the mapping can be restored when the KV store is lost.
+type conversationLink struct {
+	TeamId     string `json:"team_id"`
+	ChannelId  string `json:"channel_id"`
+	RootPostId string `json:"root_post_id,omitempty"`
+}
+
+func newConversationLink(settings *conversationSettings) *conversationLink {
+	link := &conversationLink{TeamId: settings.TeamId, ChannelId: settings.ChannelId}
+	if settings.Type == "post" {
+		link.RootPostId = settings.RootPostId
+	}
+	return link
+}
+
+func conversationAttributes(conv *twiliov1.ConversationsV1Conversation) (map[string]interface{}, error) {
+	attributes := map[string]interface{}{}
+	if conv.Attributes == nil || strings.TrimSpace(*conv.Attributes) == "" {
+		return attributes, nil
+	}
+	if err := json.Unmarshal([]byte(*conv.Attributes), &attributes); err != nil {
+		return nil, errors.Wrap(err, "Could not parse conversation attributes")
+	}
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	return attributes, nil
+}
+
+// linkFromAttributes returns the link kept in the conversation attributes, or
+// nil when there is none.
+func linkFromAttributes(conv *twiliov1.ConversationsV1Conversation) *conversationLink {
+	attributes, err := conversationAttributes(conv)
+	if err != nil {
+		return nil
+	}
+	raw, ok := attributes[conversationLinkAttribute]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	var link conversationLink
+	if err := json.Unmarshal(data, &link); err != nil || link.ChannelId == "" {
+		return nil
+	}
+	return &link
+}
+
+// writeConversationLink records the mapping in the attributes of the Twilio
+// conversation, or drops it from them when the mapping was removed. Other
+// attributes are kept.
+func (p *TwilioPlugin) writeConversationLink(ctx context.Context, settings *conversationSettings, removed bool) error {
+	twilioClient := p.getSettingsTwilioClient(settings)
+	conv, err := twilioClient.GetConversation(withCacheRefresh(ctx), settings.ConversationSid)
+	if err != nil {
+		return err
+	}
+	attributes, err := conversationAttributes(conv)
+	if err != nil {
+		return err
+	}
+
+	link := newConversationLink(settings)
+	current := linkFromAttributes(conv)
+	if removed {
+		if current == nil || *current != *link {
+			return nil
+		}
+		delete(attributes, conversationLinkAttribute)
+	} else {
+		if current != nil && *current == *link {
+			return nil
+		}
+		attributes[conversationLinkAttribute] = link
+	}
+
+	data, err := json.Marshal(attributes)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal conversation attributes")
+	}
+	return twilioClient.SetConversationAttributes(ctx, settings.ConversationSid, string(data))
+}
+
+// syncConversationLink writes the mapping to Twilio in the background, as
+// mappings are saved in places that should not wait for Twilio.
+func (p *TwilioPlugin) syncConversationLink(settings *conversationSettings, removed bool) {
+	done, ok := p.trackWork()
+	if !ok {
+		return
+	}
+	go func() {
+		defer done()
+		ctx, cancel := context.WithTimeout(p.lifecycleContext(), commandTimeout)
+		defer cancel()
+		p.linkSyncLock.Lock()
+		defer p.linkSyncLock.Unlock()
+		if err := p.writeConversationLink(ctx, settings, removed); err != nil {
+			p.API.LogWarn("Could not write link to conversation attributes", "sid", settings.ConversationSid, "error", err.Error())
+		}
+	}()
+}
+
+// settingsFromLink turns the link kept in the conversation attributes back
+// into settings, when the channel or thread it points to is still there.
+func (p *TwilioPlugin) settingsFromLink(conv *twiliov1.ConversationsV1Conversation, accountSid string) *conversationSettings {
+	link := linkFromAttributes(conv)
+	if link == nil || conv.Sid == nil {
+		return nil
+	}
+	channel, appErr := p.API.GetChannel(link.ChannelId)
+	if appErr != nil || channel.DeleteAt != 0 {
+		return nil
+	}
+	settings := &conversationSettings{
+		ConversationSid: *conv.Sid,
+		TeamId:          channel.TeamId,
+		ChannelId:       channel.Id,
+		ChatServiceSid:  conv.ChatServiceSid,
+		AccountSid:      accountSid,
+	}
+	if link.RootPostId != "" {
+		if _, appErr := p.API.GetPost(link.RootPostId); appErr != nil {
+			return nil
+		}
+		settings.Type = "post"
+		settings.RootPostId = link.RootPostId
+	}
+	return settings
+}
+
+// rebuildMappingsAsync restores lost mappings and reports the result to the
+// user that ran the command.
+func (p *TwilioPlugin) rebuildMappingsAsync(ctx context.Context, clients []ITwilioClient, args *model.CommandArgs) {
+	message := ""
+	fromAttributes, recorded := 0, 0
+	for _, twilioClient := range clients {
+		restored, written, err := p.rebuildFromAttributes(ctx, twilioClient)
+		fromAttributes += restored
+		recorded += written
+		if err != nil {
+			message += fmt.Sprintf("Error reading the conversations of account %s: %s\n", twilioClient.Account().Name, twilioErrorText(err))
+		}
+	}
+	fromProps, err := p.rebuildFromChannelProps(ctx, clients)
+	if err != nil {
+		message += fmt.Sprintf("Error reading the conversation channels: %s\n", twilioErrorText(err))
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	message += fmt.Sprintf("Restored %d mappings from Twilio conversation attributes and %d from channel props. Recorded %d existing mappings in Twilio.", fromAttributes, fromProps, recorded)
+
+	bot, err := p.getBot()
+	if err != nil {
+		p.API.LogError("Could not get bot", "error", err.Error())
+		return
+	}
+	p.API.SendEphemeralPost(args.UserId, &model.Post{
+		UserId:    bot.UserId,
+		ChannelId: args.ChannelId,
+		Message:   message,
+	})
+}
+
+// rebuildFromAttributes goes through all conversations of the account,
+// restores the mappings kept in their attributes and records existing
+// mappings the attributes do not know about yet. It returns how many were
+// restored and recorded.
+func (p *TwilioPlugin) rebuildFromAttributes(ctx context.Context, twilioClient ITwilioClient) (int, int, error) {
+	restored, recorded := 0, 0
+	accountSid := twilioClient.Account().AccountSid
+	cursor := ""
+	for {
+		page, err := twilioClient.ListConversationsPage(ctx, &conversationFilter{}, cursor, maxConversationPageSize)
+		if err != nil {
+			return restored, recorded, err
+		}
+		for i := range page.Conversations {
+			conv := &page.Conversations[i]
+			if conv.Sid == nil {
+				continue
+			}
+			existing, err := p.store.Get(*conv.Sid)
+			if err != nil {
+				return restored, recorded, err
+			}
+			if existing != nil {
+				if link := linkFromAttributes(conv); link == nil || *link != *newConversationLink(existing) {
+					if err := p.writeConversationLink(ctx, existing, false); err != nil {
+						p.API.LogWarn("Could not write link to conversation attributes", "sid", *conv.Sid, "error", err.Error())
+						continue
+					}
+					recorded++
+				}
+				continue
+			}
+			settings := p.settingsFromLink(conv, accountSid)
+			if settings == nil {
+				continue
+			}
+			if err := p.saveConversationSettings(settings); err != nil {
+				return restored, recorded, err
+			}
+			restored++
+		}
+		if page.NextPage == "" {
+			return restored, recorded, nil
+		}
+		cursor = page.NextPage
+	}
+}
+
+// rebuildFromChannelProps maps the channels created for a conversation back
+// to it when the conversation is still in Twilio. It returns how many were
+// restored.
+func (p *TwilioPlugin) rebuildFromChannelProps(ctx context.Context, clients []ITwilioClient) (int, error) {
+	unmapped, err := p.unmappedConversationChannels()
+	if err != nil {
+		return 0, err
+	}
+	results := fetchAll(ctx, unmapped, func(ctx context.Context, channel *model.Channel) (bool, error) {
+		conversationSid, _ := channel.Props["twilio_conversation_sid"].(string)
+		twilioClient, conv, err := findConversationClient(ctx, clients, conversationSid)
+		if err != nil || conv == nil {
+			return false, err
+		}
+		err = p.saveConversationSettings(&conversationSettings{
+			ConversationSid: conversationSid,
+			TeamId:          channel.TeamId,
+			ChannelId:       channel.Id,
+			ChatServiceSid:  conv.ChatServiceSid,
+			AccountSid:      twilioClient.Account().AccountSid,
+		})
+		return err == nil, err
+	})
+	restored := 0
+	for _, result := range results {
+		if result.Value {
+			restored++
+		}
+	}
+	return restored, fetchErrors(results)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+	twiliov1 "github.com/twilio/twilio-go/rest/conversations/v1"
+)
+
+const (
+	// Most conversations offered to pick from when an argument is ambiguous
+	maxConversationChoices = 10
+
+	// Pages of conversations searched for a friendly name, Twilio cannot
+	// filter by it
+	maxNamedConversationPages = 5
+
+	// Called by the buttons offering the conversations to pick from
+	conversationPickActionPath = "/conversation/pick"
+	conversationPickActionURL  = "/plugins/sx.paul.mattermost.twilio" + conversationPickActionPath
+)
+
+// resolveConversation finds the conversations a command argument refers to.
+// The argument is a conversation SID, a ~channel linked to a conversation, a
+// customer phone number optionally followed by our number, a unique name or
+// a friendly name. Open conversations are preferred over closed ones. Only
+// the first pages of conversations are searched for a friendly name, the
+// returned bool is false when there were more.
+func (p *TwilioPlugin) resolveConversation(ctx context.Context, twilioClient ITwilioClient, userId, teamId string, argument []string) ([]twiliov1.ConversationsV1Conversation, bool, error) {
+	if len(argument) == 0 {
+		return nil, true, errors.New("No conversation given")
+	}
+	first := argument[0]
+
+	if ConversationSidIsValid(first) && len(argument) == 1 {
+		conv, err := twilioClient.GetConversation(ctx, first)
+		if err != nil {
+			return nil, true, err
+		}
+		return []twiliov1.ConversationsV1Conversation{*conv}, true, nil
+	}
+
+	if strings.HasPrefix(first, "~") && len(argument) == 1 {
+		// Private channels are only found by their members
+		channel, appErr := p.API.GetChannelByName(teamId, strings.TrimPrefix(first, "~"), false)
+		if appErr != nil || !p.API.HasPermissionToChannel(userId, channel.Id, model.PermissionReadChannel) {
+			return nil, true, errors.Errorf("Could not find channel %s", first)
+		}
+		settings, err := p.store.GetByChannel(channel.Id)
+		if err != nil {
+			return nil, true, err
+		}
+		if settings == nil {
+			return nil, true, errors.Errorf("Channel %s is not linked to a conversation", first)
+		}
+		conv, err := twilioClient.GetConversation(ctx, settings.ConversationSid)
+		if err != nil {
+			return nil, true, err
+		}
+		return []twiliov1.ConversationsV1Conversation{*conv}, true, nil
+	}
+
+	if strings.HasPrefix(first, "+") && len(argument) <= 2 {
+		ourNumber := ""
+		if len(argument) == 2 {
+			ourNumber = argument[1]
+		}
+		conversations, err := p.conversationsWithNumber(ctx, twilioClient, first, ourNumber)
+		return conversations, true, err
+	}
+
+	// Twilio fetches conversations by their unique name as well
+	name := strings.Join(argument, " ")
+	conv, err := twilioClient.GetConversation(ctx, name)
+	if err == nil {
+		return []twiliov1.ConversationsV1Conversation{*conv}, true, nil
+	}
+	if !errors.Is(err, errTwilioNotFound) {
+		return nil, true, err
+	}
+	return conversationsNamed(ctx, twilioClient, name)
+}
+
+// conversationsWithNumber finds the conversations of the customer number,
+// only those on our number when it is given.
+func (p *TwilioPlugin) conversationsWithNumber(ctx context.Context, twilioClient ITwilioClient, number, ourNumber string) ([]twiliov1.ConversationsV1Conversation, error) {
+	var found []twiliov1.ConversationsV1Conversation
+	cursor := ""
+	for {
+		page, err := twilioClient.ListConversationsPage(ctx, &conversationFilter{Address: number}, cursor, maxConversationPageSize)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, page.Conversations...)
+		if page.NextPage == "" {
+			break
+		}
+		cursor = page.NextPage
+	}
+	if ourNumber == "" {
+		return preferOpen(found), nil
+	}
+
+	results := fetchAll(ctx, found, func(ctx context.Context, conv twiliov1.ConversationsV1Conversation) ([]string, error) {
+		return twilioClient.GetConversationParticipants(ctx, *conv.Sid)
+	})
+	if err := fetchErrors(results); err != nil {
+		return nil, err
+	}
+	var matching []twiliov1.ConversationsV1Conversation
+	for i, result := range results {
+		if proxyAddress(result.Value) == ourNumber {
+			matching = append(matching, found[i])
+		}
+	}
+	return preferOpen(matching), nil
+}
+
+// conversationsNamed pages through the conversations of the account for the
+// ones with the friendly name, up to maxNamedConversationPages pages. It
+// returns false when it stopped before the last page.
+func conversationsNamed(ctx context.Context, twilioClient ITwilioClient, name string) ([]twiliov1.ConversationsV1Conversation, bool, error) {
+	var found []twiliov1.ConversationsV1Conversation
+	cursor := ""
+	for pages := 0; pages < maxNamedConversationPages; pages++ {
+		page, err := twilioClient.ListConversationsPage(ctx, &conversationFilter{}, cursor, maxConversationPageSize)
+		if err != nil {
+			return nil, true, err
+		}
+		for _, conv := range page.Conversations {
+			if conv.FriendlyName != nil && strings.EqualFold(*conv.FriendlyName, name) {
+				found = append(found, conv)
+			}
+		}
+		if page.NextPage == "" {
+			return preferOpen(found), true, nil
+		}
+		cursor = page.NextPage
+	}
+	return preferOpen(found), false, nil
+}
+
+// preferOpen drops the closed conversations unless all of them are closed.
+func preferOpen(conversations []twiliov1.ConversationsV1Conversation) []twiliov1.ConversationsV1Conversation {
+	var open []twiliov1.ConversationsV1Conversation
+	for _, conv := range conversations {
+		if conv.State == nil || *conv.State != "closed" {
+			open = append(open, conv)
+		}
+	}
+	if len(open) == 0 {
+		return conversations
+	}
+	return open
+}
+
+// commandConversation resolves the conversation argument of a command to a
+// single SID. Otherwise it returns the response to send instead, which for
+// several matches is an empty one after the user was offered buttons to pick
+// a conversation, running the command again with its SID.
+func (p *TwilioPlugin) commandConversation(ctx context.Context, args *model.CommandArgs, twilioClient ITwilioClient, account *twilioAccount, command string, argument []string) (string, *model.CommandResponse) {
+	conversations, complete, err := p.resolveConversation(ctx, twilioClient, args.UserId, args.TeamId, argument)
+	if err != nil {
+		return "", &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not find Twilio conversation %s: %s", strings.Join(argument, " "), twilioErrorText(err)),
+		}
+	}
+	searched := ""
+	if !complete {
+		searched = fmt.Sprintf(" Only the first %d conversations of the account were searched for the name.", maxNamedConversationPages*maxConversationPageSize)
+	}
+	switch len(conversations) {
+	case 0:
+		return "", &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("No Twilio conversation matches %s. Use a conversation SID, ~channel, phone number, unique name or friendly name.%s", strings.Join(argument, " "), searched),
+		}
+	case 1:
+		return *conversations[0].Sid, nil
+	}
+
+	bot, err := p.getBot()
+	if err != nil {
+		return "", &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Could not get bot.",
+		}
+	}
+	text := fmt.Sprintf("%d Twilio conversations match %s. Pick one:", len(conversations), strings.Join(argument, " "))
+	if len(conversations) > maxConversationChoices {
+		text = fmt.Sprintf("%d Twilio conversations match %s, showing the %d most recently active. Pick one or use its SID:", len(conversations), strings.Join(argument, " "), maxConversationChoices)
+		conversations = conversations[:maxConversationChoices]
+	}
+	text += searched
+	// The buttons only carry the command words and the picked SID, the
+	// command is put together again when one is pressed
+	var actions []*model.PostAction
+	for _, conv := range conversations {
+		actionContext := map[string]interface{}{
+			"command":      strings.TrimPrefix(command, "/twilio "),
+			"conversation": *conv.Sid,
+		}
+		if account != nil {
+			actionContext["account"] = account.AccountSid
+		}
+		actions = append(actions, &model.PostAction{
+			Id:   strings.ToLower(*conv.Sid),
+			Name: conversationChoiceName(&conv),
+			Type: model.PostActionTypeButton,
+			Integration: &model.PostActionIntegration{
+				URL:     conversationPickActionURL,
+				Context: actionContext,
+			},
+		})
+	}
+	post := &model.Post{
+		UserId:    bot.UserId,
+		ChannelId: args.ChannelId,
+		Message:   text,
+	}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{Actions: actions}})
+	p.API.SendEphemeralPost(args.UserId, post)
+	return "", &model.CommandResponse{}
+}
+
+// conversationChoiceName labels a conversation on a button.
+func conversationChoiceName(conv *twiliov1.ConversationsV1Conversation) string {
+	name := *conv.Sid
+	if conv.FriendlyName != nil && *conv.FriendlyName != "" {
+		name = *conv.FriendlyName
+	}
+	if conv.State != nil {
+		name += " (" + *conv.State
+		if activity := lastActivity(conv); !activity.IsZero() {
+			name += ", " + activity.UTC().Format("2006-01-02")
+		}
+		name += ")"
+	}
+	return name
+}
+
+// handleConversationPick runs the command for the conversation picked with
+// one of the buttons, showing its response in place of the choices. Only the
+// command words, the SID and the account come from the button, and the user
+// has to be allowed to post in the channel, as for a slash command.
+func (p *TwilioPlugin) handleConversationPick(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var request model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || userId == "" || request.UserId != userId {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	command, _ := request.Context["command"].(string)
+	conversationSid, _ := request.Context["conversation"].(string)
+	accountSid, _ := request.Context["account"].(string)
+	if !ConversationSidIsValid(conversationSid) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var account *twilioAccount
+	if accountSid != "" {
+		if account = p.findTwilioAccount(accountSid); account == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	channel, teamId, err := p.actionChannel(userId, request.ChannelId, request.TeamId)
+	if err != nil {
+		p.API.LogDebug("Rejected conversation pick", "user_id", userId, "channel_id", request.ChannelId, "error", err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	response := p.commandHandler.executeConversationPick(&model.CommandArgs{
+		UserId:    userId,
+		ChannelId: channel.Id,
+		TeamId:    teamId,
+	}, p, account, strings.Fields(command), conversationSid)
+	if response != nil && response.Text != "" {
+		bot, err := p.getBot()
+		if err == nil {
+			p.API.UpdateEphemeralPost(userId, &model.Post{
+				Id:        request.PostId,
+				UserId:    bot.UserId,
+				ChannelId: channel.Id,
+				Message:   response.Text,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&model.PostActionIntegrationResponse{})
+}
+
+// actionChannel returns the channel and team of a button or dialog request
+// after checking that the user may post in the channel. Unlike the arguments
+// of a slash command, the request body is not checked by Mattermost.
+func (p *TwilioPlugin) actionChannel(userId, channelId, teamId string) (*model.Channel, string, error) {
+	channel, appErr := p.API.GetChannel(channelId)
+	if appErr != nil {
+		return nil, "", errors.Wrap(appErr, "Could not get channel")
+	}
+	if !p.API.HasPermissionToChannel(userId, channel.Id, model.PermissionCreatePost) {
+		return nil, "", errors.New("User can not post in the channel")
+	}
+	if channel.TeamId != "" {
+		return channel, channel.TeamId, nil
+	}
+	// Direct and group messages belong to no team, the request tells the
+	// team the user is in
+	if teamId != "" && !p.API.HasPermissionToTeam(userId, teamId, model.PermissionViewTeam) {
+		return nil, "", errors.New("User is not a member of the team")
+	}
+	return channel, teamId, nil
+}
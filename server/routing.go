@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	routingRulesKey = "twilio-routes"
+	contactTagsKey  = "twilio-contact-tags"
+
+	routeModeChannel = "channel"
+	routeModeThread  = "thread"
+)
+
+/*
+ Routing rules decide where a new conversation ends up. They are evaluated in
+ order when the first message of a conversation arrives and the first rule
+ where every given condition matches wins. Conversations that match no rule
+ get their own channel in the team assigned to the receiving number, or the
+ configured team when the number is not assigned.
+
+	{
+		"name": "uk-sales",
+		"to": "+15550001111",
+		"from": "+44",
+		"keywords": ["quote", "price"],
+		"tags": ["vip"],
+		"team": "sales",
+		"mode": "thread",
+		"inbox": "sms-inbox",
+		"private": false,
+		"users": ["bob", "ted"]
+	}
+
+	to: our receiving number
+	from: prefix of the sender number
+	keywords: any of the words appear in the message
+	tags: the sender number has any of the tags, set with /twilio route tag
+	mode: channel (own channel per conversation) or thread (thread in the inbox channel)
+*/
+
+type routingRule struct {
+	Name     string   `json:"name"`
+	To       string   `json:"to,omitempty"`
+	From     string   `json:"from,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Team     string   `json:"team,omitempty"`
+	Mode     string   `json:"mode,omitempty"`
+	Inbox    string   `json:"inbox,omitempty"`
+	Private  bool     `json:"private,omitempty"`
+	Users    []string `json:"users,omitempty"`
+}
+
+// routingDecision is the resolved destination for a new conversation.
+type routingDecision struct {
+	Rule string
+	// Contact tags of the sender the rules were matched against
+	Tags    []string
+	TeamId  string
+	Mode    string
+	Inbox   string
+	Private bool
+	UserIds []string
+}
+
+func (r *routingRule) IsValid() error {
+	if r.Name == "" {
+		return errors.New("rule must have a name")
+	}
+	switch r.Mode {
+	case "", routeModeChannel:
+	case routeModeThread:
+		if r.Inbox == "" {
+			return errors.Errorf("rule %s uses thread mode without an inbox channel", r.Name)
+		}
+	default:
+		return errors.Errorf("rule %s has unknown mode %q", r.Name, r.Mode)
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to a new conversation from the
+// sender with the given contact tags.
+func (r *routingRule) Matches(from, to, text string, tags []string) bool {
+	if r.To != "" && !strings.EqualFold(r.To, to) {
+		return false
+	}
+	if r.From != "" && !strings.HasPrefix(from, r.From) {
+		return false
+	}
+	if len(r.Keywords) > 0 {
+		lower := strings.ToLower(text)
+		found := false
+		for _, keyword := range r.Keywords {
+			if keyword != "" && strings.Contains(lower, strings.ToLower(keyword)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Tags) > 0 {
+		found := false
+		for _, tag := range r.Tags {
+			if hasTag(tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// getContactTags returns the tags of every tagged sender number.
+func (p *TwilioPlugin) getContactTags() (map[string][]string, error) {
+	tags := map[string][]string{}
+	data, err := p.API.KVGet(contactTagsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get contact tags")
+	}
+	if data == nil {
+		return tags, nil
+	}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal contact tags")
+	}
+	return tags, nil
+}
+
+// setContactTags replaces the tags of the sender number, no tags untag it.
+func (p *TwilioPlugin) setContactTags(number string, tags []string) error {
+	all, err := p.getContactTags()
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		delete(all, number)
+	} else {
+		all[number] = tags
+	}
+	return p.saveContactTags(all)
+}
+
+func (p *TwilioPlugin) saveContactTags(all map[string][]string) error {
+	data, err := json.Marshal(all)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal contact tags")
+	}
+	if err := p.API.KVSet(contactTagsKey, data); err != nil {
+		return errors.Wrap(err, "Could not save contact tags")
+	}
+	return nil
+}
+
+func (p *TwilioPlugin) getRoutingRules() ([]*routingRule, error) {
+	var rules []*routingRule
+	data, err := p.API.KVGet(routingRulesKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get routing rules")
+	}
+	if data == nil {
+		return rules, nil
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal routing rules")
+	}
+	return rules, nil
+}
+
+func (p *TwilioPlugin) saveRoutingRules(rules []*routingRule) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal routing rules")
+	}
+	if err := p.API.KVSet(routingRulesKey, data); err != nil {
+		return errors.Wrap(err, "Could not save routing rules")
+	}
+	return nil
+}
+
+// saveRoutingRule replaces the rule with the same name in place or appends it.
+func (p *TwilioPlugin) saveRoutingRule(rule *routingRule) error {
+	if err := rule.IsValid(); err != nil {
+		return err
+	}
+	rules, err := p.getRoutingRules()
+	if err != nil {
+		return err
+	}
+	for i, existing := range rules {
+		if existing.Name == rule.Name {
+			rules[i] = rule
+			return p.saveRoutingRules(rules)
+		}
+	}
+	return p.saveRoutingRules(append(rules, rule))
+}
+
+func (p *TwilioPlugin) deleteRoutingRule(name string) (bool, error) {
+	rules, err := p.getRoutingRules()
+	if err != nil {
+		return false, err
+	}
+	for i, existing := range rules {
+		if existing.Name == name {
+			return true, p.saveRoutingRules(append(rules[:i], rules[i+1:]...))
+		}
+	}
+	return false, nil
+}
+
+// resolveRoute finds where a new conversation from one number to another
+// should go. Without a matching rule, or for what the rule leaves out, it goes
+// where the receiving number is assigned to.
+func (p *TwilioPlugin) resolveRoute(from, to, messagingServiceSid, text string) (*routingDecision, error) {
+	decision, err := p.numberRoute(to, messagingServiceSid)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := p.getRoutingRules()
+	if err != nil {
+		return nil, err
+	}
+	contactTags, err := p.getContactTags()
+	if err != nil {
+		return nil, err
+	}
+	decision.Tags = contactTags[from]
+	for _, rule := range rules {
+		if !rule.Matches(from, to, text, decision.Tags) {
+			continue
+		}
+		decision.Rule = rule.Name
+		if rule.Team != "" {
+			team, appErr := p.API.GetTeamByName(rule.Team)
+			if appErr != nil {
+				return nil, errors.Wrapf(appErr, "Could not find team %s for rule %s", rule.Team, rule.Name)
+			}
+			decision.TeamId = team.Id
+		}
+		if rule.Mode != "" {
+			decision.Mode = rule.Mode
+		}
+		decision.Inbox = rule.Inbox
+		decision.Private = rule.Private
+		if len(rule.Users) > 0 {
+			decision.UserIds = nil
+			for _, username := range rule.Users {
+				user, appErr := p.API.GetUserByUsername(strings.TrimSpace(username))
+				if appErr != nil {
+					p.API.LogError("Could not find user for routing rule", "rule", rule.Name, "user", username, "error", appErr.Error())
+					continue
+				}
+				decision.UserIds = append(decision.UserIds, user.Id)
+			}
+		}
+		break
+	}
+	return decision, nil
+}
+
+// proxyAddress returns our number out of a participant list as returned by
+// GetConversationParticipants.
+func proxyAddress(participants []string) string {
+	for _, participant := range participants {
+		if strings.HasPrefix(participant, "*") {
+			return strings.TrimPrefix(participant, "*")
+		}
+	}
+	return ""
+}
+
+// createConversationThread links the conversation to a new thread in the
+// given channel.
+func (p *TwilioPlugin) createConversationThread(ctx context.Context, twilioClient ITwilioClient, conversationSid string, channel *model.Channel, author string) (*conversationSettings, error) {
+	bot, err := p.getBot()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get bot")
+	}
+	if _, appErr := p.API.AddChannelMember(channel.Id, bot.UserId); appErr != nil {
+		p.API.LogWarn("Could not add bot to inbox channel", "channel_id", channel.Id, "error", appErr.Error())
+	}
+
+	root, appErr := p.API.CreatePost(&model.Post{
+		UserId:    bot.UserId,
+		ChannelId: channel.Id,
+		Message:   "Text conversation with " + author + " " + time.Now().Format("2006-01-02 15:04"),
+		Props: map[string]interface{}{
+			"twilio_conversation_sid": conversationSid,
+			"sent_by_twilio":          true,
+		},
+	})
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "Could not create conversation thread")
+	}
+
+	conv, err := twilioClient.GetConversation(ctx, conversationSid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get conversation details")
+	}
+	settings := &conversationSettings{
+		ConversationSid: conversationSid,
+		TeamId:          channel.TeamId,
+		ChannelId:       channel.Id,
+		ChatServiceSid:  conv.ChatServiceSid,
+		AccountSid:      twilioClient.Account().AccountSid,
+		Type:            "post",
+		RootPostId:      root.Id,
+	}
+	if err := p.saveConversationSettings(settings); err != nil {
+		return nil, errors.Wrap(err, "Could not save conversation settings")
+	}
+	return settings, nil
+}
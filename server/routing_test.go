@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestRoutingRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		rule routingRule
+		from string
+		to   string
+		text string
+		tags []string
+		want bool
+	}{{
+		name: "empty rule matches everything",
+		rule: routingRule{Name: "all"},
+		from: "+15550001111", to: "+15559990000", text: "hi",
+		want: true,
+	}, {
+		name: "receiving number ignores case",
+		rule: routingRule{Name: "to", To: "whatsapp:+15559990000"},
+		from: "+15550001111", to: "WhatsApp:+15559990000",
+		want: true,
+	}, {
+		name: "other receiving number",
+		rule: routingRule{Name: "to", To: "+15559990000"},
+		from: "+15550001111", to: "+15559991111",
+		want: false,
+	}, {
+		name: "sender prefix",
+		rule: routingRule{Name: "uk", From: "+44"},
+		from: "+447700900000", to: "+15559990000",
+		want: true,
+	}, {
+		name: "other sender prefix",
+		rule: routingRule{Name: "uk", From: "+44"},
+		from: "+15550001111", to: "+15559990000",
+		want: false,
+	}, {
+		name: "keyword anywhere in any case",
+		rule: routingRule{Name: "sales", Keywords: []string{"quote", "price"}},
+		text: "What is the PRICE of this?",
+		want: true,
+	}, {
+		name: "no keyword",
+		rule: routingRule{Name: "sales", Keywords: []string{"quote", "price"}},
+		text: "hello",
+		want: false,
+	}, {
+		name: "any of the tags",
+		rule: routingRule{Name: "vip", Tags: []string{"vip", "gold"}},
+		tags: []string{"new", "Gold"},
+		want: true,
+	}, {
+		name: "untagged sender",
+		rule: routingRule{Name: "vip", Tags: []string{"vip"}},
+		want: false,
+	}, {
+		name: "every condition has to match",
+		rule: routingRule{Name: "uk-vip", From: "+44", Tags: []string{"vip"}},
+		from: "+15550001111",
+		tags: []string{"vip"},
+		want: false,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.rule.Matches(test.from, test.to, test.text, test.tags); got != test.want {
+				t.Fatalf("Matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoutingRuleIsValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  routingRule
+		valid bool
+	}{
+		{"channel mode", routingRule{Name: "a"}, true},
+		{"thread mode with inbox", routingRule{Name: "a", Mode: routeModeThread, Inbox: "sms"}, true},
+		{"no name", routingRule{}, false},
+		{"thread mode without inbox", routingRule{Name: "a", Mode: routeModeThread}, false},
+		{"unknown mode", routingRule{Name: "a", Mode: "dm"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.rule.IsValid(); (err == nil) != test.valid {
+				t.Fatalf("IsValid = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
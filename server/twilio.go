@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/pkg/errors"
@@ -16,90 +17,202 @@ import (
 	messaging "github.com/twilio/twilio-go/rest/messaging/v1"
 )
 
+// Events Twilio posts to the plugin webhook. Besides new messages the plugin
+// listens for changes that make cached conversation data stale.
+var webhookFilters = []string{
+	"onMessageAdded",
+	"onConversationUpdated",
+	"onConversationStateUpdated",
+	"onConversationRemoved",
+	"onParticipantAdded",
+	"onParticipantUpdated",
+	"onParticipantRemoved",
+}
+
 type ITwilioClient interface {
-	GetConversationParticipants(conversationSid string) ([]string, error)
-	GetConversation(conversationSid string) (*twiliov1.ConversationsV1Conversation, error)
-	SendMessageToConversation(conversationSid, message string) error
-	SendMediaToConversation(conversationSid string, media *model.FileInfo, mediadata []byte) error
-	ListConversationWebhooks(conversationSid string) ([]twiliov1.ConversationsV1ConversationScopedWebhook, error)
-	AddWebhookToConversation(conversationSid string) error
-	RemoveWebhookFromConversation(conversationSid string) error
-	SetupPhoneNumber(phoneNumber string) error
-	SetupPhoneNumberAsync(phoneNumber string, args *model.CommandArgs)
-	RemovePhoneNumber(phoneNumber string) error
-	AccountNumbers() ([]messaging.MessagingV1PhoneNumber, error)
-	AccountNumbersStrings() ([]string, error)
-	GetConversationServices() ([]twiliov1.ConversationsV1Service, error)
-	CheckServiceWebhook(serviceSid string) (bool, error)
-	FindConversationsByProxyAddress(proxyAddress string) ([]twiliov1.ConversationsV1Conversation, error)
-	DownloadMedia(ChatServiceSid string, mediaSid string) ([]byte, error)
-	ListConversations() ([]twiliov1.ConversationsV1Conversation, error)
+	GetConversationParticipants(ctx context.Context, conversationSid string) ([]string, error)
+	GetConversation(ctx context.Context, conversationSid string) (*twiliov1.ConversationsV1Conversation, error)
+	SetConversationAttributes(ctx context.Context, conversationSid, attributes string) error
+	CreateConversation(ctx context.Context, address, proxyAddress string) (string, error)
+	SendMessageToConversation(ctx context.Context, conversationSid, message string) error
+	SendMediaToConversation(ctx context.Context, conversationSid string, media *model.FileInfo, mediadata []byte) error
+	ListConversationWebhooks(ctx context.Context, conversationSid string) ([]twiliov1.ConversationsV1ConversationScopedWebhook, error)
+	AddWebhookToConversation(ctx context.Context, conversationSid string) error
+	RemoveWebhookFromConversation(ctx context.Context, conversationSid string) error
+	SetupPhoneNumber(ctx context.Context, phoneNumber string, scan bool) (int, error)
+	SetupPhoneNumberAsync(ctx context.Context, phoneNumber string, scan bool, args *model.CommandArgs)
+	RemovePhoneNumber(ctx context.Context, phoneNumber string, scan bool) (int, error)
+	AccountNumbers(ctx context.Context) ([]messaging.MessagingV1PhoneNumber, error)
+	AccountNumbersStrings(ctx context.Context) ([]string, error)
+	GetConversationServices(ctx context.Context) ([]twiliov1.ConversationsV1Service, error)
+	CheckServiceWebhook(ctx context.Context, serviceSid string) (bool, error)
+	FindConversationsByProxyAddress(ctx context.Context, proxyAddress string, scan bool) ([]twiliov1.ConversationsV1Conversation, error)
+	DownloadMedia(ctx context.Context, ChatServiceSid string, mediaSid string) ([]byte, error)
+	ListConversationsPage(ctx context.Context, filter *conversationFilter, cursor string, pageSize int) (*conversationPage, error)
+	RepointWebhooks(ctx context.Context, oldWebhook string) (int, error)
+	Account() *twilioAccount
 }
 
 type TwilioClient struct {
-	p       *TwilioPlugin
-	client  *twilio.RestClient
-	webhook string
+	p          *TwilioPlugin
+	account    *twilioAccount
+	client     *twilio.RestClient
+	httpClient *http.Client
+	mediaBase  string
+	webhook    string
+
+	// The cached client wrapping this one, used by the lookups the client
+	// makes itself
+	cached ITwilioClient
+}
+
+// lookups returns the client to fetch conversations and participants with,
+// the cached one when there is one.
+func (tc *TwilioClient) lookups() ITwilioClient {
+	if tc.cached != nil {
+		return tc.cached
+	}
+	return tc
 }
 
-func (tc *TwilioClient) DownloadMedia(ChatServiceSid string, mediaSid string) ([]byte, error) {
-	req, err := http.NewRequest("GET", "https://mcs.us1.twilio.com/v1/Services/"+ChatServiceSid+"/Media/"+mediaSid+"/Content", nil)
+func (tc *TwilioClient) DownloadMedia(ctx context.Context, ChatServiceSid string, mediaSid string) ([]byte, error) {
+	mediaUrl, err := tc.mediaServiceURL("/v1/Services/" + ChatServiceSid + "/Media/" + mediaSid + "/Content")
 	if err != nil {
 		return nil, err
 	}
-	config := tc.p.getConfiguration()
-	req.SetBasicAuth(config.TwilioSid, config.TwilioToken)
-	resp, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "GET", mediaUrl, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.SetBasicAuth(tc.account.Username, tc.account.Password)
+	resp, err := tc.httpClient.Do(req)
+	if err != nil {
+		return nil, classifyTwilioError(err)
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, errors.New("failed to download media, status code: " + resp.Status)
+		return nil, twilioResponseError(resp)
 	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
 	return data, nil
 }
 
-func NewTwilioClient(p *TwilioPlugin) ITwilioClient {
+func NewTwilioClient(p *TwilioPlugin, account *twilioAccount) ITwilioClient {
 	config := p.getConfiguration()
 
-	clientParams := twilio.ClientParams{Username: config.TwilioSid, Password: config.TwilioToken}
-	client := twilio.NewRestClientWithParams(clientParams)
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient, _ = newTwilioHTTPClient(&configuration{})
+	}
 
-	webhook, _ := url.JoinPath(*p.API.GetConfig().ServiceSettings.SiteURL, "/plugins/sx.paul.mattermost.twilio/twilio/conversation")
 	return &TwilioClient{
-		p:       p,
-		client:  client,
-		webhook: webhook,
+		p:          p,
+		account:    account,
+		client:     newTwilioRestClient(account, httpClient),
+		httpClient: httpClient,
+		mediaBase:  config.TwilioMediaBaseURL,
+		webhook:    p.getWebhookURL(),
 	}
 }
 
-func (tc *TwilioClient) GetConversation(conversationSid string) (*twiliov1.ConversationsV1Conversation, error) {
+// getWebhookURL returns the URL Twilio posts conversation events to.
+func (p *TwilioPlugin) getWebhookURL() string {
+	webhook, _ := url.JoinPath(*p.API.GetConfig().ServiceSettings.SiteURL, "/plugins/sx.paul.mattermost.twilio/twilio/conversation")
+	return webhook
+}
+
+func (tc *TwilioClient) Account() *twilioAccount {
+	return tc.account
+}
+
+// mediaServiceURL builds a Media Content Service URL for the region and edge
+// of the account, the same way the REST client builds its URLs.
+func (tc *TwilioClient) mediaServiceURL(path string) (string, error) {
+	if tc.mediaBase != "" {
+		return url.JoinPath(tc.mediaBase, path)
+	}
+	return tc.client.BuildUrl("https://mcs.us1.twilio.com" + path)
+}
+
+// rest returns a REST client for the account with its requests bound to the
+// context.
+func (tc *TwilioClient) rest(ctx context.Context) *twilio.RestClient {
+	return newTwilioRestClient(tc.account, contextHTTPClient(ctx, tc.httpClient))
+}
+
+func (tc *TwilioClient) GetConversation(ctx context.Context, conversationSid string) (*twiliov1.ConversationsV1Conversation, error) {
+	rc := tc.rest(ctx)
 
 	tc.p.API.LogDebug("Getting conversation", "sid", conversationSid)
 
-	resp, err := tc.client.ConversationsV1.FetchConversation(conversationSid)
+	resp, err := rc.ConversationsV1.FetchConversation(conversationSid)
 	if err != nil {
 		tc.p.API.LogError("Error getting conversation", "sid", conversationSid, "error", err.Error())
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
 	return resp, nil
 }
 
-func (tc *TwilioClient) GetConversationParticipants(conversationSid string) ([]string, error) {
+// SetConversationAttributes replaces the attributes JSON of the conversation.
+func (tc *TwilioClient) SetConversationAttributes(ctx context.Context, conversationSid, attributes string) error {
+	rc := tc.rest(ctx)
+
+	params := &twiliov1.UpdateConversationParams{}
+	params.SetAttributes(attributes)
+	if _, err := rc.ConversationsV1.UpdateConversation(conversationSid, params); err != nil {
+		tc.p.API.LogError("Error updating conversation attributes", "sid", conversationSid, "error", err.Error())
+		return classifyTwilioError(err)
+	}
+	return nil
+}
+
+// CreateConversation starts a conversation with the address from our proxy
+// address and adds the plugin webhook to it. It returns the conversation SID.
+func (tc *TwilioClient) CreateConversation(ctx context.Context, address, proxyAddress string) (string, error) {
+	rc := tc.rest(ctx)
+
+	params := &twiliov1.CreateConversationParams{}
+	params.SetFriendlyName("Text " + address)
+	conv, err := rc.ConversationsV1.CreateConversation(params)
+	if err != nil {
+		tc.p.API.LogError("Error creating conversation", "address", address, "error", err.Error())
+		return "", classifyTwilioError(err)
+	}
+	conversationSid := *conv.Sid
+
+	participant := &twiliov1.CreateConversationParticipantParams{}
+	participant.SetMessagingBindingAddress(address)
+	participant.SetMessagingBindingProxyAddress(proxyAddress)
+	if _, err := rc.ConversationsV1.CreateConversationParticipant(conversationSid, participant); err != nil {
+		tc.p.API.LogError("Error adding participant to conversation", "sid", conversationSid, "address", address, "error", err.Error())
+		// Do not leave an empty conversation behind
+		if derr := rc.ConversationsV1.DeleteConversation(conversationSid, nil); derr != nil {
+			tc.p.API.LogWarn("Could not delete conversation", "sid", conversationSid, "error", derr.Error())
+		}
+		return "", classifyTwilioError(err)
+	}
+	tc.p.indexConversationNumber(tc.account.AccountSid, proxyAddress, conversationSid)
+
+	if err := tc.AddWebhookToConversation(ctx, conversationSid); err != nil {
+		return conversationSid, err
+	}
+	return conversationSid, nil
+}
+
+func (tc *TwilioClient) GetConversationParticipants(ctx context.Context, conversationSid string) ([]string, error) {
+	rc := tc.rest(ctx)
 
 	tc.p.API.LogDebug("Getting participants for conversation", "sid", conversationSid)
 
 	var participants []string
 	params := &twiliov1.ListConversationParticipantParams{}
-	resp, err := tc.client.ConversationsV1.ListConversationParticipant(conversationSid, params)
+	resp, err := rc.ConversationsV1.ListConversationParticipant(conversationSid, params)
 	if err != nil {
 		tc.p.API.LogError("Error getting participants for conversation", "sid", conversationSid, "error", err.Error())
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
 	for _, participant := range resp {
 		jp, jperr := json.Marshal(participant)
@@ -129,22 +242,25 @@ func (tc *TwilioClient) GetConversationParticipants(conversationSid string) ([]s
 		}
 	}
 	tc.p.API.LogDebug("Got participants for conversation", "sid", conversationSid, "participants", participants)
+	tc.p.indexConversationNumber(tc.account.AccountSid, proxyAddress(participants), conversationSid)
 	return participants, nil
 }
 
-func (tc *TwilioClient) SendMessageToConversation(conversationSid string, message string) error {
+func (tc *TwilioClient) SendMessageToConversation(ctx context.Context, conversationSid string, message string) error {
+	rc := tc.rest(ctx)
 	tc.p.API.LogDebug("Sending message to conversation", "sid", conversationSid, "message", message)
 
 	params := &twiliov1.CreateConversationMessageParams{Body: &message}
-	_, err := tc.client.ConversationsV1.CreateConversationMessage(conversationSid, params)
+	_, err := rc.ConversationsV1.CreateConversationMessage(conversationSid, params)
 	if err != nil {
 		tc.p.API.LogError("Error sending message to conversation", "sid", conversationSid, "message", message, "error", err.Error())
 	}
-	return err
+	return classifyTwilioError(err)
 }
 
-func (tc *TwilioClient) SendMediaToConversation(conversationSid string, media *model.FileInfo, mediadata []byte) error {
-	settings, err := tc.p.getConversationSettings(conversationSid)
+func (tc *TwilioClient) SendMediaToConversation(ctx context.Context, conversationSid string, media *model.FileInfo, mediadata []byte) error {
+	rc := tc.rest(ctx)
+	settings, err := tc.p.getConversationSettings(ctx, conversationSid)
 	if err != nil {
 		tc.p.API.LogError("Could not get conversation settings", "sid", conversationSid, "error", err.Error())
 		return err
@@ -157,27 +273,31 @@ func (tc *TwilioClient) SendMediaToConversation(conversationSid string, media *m
 	tc.p.API.LogDebug("Sending media to conversation", "sid", conversationSid, "media", media.Name)
 
 	// Upload the media to Twilio Media Content Service
-	req, err := http.NewRequest("POST", "https://mcs.us1.twilio.com/v1/Services/"+*settings.ChatServiceSid+"/Media", strings.NewReader(string(mediadata)))
+	mediaUrl, err := tc.mediaServiceURL("/v1/Services/" + *settings.ChatServiceSid + "/Media")
+	if err != nil {
+		tc.p.API.LogError("Error building media service URL", "error", err.Error())
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", mediaUrl, strings.NewReader(string(mediadata)))
 	if err != nil {
 		tc.p.API.LogError("Error creating request to upload media", "error", err.Error())
 		return err
 	}
-	config := tc.p.getConfiguration()
-	req.SetBasicAuth(config.TwilioSid, config.TwilioToken)
+	req.SetBasicAuth(tc.account.Username, tc.account.Password)
 	req.Header.Set("Content-Type", media.MimeType)
 	req.Header.Set("Content-Length", strconv.Itoa(len(mediadata)))
 	req.Header.Set("X-Twilio-File-Name", media.Name)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := tc.httpClient.Do(req)
 	if err != nil {
 		tc.p.API.LogError("Error uploading media to Twilio", "error", err.Error())
-		return err
+		return classifyTwilioError(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		tc.p.API.LogError("Error uploading media to Twilio, non-2xx response", "status", resp.StatusCode, "body", string(body))
-		return errors.New("failed to upload media to Twilio, status code: " + resp.Status)
+		err := twilioResponseError(resp)
+		tc.p.API.LogError("Error uploading media to Twilio, non-2xx response", "status", resp.StatusCode, "error", err.Error())
+		return err
 	}
 	var uploadResp struct {
 		Sid string `json:"sid"`
@@ -192,37 +312,38 @@ func (tc *TwilioClient) SendMediaToConversation(conversationSid string, media *m
 	}
 
 	// Send the media message to the conversation
-	//mediaUrl := "https://mcs.us1.twilio.com/v1/Services/" + *settings.ChatServiceSid + "/Media/" + uploadResp.Sid
 	params := &twiliov1.CreateConversationMessageParams{}
 	params.SetMediaSid(uploadResp.Sid)
 
-	_, err = tc.client.ConversationsV1.CreateConversationMessage(conversationSid, params)
+	_, err = rc.ConversationsV1.CreateConversationMessage(conversationSid, params)
 	if err != nil {
 		tc.p.API.LogError("Error sending media message to conversation", "sid", conversationSid, "media_sid", uploadResp.Sid, "error", err.Error())
 	}
-	return nil
+	return classifyTwilioError(err)
 }
 
-func (tc *TwilioClient) GetConversationServices() ([]twiliov1.ConversationsV1Service, error) {
+func (tc *TwilioClient) GetConversationServices(ctx context.Context) ([]twiliov1.ConversationsV1Service, error) {
+	rc := tc.rest(ctx)
 	var services []twiliov1.ConversationsV1Service
-	//resp, err := tc.client.ConversationsV1.StreamService()
+	//resp, err := rc.ConversationsV1.StreamService()
 	params := &twiliov1.ListServiceParams{}
-	resp, err := tc.client.ConversationsV1.ListService(params)
+	resp, err := rc.ConversationsV1.ListService(params)
 	if err != nil {
 		tc.p.API.LogError("Error getting conversation services", "error", err.Error())
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
 	services = append(services, resp...)
 
 	return services, nil
 }
 
-func (tc *TwilioClient) CheckServiceWebhook(serviceSid string) (bool, error) {
+func (tc *TwilioClient) CheckServiceWebhook(ctx context.Context, serviceSid string) (bool, error) {
+	rc := tc.rest(ctx)
 
-	resp, err := tc.client.ConversationsV1.FetchServiceWebhookConfiguration(serviceSid)
+	resp, err := rc.ConversationsV1.FetchServiceWebhookConfiguration(serviceSid)
 	if err != nil {
 		tc.p.API.LogError("Error getting service webhooks", "service_sid", serviceSid, "error", err.Error())
-		return false, err
+		return false, classifyTwilioError(err)
 	}
 	return resp != nil && *resp.PostWebhookUrl == tc.webhook, nil
 }
@@ -235,38 +356,53 @@ func (tc *TwilioClient) CheckServiceWebhook(serviceSid string) (bool, error) {
  4. Sets the plugin webhook to receive new conversations
 */
 
-func (tc *TwilioClient) ListConversationWebhooks(conversationSid string) ([]twiliov1.ConversationsV1ConversationScopedWebhook, error) {
+func (tc *TwilioClient) ListConversationWebhooks(ctx context.Context, conversationSid string) ([]twiliov1.ConversationsV1ConversationScopedWebhook, error) {
+	rc := tc.rest(ctx)
 
 	var webhooks []twiliov1.ConversationsV1ConversationScopedWebhook
 	params := &twiliov1.ListConversationScopedWebhookParams{}
-	resp, err := tc.client.ConversationsV1.ListConversationScopedWebhook(conversationSid, params)
+	resp, err := rc.ConversationsV1.ListConversationScopedWebhook(conversationSid, params)
 	if err != nil {
 		tc.p.API.LogError("Error getting conversation webhooks", "conversation_sid", conversationSid, "error", err.Error())
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
 	webhooks = append(webhooks, resp...)
 	return webhooks, nil
 }
 
-func (tc *TwilioClient) AddWebhookToConversation(conversationSid string) error {
+func (tc *TwilioClient) AddWebhookToConversation(ctx context.Context, conversationSid string) error {
+	rc := tc.rest(ctx)
 
-	resp, err := tc.client.ConversationsV1.ListConversationScopedWebhook(conversationSid, &twiliov1.ListConversationScopedWebhookParams{})
+	resp, err := rc.ConversationsV1.ListConversationScopedWebhook(conversationSid, &twiliov1.ListConversationScopedWebhookParams{})
 	if err != nil {
 		tc.p.API.LogError("Error getting conversation webhooks", "conversation_sid", conversationSid, "error", err.Error())
-		return err
+		return classifyTwilioError(err)
 	}
 	for _, webhook := range resp {
 		var url string
 		url = ""
+		filters := 0
 		if webhook.Configuration != nil {
 			if configMap, ok := (*webhook.Configuration).(map[string]interface{}); ok {
 				if u, ok := configMap["url"].(string); ok {
 					url = u
 				}
+				if f, ok := configMap["filters"].([]interface{}); ok {
+					filters = len(f)
+				}
 			}
 		}
 		if strings.EqualFold(url, tc.webhook) {
 			tc.p.API.LogDebug("Webhook already exists for conversation", "conversation_sid", conversationSid, "webhook_sid", *webhook.Sid)
+			// Webhooks added by older versions only listen for new messages
+			if filters < len(webhookFilters) {
+				params := &twiliov1.UpdateConversationScopedWebhookParams{}
+				params.SetConfigurationFilters(webhookFilters)
+				if _, err := rc.ConversationsV1.UpdateConversationScopedWebhook(conversationSid, *webhook.Sid, params); err != nil {
+					tc.p.API.LogError("Error updating conversation webhook filters", "conversation_sid", conversationSid, "error", err.Error())
+					return classifyTwilioError(err)
+				}
+			}
 			return nil
 		}
 	}
@@ -274,24 +410,25 @@ func (tc *TwilioClient) AddWebhookToConversation(conversationSid string) error {
 	params := &twiliov1.CreateConversationScopedWebhookParams{}
 	params.SetConfigurationMethod("post")
 	params.SetConfigurationUrl(tc.webhook)
-	params.SetConfigurationFilters([]string{"onMessageAdded"})
+	params.SetConfigurationFilters(webhookFilters)
 	params.SetTarget("webhook")
 
-	_, err = tc.client.ConversationsV1.CreateConversationScopedWebhook(conversationSid, params)
+	_, err = rc.ConversationsV1.CreateConversationScopedWebhook(conversationSid, params)
 	if err != nil {
 		tc.p.API.LogError("Error creating conversation webhook", "conversation_sid", conversationSid, "error", err.Error())
-		return err
+		return classifyTwilioError(err)
 	}
 	return nil
 	//
 }
 
-func (tc *TwilioClient) RemoveWebhookFromConversation(conversationSid string) error {
+func (tc *TwilioClient) RemoveWebhookFromConversation(ctx context.Context, conversationSid string) error {
+	rc := tc.rest(ctx)
 
-	resp, err := tc.client.ConversationsV1.ListConversationScopedWebhook(conversationSid, &twiliov1.ListConversationScopedWebhookParams{})
+	resp, err := rc.ConversationsV1.ListConversationScopedWebhook(conversationSid, &twiliov1.ListConversationScopedWebhookParams{})
 	if err != nil {
 		tc.p.API.LogError("Error getting conversation webhooks", "conversation_sid", conversationSid, "error", err.Error())
-		return err
+		return classifyTwilioError(err)
 	}
 	for _, webhook := range resp {
 		var url string
@@ -306,10 +443,10 @@ func (tc *TwilioClient) RemoveWebhookFromConversation(conversationSid string) er
 
 		if strings.EqualFold(url, tc.webhook) {
 			// Delete the webhook
-			err = tc.client.ConversationsV1.DeleteConversationScopedWebhook(conversationSid, *webhook.Sid)
+			err = rc.ConversationsV1.DeleteConversationScopedWebhook(conversationSid, *webhook.Sid)
 			if err != nil {
 				tc.p.API.LogError("Error deleting conversation webhook", "conversation_sid", conversationSid, "webhook_sid", *webhook.Sid, "error", err.Error())
-				return err
+				return classifyTwilioError(err)
 			}
 			tc.p.API.LogDebug("Deleted webhook from conversation", "conversation_sid", conversationSid, "webhook_sid", *webhook.Sid)
 		}
@@ -317,157 +454,104 @@ func (tc *TwilioClient) RemoveWebhookFromConversation(conversationSid string) er
 	return nil
 }
 
-func (tc *TwilioClient) ListConversations() ([]twiliov1.ConversationsV1Conversation, error) {
-	var conversations []twiliov1.ConversationsV1Conversation
-	params := &twiliov1.ListConversationParams{}
-	resp, err := tc.client.ConversationsV1.ListConversation(params)
+// FindConversationsByProxyAddress finds the conversations our number takes
+// part in from the number index. Twilio cannot look up conversations by our
+// side of the binding, so until the account was scanned once for the number,
+// or when scan is set, the participants of every conversation on the account
+// are fetched instead. The scan fills the index for the next lookups.
+func (tc *TwilioClient) FindConversationsByProxyAddress(ctx context.Context, proxyAddress string, scan bool) ([]twiliov1.ConversationsV1Conversation, error) {
+	if !scan {
+		scanned, err := tc.p.numberScanned(tc.account.AccountSid, proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		scan = !scanned
+	}
+	if scan {
+		tc.p.API.LogInfo("Scanning all conversations for number", "address", proxyAddress)
+		return tc.scanConversationsByProxyAddress(ctx, proxyAddress)
+	}
+	sids, err := tc.p.numberConversations(tc.account.AccountSid, proxyAddress)
 	if err != nil {
-		tc.p.API.LogError("Error getting conversations", "error", err.Error())
 		return nil, err
 	}
-	conversations = append(conversations, resp...)
+	results := fetchAll(ctx, sids, func(ctx context.Context, sid string) (*twiliov1.ConversationsV1Conversation, error) {
+		return tc.lookups().GetConversation(ctx, sid)
+	})
+	var conversations []twiliov1.ConversationsV1Conversation
+	for i, result := range results {
+		if errors.Is(result.Err, errTwilioNotFound) {
+			tc.p.unindexConversationNumber(tc.account.AccountSid, proxyAddress, sids[i])
+			continue
+		}
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		conversations = append(conversations, *result.Value)
+	}
 	return conversations, nil
 }
 
-func (tc *TwilioClient) FindConversationsByProxyAddress(proxyAddress string) ([]twiliov1.ConversationsV1Conversation, error) {
-
+// scanConversationsByProxyAddress fetches the participants of every
+// conversation on the account to find the ones with our number. The number
+// counts as scanned when the participants of every conversation were found.
+func (tc *TwilioClient) scanConversationsByProxyAddress(ctx context.Context, proxyAddress string) ([]twiliov1.ConversationsV1Conversation, error) {
 	var conversations []twiliov1.ConversationsV1Conversation
-	params := &twiliov1.ListConversationParams{}
-	resp, err := tc.client.ConversationsV1.ListConversation(params)
-	if err != nil {
-		tc.p.API.LogError("Error getting conversations", "error", err.Error())
-		return nil, err
-	}
-	var wg sync.WaitGroup
-	guard := make(chan struct{}, 5) // limit to 5 concurrent requests
-	for _, conversation := range resp {
-		wg.Add(1)
-		guard <- struct{}{}
-		go func(conv twiliov1.ConversationsV1Conversation) {
-			defer func() {
-				<-guard
-				wg.Done()
-			}()
-
-			// Check if the conversation has a participant with the proxy address
-			participants, err := tc.GetConversationParticipants(*conv.Sid)
-			if err != nil {
-				tc.p.API.LogError("Error getting participants for conversation", "sid", *conv.Sid, "error", err.Error())
-				return
+	complete := true
+	err := tc.eachConversationPage(ctx, &conversationFilter{}, func(page []twiliov1.ConversationsV1Conversation) error {
+		// Check if the conversation has a participant with the proxy address
+		results := fetchAll(ctx, page, func(ctx context.Context, conv twiliov1.ConversationsV1Conversation) ([]string, error) {
+			return tc.lookups().GetConversationParticipants(ctx, *conv.Sid)
+		})
+		for i, result := range results {
+			if result.Err != nil {
+				tc.p.API.LogError("Error getting participants for conversation", "sid", *page[i].Sid, "error", result.Err.Error())
+				complete = false
+				continue
 			}
-			for _, participant := range participants {
+			for _, participant := range result.Value {
 				if strings.EqualFold(participant, "*"+proxyAddress) {
-					conversations = append(conversations, conv)
+					conversations = append(conversations, page[i])
 					break
 				}
 			}
-		}(conversation)
-	}
-	wg.Wait()
-
-	return conversations, nil
-}
-
-func (tc *TwilioClient) SetupPhoneNumberAsync(phoneNumber string, args *model.CommandArgs) {
-	// Update the phone number to auto create conversations and set the webhook for new conversations
-	resp, err := tc.client.ConversationsV1.FetchConfigurationAddress(phoneNumber)
-
-	if err != nil || resp == nil || resp.Sid == nil {
-		params := &twiliov1.CreateConfigurationAddressParams{}
-		params.SetType("sms")
-		params.SetAddress(phoneNumber)
-		params.SetAutoCreationEnabled(true)
-		params.SetAutoCreationType("webhook")
-		params.SetAutoCreationWebhookMethod("post")
-		params.SetAutoCreationWebhookUrl(tc.webhook)
-		params.SetAutoCreationWebhookFilters([]string{"onMessageAdded"})
-		respc, errc := tc.client.ConversationsV1.CreateConfigurationAddress(params)
-		if errc != nil {
-
-			post := &model.Post{
-				UserId:    tc.p.bot.UserId,
-				ChannelId: args.ChannelId,
-				Message:   "Error setting up phone number " + phoneNumber + ": " + errc.Error(),
-				Type:      model.PostTypeEphemeral,
-			}
-			if _, err := tc.p.API.CreatePost(post); err != nil {
-				tc.p.API.LogError("Could not create post for error", "error", err.Error())
-			}
-			return
 		}
-		tc.p.API.LogDebug("Created phone number configuration", "phone_number", phoneNumber, "sid", *respc.Sid)
-
-	} else {
-		params := &twiliov1.UpdateConfigurationAddressParams{}
-		params.SetAutoCreationEnabled(true)
-		params.SetAutoCreationType("webhook")
-		params.SetAutoCreationWebhookMethod("post")
-		params.SetAutoCreationWebhookUrl(tc.webhook)
-		params.SetAutoCreationWebhookFilters([]string{"onMessageAdded"})
-		_, err = tc.client.ConversationsV1.UpdateConfigurationAddress(*resp.Sid, params)
-		if err != nil {
-			post := &model.Post{
-				UserId:    tc.p.bot.UserId,
-				ChannelId: args.ChannelId,
-				Message:   "Error setting up phone number " + phoneNumber + ": " + err.Error(),
-				Type:      model.PostTypeEphemeral,
-			}
-			if _, err := tc.p.API.CreatePost(post); err != nil {
-				tc.p.API.LogError("Could not create post for error", "error", err.Error())
-			}
-			return
-		}
-		tc.p.API.LogDebug("Updated phone number configuration", "phone_number", phoneNumber)
+		return ctx.Err()
+	})
+	if err == nil && complete {
+		tc.p.setNumberScanned(tc.account.AccountSid, proxyAddress)
 	}
+	return conversations, err
+}
 
-	// Find conversations with the phone number as a participant
-	tc.p.API.LogDebug("Setting up phone number:", phoneNumber)
-	conversations, err := tc.FindConversationsByProxyAddress(phoneNumber)
-	if err != nil {
-		post := &model.Post{
-			UserId:    tc.p.bot.UserId,
-			ChannelId: args.ChannelId,
-			Message:   "Error setting up phone number " + phoneNumber + ": " + err.Error(),
-			Type:      model.PostTypeEphemeral,
-		}
-		if _, err := tc.p.API.CreatePost(post); err != nil {
-			tc.p.API.LogError("Could not create post for error", "error", err.Error())
-		}
+// SetupPhoneNumberAsync sets up the phone number and reports the result to
+// the user that ran the command. Nothing is reported when the context is
+// cancelled, the job runs again on the next activation.
+func (tc *TwilioClient) SetupPhoneNumberAsync(ctx context.Context, phoneNumber string, scan bool, args *model.CommandArgs) {
+	count, err := tc.SetupPhoneNumber(ctx, phoneNumber, scan)
+	if ctx.Err() != nil {
 		return
 	}
-	for _, conversation := range conversations {
-		// Add webhook to conversation
-		tc.p.API.LogDebug("Adding webhook to conversation:", "conversation", *conversation.Sid)
-		err := tc.AddWebhookToConversation(*conversation.Sid)
-		if err != nil {
-			tc.p.API.LogError("Error adding webhook to conversation:", *conversation.Sid, "error:", err.Error())
-			post := &model.Post{
-				UserId:    tc.p.bot.UserId,
-				ChannelId: args.ChannelId,
-				Message:   "Error setting up phone number " + phoneNumber + ": " + err.Error(),
-				Type:      model.PostTypeEphemeral,
-			}
-			if _, err := tc.p.API.CreatePost(post); err != nil {
-				tc.p.API.LogError("Could not create post for error", "error", err.Error())
-			}
-			return
-		}
+	message := fmt.Sprintf("Successfully set up phone number %s, added the webhook to %d conversations.", phoneNumber, count)
+	if err != nil {
+		message = "Error setting up phone number " + phoneNumber + ": " + twilioErrorText(err)
 	}
-	post := &model.Post{
+	tc.p.API.SendEphemeralPost(args.UserId, &model.Post{
 		UserId:    tc.p.bot.UserId,
 		ChannelId: args.ChannelId,
-		Message:   "Successfully set up phone number " + phoneNumber,
-		Type:      model.PostTypeEphemeral,
-	}
-	if _, err := tc.p.API.CreatePost(post); err != nil {
-		tc.p.API.LogError("Could not create post for error", "error", err.Error())
-	}
+		Message:   message,
+	})
 }
 
-func (tc *TwilioClient) SetupPhoneNumber(phoneNumber string) error {
+// SetupPhoneNumber points the number at the plugin webhook and adds the
+// webhook to its conversations, returning how many got it. With scan,
+// conversations missing from the number index are found by scanning the
+// account.
+func (tc *TwilioClient) SetupPhoneNumber(ctx context.Context, phoneNumber string, scan bool) (int, error) {
+	rc := tc.rest(ctx)
 
 	// Update the phone number to auto create conversations and set the webhook for new conversations
-	resp, err := tc.client.ConversationsV1.FetchConfigurationAddress(phoneNumber)
+	resp, err := rc.ConversationsV1.FetchConfigurationAddress(phoneNumber)
 
 	if err != nil || resp == nil || resp.Sid == nil {
 		params := &twiliov1.CreateConfigurationAddressParams{}
@@ -477,11 +561,11 @@ func (tc *TwilioClient) SetupPhoneNumber(phoneNumber string) error {
 		params.SetAutoCreationType("webhook")
 		params.SetAutoCreationWebhookMethod("post")
 		params.SetAutoCreationWebhookUrl(tc.webhook)
-		params.SetAutoCreationWebhookFilters([]string{"onMessageAdded"})
-		respc, errc := tc.client.ConversationsV1.CreateConfigurationAddress(params)
+		params.SetAutoCreationWebhookFilters(webhookFilters)
+		respc, errc := rc.ConversationsV1.CreateConfigurationAddress(params)
 		if errc != nil {
 			tc.p.API.LogError("Error creating phone number configuration", "phone_number", phoneNumber, "error", errc.Error())
-			return errc
+			return 0, classifyTwilioError(errc)
 		}
 		tc.p.API.LogDebug("Created phone number configuration", "phone_number", phoneNumber, "sid", *respc.Sid)
 
@@ -491,97 +575,104 @@ func (tc *TwilioClient) SetupPhoneNumber(phoneNumber string) error {
 		params.SetAutoCreationType("webhook")
 		params.SetAutoCreationWebhookMethod("post")
 		params.SetAutoCreationWebhookUrl(tc.webhook)
-		params.SetAutoCreationWebhookFilters([]string{"onMessageAdded"})
-		_, err = tc.client.ConversationsV1.UpdateConfigurationAddress(*resp.Sid, params)
+		params.SetAutoCreationWebhookFilters(webhookFilters)
+		_, err = rc.ConversationsV1.UpdateConfigurationAddress(*resp.Sid, params)
 		if err != nil {
 			tc.p.API.LogError("Error updating phone number configuration", "phone_number", phoneNumber, "error", err.Error())
-			return err
+			return 0, classifyTwilioError(err)
 		}
 		tc.p.API.LogDebug("Updated phone number configuration", "phone_number", phoneNumber)
 	}
 
 	// Find conversations with the phone number as a participant
 	tc.p.API.LogDebug("Setting up phone number:", phoneNumber)
-	conversations, err := tc.FindConversationsByProxyAddress(phoneNumber)
+	conversations, err := tc.FindConversationsByProxyAddress(ctx, phoneNumber, scan)
 	if err != nil {
-		return err
+		return 0, classifyTwilioError(err)
 	}
-	for _, conversation := range conversations {
-		// Add webhook to conversation
+	results := fetchAll(ctx, conversations, func(ctx context.Context, conversation twiliov1.ConversationsV1Conversation) (struct{}, error) {
 		tc.p.API.LogDebug("Adding webhook to conversation:", "conversation", *conversation.Sid)
-		err := tc.AddWebhookToConversation(*conversation.Sid)
+		err := tc.AddWebhookToConversation(ctx, *conversation.Sid)
 		if err != nil {
-			tc.p.API.LogError("Error adding webhook to conversation:", *conversation.Sid, "error:", err.Error())
-			return err
+			tc.p.API.LogError("Error adding webhook to conversation", "conversation", *conversation.Sid, "error", err.Error())
 		}
-	}
-	return nil
-
+		return struct{}{}, err
+	})
+	return fetchSucceeded(results), fetchErrors(results)
 }
 
-func (tc *TwilioClient) RemovePhoneNumber(phoneNumber string) error {
+// RemovePhoneNumber removes the plugin webhook from the conversations of the
+// number and deletes its configuration, returning how many conversations lost
+// the webhook. With scan, conversations missing from the number index are
+// found by scanning the account.
+func (tc *TwilioClient) RemovePhoneNumber(ctx context.Context, phoneNumber string, scan bool) (int, error) {
+	rc := tc.rest(ctx)
 
 	// Find conversations with the phone number as a participant
 	tc.p.API.LogDebug("Removing phone number:", "number", phoneNumber)
-	conversations, err := tc.FindConversationsByProxyAddress(phoneNumber)
+	conversations, err := tc.FindConversationsByProxyAddress(ctx, phoneNumber, scan)
 	if err != nil {
-		return err
+		return 0, classifyTwilioError(err)
 	}
-	for _, conversation := range conversations {
-		// Add webhook to conversation
+	results := fetchAll(ctx, conversations, func(ctx context.Context, conversation twiliov1.ConversationsV1Conversation) (struct{}, error) {
 		tc.p.API.LogDebug("Removing webhook to conversation:", "sid", *conversation.Sid)
-		err := tc.RemoveWebhookFromConversation(*conversation.Sid)
-		if err != nil {
-			return err
-		}
+		return struct{}{}, tc.RemoveWebhookFromConversation(ctx, *conversation.Sid)
+	})
+	count := fetchSucceeded(results)
+	if err := fetchErrors(results); err != nil {
+		return count, err
 	}
 	tc.p.API.LogDebug("Fetching configuration for phone number:", "number", phoneNumber)
 	// Update the phone number to auto create conversations and set the webhook for new conversations
-	resp, err := tc.client.ConversationsV1.FetchConfigurationAddress(phoneNumber)
+	resp, err := rc.ConversationsV1.FetchConfigurationAddress(phoneNumber)
 
 	if err != nil || resp == nil || resp.Sid == nil {
 
 		tc.p.API.LogDebug("Configuration does not already exist", "phone_number", phoneNumber)
-		return nil
+		return count, nil
 	}
 
-	err = tc.client.ConversationsV1.DeleteConfigurationAddress(*resp.Sid)
+	err = rc.ConversationsV1.DeleteConfigurationAddress(*resp.Sid)
 	if err != nil {
 		tc.p.API.LogError("Error deleting phone number configuration", "phone_number", phoneNumber, "error", err.Error())
-		return err
+		return count, classifyTwilioError(err)
 	}
 	tc.p.API.LogDebug("Deleted phone number configuration", "phone_number", phoneNumber)
-	return nil
+	return count, nil
 }
 
-func (tc *TwilioClient) AccountNumbers() ([]messaging.MessagingV1PhoneNumber, error) {
+func (tc *TwilioClient) AccountNumbers(ctx context.Context) ([]messaging.MessagingV1PhoneNumber, error) {
+	rc := tc.rest(ctx)
 
 	var numbers []messaging.MessagingV1PhoneNumber
 	params := &messaging.ListServiceParams{}
-	resp, err := tc.client.MessagingV1.ListService(params)
+	resp, err := rc.MessagingV1.ListService(params)
 	if err != nil {
 		tc.p.API.LogError("Error getting messaging services", "error", err.Error())
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
-	for _, service := range resp {
-
+	results := fetchAll(ctx, resp, func(ctx context.Context, service messaging.MessagingV1Service) ([]messaging.MessagingV1PhoneNumber, error) {
 		mparams := &messaging.ListPhoneNumberParams{}
-		r, errr := tc.client.MessagingV1.ListPhoneNumber(*service.Sid, mparams)
+		r, errr := tc.rest(ctx).MessagingV1.ListPhoneNumber(*service.Sid, mparams)
 		if errr != nil {
 			tc.p.API.LogError("Error getting phone numbers for service", "service_sid", *service.Sid, "error", errr.Error())
-			return nil, errr
 		}
-		numbers = append(numbers, r...)
-
+		return r, classifyTwilioError(errr)
+	})
+	if err := fetchErrors(results); err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		numbers = append(numbers, result.Value...)
 	}
 	return numbers, nil
 }
 
-func (tc *TwilioClient) AccountNumbersStrings() ([]string, error) {
+func (tc *TwilioClient) AccountNumbersStrings(ctx context.Context) ([]string, error) {
 	var numbers []string
-	nums, err := tc.AccountNumbers()
+	nums, err := tc.AccountNumbers(ctx)
 	if err != nil {
-		return nil, err
+		return nil, classifyTwilioError(err)
 	}
 	for _, number := range nums {
 		if number.PhoneNumber != nil {
@@ -590,3 +681,81 @@ func (tc *TwilioClient) AccountNumbersStrings() ([]string, error) {
 	}
 	return numbers, nil
 }
+
+// RepointWebhooks moves the phone number configurations and conversation
+// webhooks that still use an old webhook URL to the current one. It returns
+// how many were moved.
+func (tc *TwilioClient) RepointWebhooks(ctx context.Context, oldWebhook string) (int, error) {
+	rc := tc.rest(ctx)
+	if oldWebhook == "" || strings.EqualFold(oldWebhook, tc.webhook) {
+		return 0, nil
+	}
+	moved := 0
+
+	addresses, err := rc.ConversationsV1.ListConfigurationAddress(&twiliov1.ListConfigurationAddressParams{})
+	if err != nil {
+		tc.p.API.LogError("Error listing phone number configurations", "error", err.Error())
+		return moved, classifyTwilioError(err)
+	}
+	for _, address := range addresses {
+		if address.Sid == nil || address.AutoCreation == nil {
+			continue
+		}
+		autoCreation, ok := (*address.AutoCreation).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if u, ok := autoCreation["webhook_url"].(string); !ok || !strings.EqualFold(u, oldWebhook) {
+			continue
+		}
+		params := &twiliov1.UpdateConfigurationAddressParams{}
+		params.SetAutoCreationWebhookUrl(tc.webhook)
+		if _, err := rc.ConversationsV1.UpdateConfigurationAddress(*address.Sid, params); err != nil {
+			tc.p.API.LogError("Error updating phone number configuration", "sid", *address.Sid, "error", err.Error())
+			return moved, classifyTwilioError(err)
+		}
+		moved++
+	}
+
+	err = tc.eachConversationPage(ctx, &conversationFilter{}, func(page []twiliov1.ConversationsV1Conversation) error {
+		results := fetchAll(ctx, page, func(ctx context.Context, conversation twiliov1.ConversationsV1Conversation) (int, error) {
+			return tc.repointConversationWebhooks(ctx, *conversation.Sid, oldWebhook)
+		})
+		for _, result := range results {
+			moved += result.Value
+		}
+		return fetchErrors(results)
+	})
+	return moved, err
+}
+
+// repointConversationWebhooks moves the webhooks of one conversation from the
+// old webhook URL to the current one.
+func (tc *TwilioClient) repointConversationWebhooks(ctx context.Context, conversationSid, oldWebhook string) (int, error) {
+	moved := 0
+	webhooks, err := tc.ListConversationWebhooks(ctx, conversationSid)
+	if err != nil {
+		return moved, err
+	}
+	for _, webhook := range webhooks {
+		url := ""
+		if webhook.Configuration != nil {
+			if configMap, ok := (*webhook.Configuration).(map[string]interface{}); ok {
+				if u, ok := configMap["url"].(string); ok {
+					url = u
+				}
+			}
+		}
+		if !strings.EqualFold(url, oldWebhook) {
+			continue
+		}
+		params := &twiliov1.UpdateConversationScopedWebhookParams{}
+		params.SetConfigurationUrl(tc.webhook)
+		if _, err := tc.rest(ctx).ConversationsV1.UpdateConversationScopedWebhook(conversationSid, *webhook.Sid, params); err != nil {
+			tc.p.API.LogError("Error updating conversation webhook", "conversation_sid", conversationSid, "webhook_sid", *webhook.Sid, "error", err.Error())
+			return moved, classifyTwilioError(err)
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/twilio/twilio-go/client"
+)
+
+// Kinds of Twilio failures, test for them with errors.Is.
+var (
+	errTwilioNotFound    = errors.New("not found")
+	errTwilioAuth        = errors.New("authentication failed")
+	errTwilioRateLimited = errors.New("rate limited")
+	errTwilioTransient   = errors.New("temporary failure")
+)
+
+// twilioError is a failed Twilio request with the error code Twilio returned,
+// see https://www.twilio.com/docs/api/errors.
+type twilioError struct {
+	kind    error
+	Code    int
+	Status  int
+	Message string
+	err     error
+}
+
+func (e *twilioError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("Twilio error %d: %s", e.Code, e.Message)
+	}
+	if e.Status != 0 {
+		return fmt.Sprintf("Twilio returned status %d: %s", e.Status, e.Message)
+	}
+	return e.err.Error()
+}
+
+func (e *twilioError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+func (e *twilioError) Unwrap() error {
+	return e.err
+}
+
+func twilioErrorKind(status int) error {
+	switch {
+	case status == http.StatusNotFound:
+		return errTwilioNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errTwilioAuth
+	case status == http.StatusTooManyRequests:
+		return errTwilioRateLimited
+	case status >= 500:
+		return errTwilioTransient
+	}
+	return nil
+}
+
+// classifyTwilioError turns an error from the Twilio client or the HTTP client
+// into a twilioError. Cancellation by the caller is returned as it is.
+func classifyTwilioError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var twErr *twilioError
+	if errors.As(err, &twErr) {
+		return err
+	}
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) {
+		return &twilioError{
+			kind:    twilioErrorKind(restErr.Status),
+			Code:    restErr.Code,
+			Status:  restErr.Status,
+			Message: restErr.Message,
+			err:     err,
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return &twilioError{kind: errTwilioTransient, err: err}
+	}
+	return &twilioError{err: err}
+}
+
+// twilioResponseError builds the error for a failed response to a request
+// made without the REST client, like the media service.
+func twilioResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	restErr := &client.TwilioRestError{Status: resp.StatusCode, Message: resp.Status}
+	_ = json.Unmarshal(body, restErr)
+	if restErr.Status == 0 {
+		restErr.Status = resp.StatusCode
+	}
+	return classifyTwilioError(restErr)
+}
+
+// isRetryableTwilioError reports whether the request could succeed if tried
+// again later.
+func isRetryableTwilioError(err error) bool {
+	return errors.Is(err, errTwilioRateLimited) || errors.Is(err, errTwilioTransient)
+}
+
+// twilioErrorText describes an error for the user running a command.
+func twilioErrorText(err error) string {
+	code := ""
+	var twErr *twilioError
+	if errors.As(err, &twErr) && twErr.Code != 0 {
+		code = fmt.Sprintf(" (Twilio error %d)", twErr.Code)
+	}
+	switch {
+	case errors.Is(err, errTwilioNotFound):
+		return "Twilio could not find it" + code + "."
+	case errors.Is(err, errTwilioAuth):
+		return "Twilio rejected the credentials for this account" + code + "."
+	case errors.Is(err, errTwilioRateLimited):
+		return "Twilio is rate limiting requests, try again in a minute" + code + "."
+	case errors.Is(err, errTwilioTransient):
+		return "Twilio could not be reached, try again later" + code + "."
+	case errors.Is(err, context.Canceled):
+		return "The request was cancelled."
+	}
+	return err.Error()
+}
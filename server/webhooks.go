@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	webhookURLKey         = "twilio-webhook-url"
+	previousWebhookURLKey = "twilio-webhook-url-previous"
+)
+
+// checkWebhookURL remembers the webhook URL built from the site URL and lets
+// the admin know when it changed, as Twilio keeps posting to the old one.
+func (p *TwilioPlugin) checkWebhookURL() {
+	current := p.getWebhookURL()
+
+	data, err := p.API.KVGet(webhookURLKey)
+	if err != nil {
+		p.API.LogError("Could not get stored webhook URL", "error", err.Error())
+		return
+	}
+	previous := string(data)
+	if previous == current {
+		return
+	}
+	if err := p.API.KVSet(webhookURLKey, []byte(current)); err != nil {
+		p.API.LogError("Could not store webhook URL", "error", err.Error())
+		return
+	}
+	if previous == "" {
+		return
+	}
+	if err := p.API.KVSet(previousWebhookURLKey, []byte(previous)); err != nil {
+		p.API.LogError("Could not store previous webhook URL", "error", err.Error())
+	}
+
+	p.API.LogInfo("Twilio webhook URL changed", "previous", previous, "current", current)
+	message := fmt.Sprintf("The Twilio webhook URL changed from %s to %s. Existing phone numbers and conversations still send their messages to the old URL. Run `/twilio number webhooks repoint` to move them to the new one.", previous, current)
+	if err := p.notifyAdmin(message); err != nil {
+		p.API.LogError("Could not notify admin about webhook URL change", "error", err.Error())
+	}
+}
+
+// getPreviousWebhookURL returns the webhook URL in use before the last change.
+func (p *TwilioPlugin) getPreviousWebhookURL() (string, error) {
+	data, err := p.API.KVGet(previousWebhookURLKey)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not get previous webhook URL")
+	}
+	return string(data), nil
+}
+
+// notifyAdmin sends a direct message from the bot to the user that installed
+// the plugin, or to a system admin when that user is gone.
+func (p *TwilioPlugin) notifyAdmin(message string) error {
+	bot, err := p.getBot()
+	if err != nil {
+		return err
+	}
+
+	userId := p.getConfiguration().InstallUserId
+	if user, appErr := p.API.GetUser(userId); appErr != nil || user == nil {
+		userList, listErr := p.API.GetUsers(&model.UserGetOptions{
+			Role:    "system_admin",
+			Page:    0,
+			PerPage: 1,
+		})
+		if listErr != nil || len(userList) == 0 {
+			return errors.Wrap(listErr, "Could not find system admin user to notify")
+		}
+		userId = userList[0].Id
+	}
+
+	channel, appErr := p.API.GetDirectChannel(userId, bot.UserId)
+	if appErr != nil {
+		return errors.Wrap(appErr, "Could not get direct channel")
+	}
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    bot.UserId,
+		ChannelId: channel.Id,
+		Message:   message,
+	}); appErr != nil {
+		return errors.Wrap(appErr, "Could not create post")
+	}
+	return nil
+}
+
+// repointWebhooksAsync moves webhooks for every given client and reports the
+// result to the user that ran the command.
+func (p *TwilioPlugin) repointWebhooksAsync(ctx context.Context, clients []ITwilioClient, oldWebhook string, args *model.CommandArgs) {
+	total := 0
+	message := ""
+	for _, twilioClient := range clients {
+		moved, err := twilioClient.RepointWebhooks(ctx, oldWebhook)
+		total += moved
+		if err != nil {
+			message += fmt.Sprintf("Error moving webhooks for account %s: %s\n", twilioClient.Account().Name, twilioErrorText(err))
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	message += fmt.Sprintf("Moved %d webhooks to %s.", total, p.getWebhookURL())
+
+	bot, err := p.getBot()
+	if err != nil {
+		p.API.LogError("Could not get bot", "error", err.Error())
+		return
+	}
+	p.API.SendEphemeralPost(args.UserId, &model.Post{
+		UserId:    bot.UserId,
+		ChannelId: args.ChannelId,
+		Message:   message,
+	})
+}